@@ -0,0 +1,178 @@
+package cargo
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/aewens/nautical/cargo/model"
+)
+
+type Event struct {
+	ID          int64     `json:"id"`
+	Recorded    time.Time `json:"recorded"`
+	Operation   string    `json:"operation"`
+	Kind        string    `json:"kind"`
+	UUID        []byte    `json:"uuid"`
+	Actor       string    `json:"actor"`
+	Before      string    `json:"before"`
+	After       string    `json:"after"`
+	RelatedKind string    `json:"related_kind,omitempty"`
+	RelatedUUID []byte    `json:"related_uuid,omitempty"`
+}
+
+// AuditFilter narrows the audit log; zero fields match everything. UUID
+// matches both the crate written and the entity related to the write, so
+// the history of a tag includes every crate it was mapped to.
+type AuditFilter struct {
+	UUID      []byte
+	Kind      string
+	Operation string
+	Actor     string
+	Since     time.Time
+	Until     time.Time
+	Count     int
+}
+
+func (self AuditFilter) build() (string, []interface{}) {
+	clauses := []string{}
+	args := []interface{}{}
+
+	if len(self.UUID) > 0 {
+		clauses = append(clauses, "(uuid = ? OR related_uuid = ?)")
+		args = append(args, self.UUID, self.UUID)
+	}
+
+	fields := map[string]string{
+		"kind":      self.Kind,
+		"operation": self.Operation,
+		"actor":     self.Actor,
+	}
+
+	for _, field := range []string{"kind", "operation", "actor"} {
+		if len(fields[field]) > 0 {
+			clauses = append(clauses, field + " = ?")
+			args = append(args, fields[field])
+		}
+	}
+
+	if !self.Since.IsZero() {
+		clauses = append(clauses, "recorded >= ?")
+		args = append(args, self.Since.UTC())
+	}
+
+	if !self.Until.IsZero() {
+		clauses = append(clauses, "recorded < ?")
+		args = append(args, self.Until.UTC())
+	}
+
+	statement := `
+		SELECT
+			id, recorded, operation, kind, uuid, actor, before, after,
+			related_kind, related_uuid
+		FROM audit
+	`
+
+	if len(clauses) > 0 {
+		statement = statement + " WHERE " + strings.Join(clauses, " AND ")
+	}
+
+	statement = statement + " ORDER BY id"
+	if self.Count > 0 {
+		statement = statement + " LIMIT ?"
+		args = append(args, self.Count)
+	}
+
+	return statement + ";", args
+}
+
+func events(
+	ctx    context.Context,
+	store  model.Store,
+	filter AuditFilter,
+	fn     func(*Event) error,
+) error {
+	statement, args := filter.build()
+	rows, err := store.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			event Event
+			kind  sql.NullString
+		)
+
+		err = rows.Scan(
+			&event.ID,
+			&event.Recorded,
+			&event.Operation,
+			&event.Kind,
+			&event.UUID,
+			&event.Actor,
+			&event.Before,
+			&event.After,
+			&kind,
+			&event.RelatedUUID,
+		)
+
+		if err != nil {
+			return err
+		}
+
+		event.RelatedKind = kind.String
+		err = fn(&event)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func Audit(
+	ctx    context.Context,
+	store  model.Store,
+	filter AuditFilter,
+) ([]*Event, error) {
+	found := []*Event{}
+	err := events(ctx, store, filter, func(event *Event) error {
+		found = append(found, event)
+		return nil
+	})
+
+	return found, err
+}
+
+// ExportAudit writes the matching events to w as JSON lines, oldest first.
+func ExportAudit(
+	ctx    context.Context,
+	store  model.Store,
+	w      io.Writer,
+	filter AuditFilter,
+) error {
+	encoder := json.NewEncoder(w)
+	return events(ctx, store, filter, func(event *Event) error {
+		return encoder.Encode(event)
+	})
+}
+
+func (self *Hold) Audit(
+	ctx    context.Context,
+	filter AuditFilter,
+) ([]*Event, error) {
+	return Audit(ctx, self.Store, filter)
+}
+
+func (self *Hold) ExportAudit(
+	ctx    context.Context,
+	w      io.Writer,
+	filter AuditFilter,
+) error {
+	return ExportAudit(ctx, self.Store, w, filter)
+}
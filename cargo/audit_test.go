@@ -0,0 +1,107 @@
+package cargo
+
+import (
+	"testing"
+	"bytes"
+	"context"
+	"strings"
+	"encoding/json"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/aewens/nautical/cargo/model"
+)
+
+func TestAudit(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:", WithAudit("importer"), WithSoftDelete(0))
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	tag, err := hold.NewTag()
+	catch(t, err)
+	catch(t, tag.Set("label", []byte("review")))
+	catch(t, tag.Save(ctx))
+
+	crate, err := hold.NewCrate("external")
+	catch(t, err)
+	catch(t, crate.Set("type", []byte("note")))
+	catch(t, crate.Set("name", []byte("draft")))
+	catch(t, crate.Set("body", []byte("text")))
+	catch(t, crate.Save(ctx))
+	catch(t, crate.Map(ctx, tag))
+
+	reviewer := model.WithActor(ctx, "reviewer")
+	catch(t, crate.Set("name", []byte("final")))
+	catch(t, crate.Update(reviewer))
+	catch(t, crate.Unmap(reviewer, tag))
+	catch(t, crate.Delete(reviewer))
+
+	external := crate.(*model.External)
+	events, err := hold.Audit(ctx, AuditFilter{UUID: external.UUID})
+	catch(t, err)
+
+	operations := []string{"save", "map", "update", "unmap", "delete"}
+	if len(events) != len(operations) {
+		t.Fatalf("Expected %d events, found %d", len(operations), len(events))
+	}
+
+	for i, event := range events {
+		if event.Operation != operations[i] {
+			t.Fatalf("Expected %s, found %s", operations[i], event.Operation)
+		}
+	}
+
+	if events[1].After != "label=review" || events[1].RelatedKind != "tag" {
+		t.Fatalf("Did not summarize mapping: %#v", events[1])
+	}
+
+	if events[2].Actor != "reviewer" || events[2].Before == events[2].After {
+		t.Fatalf("Did not record update: %#v", events[2])
+	}
+
+	if !strings.HasSuffix(events[4].After, "trashed") {
+		t.Fatalf("Did not record trash: %s", events[4].After)
+	}
+
+	tagged, err := hold.Audit(ctx, AuditFilter{UUID: tag.UUID, Operation: "map"})
+	catch(t, err)
+
+	if len(tagged) != 1 || !bytes.Equal(tagged[0].UUID, external.UUID) {
+		t.Fatalf("Did not find when crate was tagged: %d", len(tagged))
+	}
+
+	// upserts journal within the transaction that found the existing crate
+	upserted, err := hold.NewTag()
+	catch(t, err)
+	catch(t, upserted.Set("label", []byte("imported")))
+	catch(t, upserted.Upsert(ctx))
+	catch(t, upserted.Upsert(ctx))
+
+	upserts, err := hold.Audit(ctx, AuditFilter{UUID: upserted.UUID})
+	catch(t, err)
+
+	if len(upserts) != 2 || upserts[1].Operation != "update" {
+		t.Fatalf("Did not journal upserts: %d", len(upserts))
+	}
+
+	_, err = hold.Store.Exec(`DELETE FROM audit;`)
+	if err == nil {
+		t.Fatal("Deleted from audit log")
+	}
+
+	var buffer bytes.Buffer
+	catch(t, hold.ExportAudit(ctx, &buffer, AuditFilter{Actor: "importer"}))
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("Did not export events: %d", len(lines))
+	}
+
+	var event Event
+	catch(t, json.Unmarshal([]byte(lines[0]), &event))
+
+	if event.Kind != "tag" || event.Operation != "save" {
+		t.Fatalf("Did not decode event: %#v", event)
+	}
+}
@@ -0,0 +1,188 @@
+package cargo
+
+import (
+	"testing"
+	"bytes"
+	"errors"
+	"fmt"
+	"context"
+	"strings"
+	"path/filepath"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/aewens/nautical/cargo/model"
+	"github.com/aewens/nautical/cargo/repo"
+)
+
+func internals(hold *Hold, count int) ([]model.Entity, error) {
+	entities := []model.Entity{}
+	for i := 0; i < count; i++ {
+		internal, err := model.NewInternal(hold.Vault())
+		if err != nil {
+			return entities, err
+		}
+
+		internal.Type = "batch"
+		internal.Origin = "ingest"
+		internal.Data = []byte(fmt.Sprintf("capture%d", i))
+		entities = append(entities, internal)
+	}
+
+	return entities, nil
+}
+
+func TestBatch(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:")
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	entities, err := internals(hold, 50)
+	catch(t, err)
+
+	entities[7].(*model.Internal).Type = strings.Repeat("x", 65)
+
+	entity, err := hold.NewRepo("internal")
+	catch(t, err)
+
+	irepo := entity.(*repo.Internal)
+	err = irepo.SaveAll(ctx, entities...)
+
+	var failures *repo.BatchErrors
+	if !errors.As(err, &failures) || len(failures.Errors) != 1 {
+		t.Fatalf("Did not report failure: %v", err)
+	}
+
+	if failures.Errors[0].Index != 7 || failures.Errors[0].Entity != entities[7] {
+		t.Fatalf("Reported wrong item: %d", failures.Errors[0].Index)
+	}
+
+	// the blob deposited for the failed crate is rolled back with it
+	count, refs := blobs(t, hold)
+	if StreamSize(irepo.All(ctx)) != 49 || count != 49 || refs != 49 {
+		t.Fatalf("Did not save the rest: %d blobs, %d refs", count, refs)
+	}
+
+	saved := append(append([]model.Entity{}, entities[:7]...), entities[8:]...)
+	for _, entity := range saved {
+		entity.(*model.Internal).Origin = "batch"
+	}
+
+	catch(t, irepo.UpdateAll(ctx, saved...))
+	if StreamSize(irepo.Equals(ctx, "origin", "batch")) != 49 {
+		t.Fatal("Did not update all")
+	}
+
+	tag, err := hold.NewTag()
+	catch(t, err)
+	catch(t, tag.Set("label", []byte("ingested")))
+	catch(t, tag.Save(ctx))
+
+	catch(t, irepo.MapAll(ctx, tag, saved...))
+	tagger := entity.(repo.Tagger)
+	if StreamSize(tagger.Tagged(ctx, "ingested")) != 49 {
+		t.Fatal("Did not map all")
+	}
+
+	catch(t, irepo.DeleteAll(ctx, saved[:10]...))
+	if StreamSize(irepo.All(ctx)) != 39 {
+		t.Fatal("Did not delete all")
+	}
+
+	// entities are left bound to the repo's store, outside the transaction
+	catch(t, saved[10].Update(ctx))
+}
+
+func TestBatchRollback(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:", WithNaturalKey("internal", "type", "hash"))
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	saved, err := internals(hold, 2)
+	catch(t, err)
+
+	irepo := repo.NewInternal(hold.Vault())
+	catch(t, irepo.SaveAll(ctx, saved...))
+
+	_, err = hold.Store.Exec(`
+		CREATE TRIGGER reject BEFORE UPDATE ON internal
+		WHEN new.origin = 'reject'
+		BEGIN
+			SELECT RAISE(ABORT, 'rejected');
+		END;
+	`)
+	catch(t, err)
+
+	// both match a saved crate, the second is rejected after taking it over
+	entities, err := internals(hold, 2)
+	catch(t, err)
+
+	failed := entities[1].(*model.Internal)
+	failed.Origin = "reject"
+	uuid := failed.UUID
+
+	err = irepo.UpsertAll(ctx, entities...)
+
+	var failures *repo.BatchErrors
+	if !errors.As(err, &failures) || len(failures.Errors) != 1 {
+		t.Fatalf("Did not report failure: %v", err)
+	}
+
+	if entities[0].(*model.Internal).ID != saved[0].(*model.Internal).ID {
+		t.Fatal("Did not take over matched crate")
+	}
+
+	if failed.ID != 0 || !bytes.Equal(failed.UUID, uuid) {
+		t.Fatalf("Kept the rolled back crate: %d", failed.ID)
+	}
+}
+
+func benchmark(b *testing.B, write func(*Hold, []model.Entity) error) {
+	path := filepath.Join(b.TempDir(), "bench.db")
+	hold, err := New(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	defer hold.Store.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		entities, err := internals(hold, 100)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.StartTimer()
+		err = write(hold, entities)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSave(b *testing.B) {
+	ctx := context.Background()
+	benchmark(b, func(hold *Hold, entities []model.Entity) error {
+		for _, entity := range entities {
+			err := entity.Save(ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func BenchmarkSaveAll(b *testing.B) {
+	ctx := context.Background()
+	benchmark(b, func(hold *Hold, entities []model.Entity) error {
+		irepo := repo.NewInternal(hold.Vault())
+		return irepo.SaveAll(ctx, entities...)
+	})
+}
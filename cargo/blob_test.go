@@ -0,0 +1,157 @@
+package cargo
+
+import (
+	"testing"
+	"bytes"
+	"context"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/aewens/nautical/cargo/model"
+	"github.com/aewens/nautical/cargo/repo"
+)
+
+func blobs(t *testing.T, hold *Hold) (int, int) {
+	var count, refs int
+	err := hold.Store.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(refs), 0) FROM blob;
+	`).Scan(&count, &refs)
+	catch(t, err)
+
+	return count, refs
+}
+
+func TestBlobs(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:")
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	crates := []model.Entity{}
+	for _, origin := range []string{"feed", "mirror"} {
+		crate, err := hold.NewCrate("internal")
+		catch(t, err)
+		catch(t, crate.Set("type", []byte("html")))
+		catch(t, crate.Set("origin", []byte(origin)))
+		catch(t, crate.Set("data", []byte("<p>same</p>")))
+		catch(t, crate.Save(ctx))
+
+		crates = append(crates, crate)
+	}
+
+	count, refs := blobs(t, hold)
+	if count != 1 || refs != 2 {
+		t.Fatalf("Did not share blob: %d blobs, %d refs", count, refs)
+	}
+
+	repository, err := hold.NewRepo("internal")
+	catch(t, err)
+
+	irepo := repository.(*repo.Internal)
+	hash := crates[0].(*model.Internal).Hash()
+	if StreamSize(irepo.LookupHash(ctx, hash)) != 2 {
+		t.Fatal("Did not look up crates by hash")
+	}
+
+	id, _ := crates[1].ExportMetadata()
+	entity, err := irepo.Get(ctx, id)
+	catch(t, err)
+
+	if string(entity.(*model.Internal).Data) != "<p>same</p>" {
+		t.Fatalf("Did not read blob: %s", entity.(*model.Internal).Data)
+	}
+
+	catch(t, crates[1].Set("data", []byte("<p>changed</p>")))
+	catch(t, crates[1].Update(ctx))
+	catch(t, crates[0].Delete(ctx))
+
+	// the original blob is still held by the revision of the second crate
+	count, refs = blobs(t, hold)
+	if count != 2 || refs != 2 {
+		t.Fatalf("Did not count refs: %d blobs, %d refs", count, refs)
+	}
+
+	catch(t, crates[1].Delete(ctx))
+
+	collected, err := hold.Collect(ctx)
+	catch(t, err)
+
+	count, _ = blobs(t, hold)
+	if collected != 2 || count != 0 {
+		t.Fatalf("Did not collect blobs: %d", collected)
+	}
+}
+
+func TestBlobMigration(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:")
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	catch(t, hold.MigrateTo(8))
+
+	data := []byte("legacy")
+	_, err = hold.Store.Exec(`
+		INSERT INTO internal (uuid, type, origin, data)
+		VALUES (randomblob(32), 'text', 'disk', ?);
+	`, []byte("original"))
+	catch(t, err)
+
+	// the original data is kept inline in a revision as well
+	_, err = hold.Store.Exec(`
+		UPDATE internal SET data = ? WHERE id = 1;
+	`, data)
+	catch(t, err)
+
+	catch(t, hold.Migrate())
+
+	repository, err := hold.NewRepo("internal")
+	catch(t, err)
+
+	entity, err := repository.Get(ctx, 1)
+	catch(t, err)
+
+	if !bytes.Equal(entity.(*model.Internal).Data, data) {
+		t.Fatal("Did not read inline data")
+	}
+
+	moved, err := hold.Deduplicate(ctx)
+	catch(t, err)
+
+	irepo := repository.(*repo.Internal)
+	if moved != 2 || StreamSize(irepo.LookupHash(ctx, model.Digest(data))) != 1 {
+		t.Fatalf("Did not move inline data: %d", moved)
+	}
+
+	revisions, err := irepo.Revisions(ctx, entity)
+	catch(t, err)
+
+	if len(revisions) != 1 {
+		t.Fatalf("Recorded revision for move: %d", len(revisions))
+	}
+
+	if string(revisions[0].Entity.(*model.Internal).Data) != "original" {
+		t.Fatal("Did not move revision data")
+	}
+
+	collected, err := hold.Collect(ctx)
+	catch(t, err)
+
+	count, refs := blobs(t, hold)
+	if collected != 0 || count != 2 || refs != 2 {
+		t.Fatalf("Did not count references: %d blobs, %d refs", count, refs)
+	}
+
+	catch(t, hold.MigrateTo(8))
+
+	var inline []byte
+	err = hold.Store.QueryRow(`SELECT data FROM internal WHERE id = 1;`).Scan(
+		&inline,
+	)
+	catch(t, err)
+
+	if !bytes.Equal(inline, data) {
+		t.Fatalf("Did not restore inline data: %s", inline)
+	}
+}
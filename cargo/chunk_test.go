@@ -0,0 +1,152 @@
+package cargo
+
+import (
+	"testing"
+	"bytes"
+	"context"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/aewens/nautical/cargo/model"
+	"github.com/aewens/nautical/cargo/repo"
+)
+
+func chunks(t *testing.T, hold *Hold) int {
+	var count int
+	err := hold.Store.QueryRow(`SELECT COUNT(*) FROM blob_chunk;`).Scan(&count)
+	catch(t, err)
+
+	return count
+}
+
+func TestChunks(t *testing.T) {
+	ctx := context.Background()
+	size := model.ChunkSize
+	model.ChunkSize = 8
+
+	defer func() {
+		model.ChunkSize = size
+	}()
+
+	hold, err := New(":memory:", WithCompression("gzip"), WithEncryption(
+		model.Secret{ID: "chunks", Key: bytes.Repeat([]byte{3}, 32)},
+	))
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	data := []byte("a capture far larger than a single chunk")
+	crates := []*model.Internal{}
+	for _, origin := range []string{"feed", "mirror"} {
+		crate, err := hold.NewCrate("internal")
+		catch(t, err)
+		catch(t, crate.Set("type", []byte("html")))
+		catch(t, crate.Set("origin", []byte(origin)))
+
+		internal := crate.(*model.Internal)
+		catch(t, internal.SaveFrom(ctx, bytes.NewReader(data)))
+		crates = append(crates, internal)
+	}
+
+	count, refs := blobs(t, hold)
+	if count != 1 || refs != 2 || chunks(t, hold) != 5 {
+		t.Fatalf("Did not share chunks: %d blobs, %d refs", count, refs)
+	}
+
+	entity, err := hold.NewRepo("internal")
+	catch(t, err)
+
+	irepo := entity.(*repo.Internal)
+	found, err := irepo.Metadata(ctx, crates[0].ID)
+	catch(t, err)
+
+	internal := found.(*model.Internal)
+	if internal.Data != nil || internal.Origin != "feed" {
+		t.Fatalf("Invalid metadata: %#v", internal)
+	}
+
+	var copied bytes.Buffer
+	written, err := internal.CopyTo(ctx, &copied)
+	catch(t, err)
+
+	if written != int64(len(data)) || !bytes.Equal(copied.Bytes(), data) {
+		t.Fatalf("Did not stream data: %s", copied.Bytes())
+	}
+
+	found, err = irepo.Get(ctx, crates[1].ID)
+	catch(t, err)
+
+	if !bytes.Equal(found.(*model.Internal).Data, data) {
+		t.Fatal("Did not join chunks")
+	}
+
+	if StreamSize(irepo.LookupHash(ctx, hold.Config.Keyring.Digest(data))) != 2 {
+		t.Fatal("Did not hash streamed data")
+	}
+
+	catch(t, crates[1].SaveFrom(ctx, bytes.NewReader([]byte("replaced"))))
+
+	revisions, err := irepo.Revisions(ctx, crates[1])
+	catch(t, err)
+
+	if len(revisions) != 1 {
+		t.Fatalf("Invalid revisions: %d", len(revisions))
+	}
+
+	if !bytes.Equal(revisions[0].Entity.(*model.Internal).Data, data) {
+		t.Fatal("Did not join chunks of revision")
+	}
+
+	copied.Reset()
+	_, err = crates[1].CopyTo(ctx, &copied)
+	catch(t, err)
+
+	if copied.String() != "replaced" {
+		t.Fatalf("Did not stream update: %s", copied.Bytes())
+	}
+
+	// Data is left nil by SaveFrom, which keeps the streamed data on update
+	crates[1].Origin = "archive"
+	catch(t, crates[1].Update(ctx))
+
+	copied.Reset()
+	_, err = crates[1].CopyTo(ctx, &copied)
+	catch(t, err)
+
+	if copied.String() != "replaced" {
+		t.Fatalf("Did not keep data on update: %s", copied.Bytes())
+	}
+
+	err = crates[0].SaveFrom(ctx, bytes.NewReader([]byte{}))
+	if err == nil {
+		t.Fatal("Saved empty stream")
+	}
+
+	// rolling back would join the sealed chunks in the clear
+	err = hold.MigrateTo(12)
+	if err == nil || chunks(t, hold) == 0 {
+		t.Fatal("Rolled back chunks with encryption keys set")
+	}
+
+	plain, err := New(":memory:", WithCompression("gzip"))
+	catch(t, err)
+
+	defer plain.Store.Close()
+
+	internal, err = model.NewInternal(plain.Vault())
+	catch(t, err)
+
+	internal.Type = "html"
+	internal.Origin = "feed"
+	catch(t, internal.SaveFrom(ctx, bytes.NewReader(data)))
+	catch(t, plain.MigrateTo(12))
+
+	var joined []byte
+	err = plain.Store.QueryRow(`
+		SELECT data FROM blob WHERE hash = ?;
+	`, model.Digest(data)).Scan(&joined)
+	catch(t, err)
+
+	if !bytes.Equal(joined, data) {
+		t.Fatalf("Did not join chunks on rollback: %s", joined)
+	}
+}
@@ -0,0 +1,191 @@
+package cargo
+
+import (
+	"testing"
+	"bytes"
+	"context"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/aewens/nautical/cargo/model"
+	"github.com/aewens/nautical/cargo/repo"
+)
+
+func encodings(t *testing.T, hold *Hold) (int, int) {
+	var bodies, data int
+	err := hold.Store.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM external WHERE typeof(body) = 'blob'),
+			(SELECT COUNT(*) FROM blob WHERE codec != '');
+	`).Scan(&bodies, &data)
+	catch(t, err)
+
+	return bodies, data
+}
+
+func TestCompression(t *testing.T) {
+	ctx := context.Background()
+	_, err := New(":memory:", WithCompression("zstd"))
+	if err == nil {
+		t.Fatal("Accepted unsupported codec")
+	}
+
+	hold, err := New(":memory:", WithCompression("gzip"))
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	long := strings.Repeat("the harbor log repeats itself ", 64)
+	bodies := map[string]string{
+		"short": "tiny",
+		"long":  long,
+	}
+
+	crates := map[string]model.Entity{}
+	for name, body := range bodies {
+		crate, err := hold.NewCrate("external")
+		catch(t, err)
+		catch(t, crate.Set("type", []byte("note")))
+		catch(t, crate.Set("name", []byte(name)))
+		catch(t, crate.Set("body", []byte(body)))
+		catch(t, crate.Save(ctx))
+		crates[name] = crate
+	}
+
+	data := bytes.Repeat([]byte("<p>payload</p>"), 64)
+	internal, err := hold.NewCrate("internal")
+	catch(t, err)
+	catch(t, internal.Set("type", []byte("html")))
+	catch(t, internal.Set("origin", []byte("feed")))
+	catch(t, internal.Set("data", data))
+	catch(t, internal.Save(ctx))
+
+	// the short body grows when compressed, so it is left as plain text
+	compressed, encoded := encodings(t, hold)
+	if compressed != 1 || encoded != 1 {
+		t.Fatalf("Did not compress: %d bodies, %d blobs", compressed, encoded)
+	}
+
+	entity, err := hold.NewRepo("external")
+	catch(t, err)
+
+	erepo := entity.(*repo.External)
+	id, _ := crates["long"].ExportMetadata()
+	found, err := erepo.Get(ctx, id)
+	catch(t, err)
+
+	if found.(*model.External).Body != long {
+		t.Fatal("Did not decompress body")
+	}
+
+	if StreamSize(erepo.Contains(ctx, "body", "repeats itself")) != 1 {
+		t.Fatal("Could not filter compressed body")
+	}
+
+	entity, err = hold.NewRepo("internal")
+	catch(t, err)
+
+	id, _ = internal.ExportMetadata()
+	found, err = entity.Get(ctx, id)
+	catch(t, err)
+
+	if !bytes.Equal(found.(*model.Internal).Data, data) {
+		t.Fatal("Did not decompress data")
+	}
+
+	present, err := exists(hold.Store, "external_search")
+	catch(t, err)
+
+	if present && StreamSize(erepo.Search(ctx, "harbor")) != 1 {
+		t.Fatal("Could not search compressed body")
+	}
+
+	catch(t, crates["long"].Set("body", []byte("rewritten")))
+	catch(t, crates["long"].Update(ctx))
+
+	revisions, err := erepo.Revisions(ctx, crates["long"])
+	catch(t, err)
+
+	if len(revisions) != 1 {
+		t.Fatalf("Invalid revisions: %d", len(revisions))
+	}
+
+	if revisions[0].Entity.(*model.External).Body != long {
+		t.Fatal("Did not decompress revision")
+	}
+
+	hold.Config.Compression = ""
+	rewritten, err := hold.Recompress(ctx)
+	catch(t, err)
+
+	compressed, encoded = encodings(t, hold)
+	if rewritten != 2 || compressed != 0 || encoded != 0 {
+		t.Fatalf("Did not decompress stored values: %d", rewritten)
+	}
+
+	revisions, err = erepo.Revisions(ctx, crates["long"])
+	catch(t, err)
+
+	if len(revisions) != 1 || revisions[0].Entity.(*model.External).Body != long {
+		t.Fatal("Recompressing changed the revisions")
+	}
+
+	if present && StreamSize(erepo.Search(ctx, "harbor")) != 0 {
+		t.Fatal("Search index is out of date")
+	}
+}
+
+func TestCompressionMigration(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:", WithCompression("gzip"))
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	body := strings.Repeat("compressed ", 64)
+	external, err := hold.NewCrate("external")
+	catch(t, err)
+	catch(t, external.Set("type", []byte("note")))
+	catch(t, external.Set("name", []byte("log")))
+	catch(t, external.Set("body", []byte(body)))
+	catch(t, external.Save(ctx))
+
+	data := bytes.Repeat([]byte("compressed"), 64)
+	internal, err := hold.NewCrate("internal")
+	catch(t, err)
+	catch(t, internal.Set("type", []byte("text")))
+	catch(t, internal.Set("origin", []byte("disk")))
+	catch(t, internal.Set("data", data))
+	catch(t, internal.Save(ctx))
+
+	catch(t, hold.MigrateTo(9))
+
+	var (
+		plain  string
+		stored []byte
+	)
+
+	err = hold.Store.QueryRow(`
+		SELECT
+			(SELECT body FROM external WHERE typeof(body) = 'text'),
+			(SELECT data FROM blob);
+	`).Scan(&plain, &stored)
+	catch(t, err)
+
+	if plain != body || !bytes.Equal(stored, data) {
+		t.Fatal("Did not decode values on rollback")
+	}
+
+	catch(t, hold.Migrate())
+
+	entity, err := hold.NewRepo("internal")
+	catch(t, err)
+
+	id, _ := internal.ExportMetadata()
+	found, err := entity.Get(ctx, id)
+	catch(t, err)
+
+	if !bytes.Equal(found.(*model.Internal).Data, data) {
+		t.Fatal("Did not read data after migrating")
+	}
+}
@@ -1,6 +1,7 @@
 package cargo
 
 import (
+	"context"
 	"fmt"
 	"time"
 	"database/sql"
@@ -10,55 +11,335 @@ import (
 )
 
 type Hold struct {
-	Store  *sql.DB
+	Store       *sql.DB
+	Migrations  []Migration
+	AutoMigrate bool
+	Config      *model.Config
+}
+
+type Option func(*Hold) error
+
+func WithAutoMigrate() Option {
+	return func(hold *Hold) error {
+		hold.AutoMigrate = true
+		return nil
+	}
+}
+
+func WithMigrations(migrations ...Migration) Option {
+	return func(hold *Hold) error {
+		hold.Migrations = append(hold.Migrations, migrations...)
+		return nil
+	}
+}
+
+// WithSoftDelete sends deleted crates to the trash instead of removing them.
+// Those that have been there longer than retention are purged when the Hold
+// is opened and whenever Purge is called; nothing purges them in between. A
+// retention of zero keeps them until they are deleted again or emptied.
+func WithSoftDelete(retention time.Duration) Option {
+	return func(hold *Hold) error {
+		if retention < 0 {
+			return fmt.Errorf("Invalid retention: %s", retention)
+		}
+
+		hold.Config.SoftDelete = true
+		hold.Config.Retention = retention
+		return nil
+	}
+}
+
+// WithAudit records every write in the audit log under actor, which a
+// context from model.WithActor can override per call.
+func WithAudit(actor string) Option {
+	return func(hold *Hold) error {
+		hold.Config.Audit = true
+		hold.Config.Actor = actor
+		return nil
+	}
+}
+
+// WithCompression encodes internal data and external bodies with codec, one of
+// model.Codecs, when that makes them smaller. Existing values stay as they are
+// until rewritten or recompressed.
+func WithCompression(codec string) Option {
+	return func(hold *Hold) error {
+		_, ok := model.Codecs[codec]
+		if !ok {
+			return fmt.Errorf("Unsupported codec: %s", codec)
+		}
+
+		hold.Config.Compression = codec
+		return nil
+	}
+}
+
+// WithEncryption seals internal data and external bodies with AES-GCM under
+// the first of keys, keeping the rest to open values sealed with them before.
+// Types, origins, names and timestamps stay in the clear, and sealed bodies
+// are left out of the search index.
+func WithEncryption(keys ...model.Secret) Option {
+	return func(hold *Hold) error {
+		keyring, err := model.NewKeyring(keys...)
+		if err != nil {
+			return err
+		}
+
+		hold.Config.Keyring = keyring
+		return nil
+	}
+}
+
+// WithNaturalKey makes Upsert match crates of crateType on fields, from
+// model.NaturalFields, when no crate has the UUID being written. Importers
+// that mint new UUIDs on every run can then be run again without duplicating
+// crates. The key's columns are indexed once the schema is up to date; a key on
+// the body alone still decodes every body to find a match.
+func WithNaturalKey(crateType string, fields ...string) Option {
+	return func(hold *Hold) error {
+		err := model.CheckNaturalKey(crateType, fields)
+		if err != nil {
+			return err
+		}
+
+		if hold.Config.NaturalKeys == nil {
+			hold.Config.NaturalKeys = make(map[string][]string)
+		}
+
+		hold.Config.NaturalKeys[crateType] = fields
+		return nil
+	}
 }
 
 func Now() time.Time {
 	return model.Now()
 }
 
-func New(conn string) (*Hold, error) {
+// New opens the Hold at conn, migrating a new database to the latest schema.
+// Like Migrate, this leaves a database that only connections opened through
+// this package can write to, as its triggers call functions registered here.
+func New(conn string, options ...Option) (*Hold, error) {
 	var hold *Hold
 
-	store, err := Open(conn, Tables)
+	config := &model.Config{}
+	store, err := Connect(conn, config)
 	if err != nil {
 		return hold, err
 	}
 
 	hold = &Hold{
-		Store:  store,
+		Store:      store,
+		Migrations: append([]Migration{}, Migrations...),
+		Config:     config,
+	}
+
+	for _, option := range options {
+		err = option(hold)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+
+	pending, err := hold.Pending()
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	version, err := hold.Version()
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	current := len(pending) == 0
+	if !current && (version == 0 || hold.AutoMigrate) {
+		err = hold.Migrate()
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+
+		current = true
+	}
+
+	if current {
+		err = model.NaturalIndexes(context.Background(), hold.Vault())
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+
+	if hold.Config.Retention > 0 {
+		_, err = hold.Purge(context.Background())
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
 	}
 
 	return hold, nil
 }
 
-func (self *Hold) NewCrate(crateType string) (model.Entity, error) {
+// Vault is the Store handed to crates and repos, carrying the Hold's Config.
+func (self *Hold) Vault() model.Store {
+	return &model.Vault{
+		Store:  self.Store,
+		Config: self.Config,
+	}
+}
+
+// Purge permanently deletes the crates that have outlived the retention
+// period in the trash.
+func (self *Hold) Purge(ctx context.Context) (int64, error) {
+	if self.Config.Retention <= 0 {
+		return 0, nil
+	}
+
+	return model.Purge(ctx, self.Vault(), Now().Add(-self.Config.Retention))
+}
+
+// Collect deletes the blobs of internal data that nothing refers to anymore.
+func (self *Hold) Collect(ctx context.Context) (int64, error) {
+	return model.Collect(ctx, self.Store)
+}
+
+// Deduplicate moves internal data written before the blob table existed into
+// content-addressed blobs.
+func (self *Hold) Deduplicate(ctx context.Context) (int64, error) {
+	return model.Deduplicate(ctx, self.Vault())
+}
+
+// Recompress rewrites stored internal data and external bodies with the
+// configured codec and keys, or decodes them when both are off.
+func (self *Hold) Recompress(ctx context.Context) (int64, error) {
+	return model.Recompress(ctx, self.Vault())
+}
+
+// Rotate makes key the one that seals new values and reseals everything
+// stored under it. The older keys stay on the keyring, though once Rotate
+// returns nothing needs them anymore.
+func (self *Hold) Rotate(
+	ctx context.Context,
+	key model.Secret,
+) (int64, error) {
+	keyring, err := self.Config.Keyring.Rotate(key)
+	if err != nil {
+		return 0, err
+	}
+
+	self.Config.Keyring = keyring
+	return self.Recompress(ctx)
+}
+
+// Empty permanently deletes everything in the trash.
+func (self *Hold) Empty(ctx context.Context) (int64, error) {
+	return model.Empty(ctx, self.Vault())
+}
+
+func (self *Hold) Version() (int, error) {
+	return Version(self.Store)
+}
+
+func (self *Hold) Pending() ([]Migration, error) {
+	return Pending(self.Store, self.Migrations)
+}
+
+func (self *Hold) Migrate() error {
+	return Migrate(self.Store, self.Migrations, Latest(self.Migrations))
+}
+
+// MigrateTo brings the schema to version, refusing while the Hold has keys to
+// roll back a migration that would write its sealed data back in the clear.
+func (self *Hold) MigrateTo(version int) error {
+	if self.Config.Keyring != nil {
+		applied, err := Applied(self.Store)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range self.Migrations {
+			unseals := migration.Unseals && migration.Version > version
+			if unseals && applied[migration.Version] {
+				return fmt.Errorf(
+					"Cannot roll back %s with encryption keys set",
+					migration.Name,
+				)
+			}
+		}
+	}
+
+	return Migrate(self.Store, self.Migrations, version)
+}
+
+func NewCrate(store model.Store, crateType string) (model.Entity, error) {
 	var crate model.Entity = nil
 
 	switch crateType {
 	case "internal":
-		return model.NewInternal(self.Store)
+		return model.NewInternal(store)
 	case "external":
-		return model.NewExternal(self.Store)
+		return model.NewExternal(store)
 	}
 	return crate, fmt.Errorf("Invalid crate type: %s", crateType)
 }
 
-func (self *Hold) NewTag() (*model.Tag, error) {
-	return model.NewTag(self.Store)
-}
-
-func (self *Hold) NewRepo(repoType string) (repo.Entity, error) {
+func NewRepo(store model.Store, repoType string) (repo.Entity, error) {
 	var repository repo.Entity = nil
 
 	switch repoType {
 	case "internal":
-		return repo.NewInternal(self.Store), nil
+		return repo.NewInternal(store), nil
 	case "external":
-		return repo.NewExternal(self.Store), nil
+		return repo.NewExternal(store), nil
 	case "tag":
-		return repo.NewTag(self.Store), nil
+		return repo.NewTag(store), nil
 	}
 
 	return repository, fmt.Errorf("Invalid repo type: %s", repoType)
 }
+
+// ResolveUUID finds the crate with the given UUID in whichever table holds
+// it, returning sql.ErrNoRows when none does.
+func ResolveUUID(
+	ctx   context.Context,
+	store model.Store,
+	uuid  []byte,
+) (model.Entity, error) {
+	for _, repoType := range []string{"internal", "external", "tag"} {
+		repository, err := NewRepo(store, repoType)
+		if err != nil {
+			return nil, err
+		}
+
+		entity, err := repository.GetByUUID(ctx, uuid)
+		if err == sql.ErrNoRows {
+			continue
+		}
+
+		return entity, err
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (self *Hold) NewCrate(crateType string) (model.Entity, error) {
+	return NewCrate(self.Vault(), crateType)
+}
+
+func (self *Hold) NewTag() (*model.Tag, error) {
+	return model.NewTag(self.Vault())
+}
+
+func (self *Hold) NewRepo(repoType string) (repo.Entity, error) {
+	return NewRepo(self.Vault(), repoType)
+}
+
+func (self *Hold) Resolve(
+	ctx  context.Context,
+	uuid []byte,
+) (model.Entity, error) {
+	return ResolveUUID(ctx, self.Vault(), uuid)
+}
@@ -1,6 +1,8 @@
 package cargo
 
 import (
+	"context"
+	"database/sql"
 	"testing"
 	"fmt"
 	"time"
@@ -17,6 +19,7 @@ func catch(t *testing.T, err error) {
 }
 
 func TestHold(t *testing.T) {
+	ctx := context.Background()
 	hold, err := New(":memory:")
 	catch(t, err)
 
@@ -40,13 +43,13 @@ func TestHold(t *testing.T) {
 	err = tag.Set("label", []byte("test"))
 	catch(t, err)
 
-	err = tag.Save()
+	err = tag.Save(ctx)
 	catch(t, err)
 
 	err = tag.Set("flag", []byte{2})
 	catch(t, err)
 
-	err = tag.Update()
+	err = tag.Update(ctx)
 	catch(t, err)
 
 	icrate, err := hold.NewCrate("internal")
@@ -62,10 +65,10 @@ func TestHold(t *testing.T) {
 	err = icrate.Set("data", []byte{0})
 	catch(t, err)
 
-	err = icrate.Save()
+	err = icrate.Save(ctx)
 	catch(t, err)
 
-	err = icrate.Map(tag)
+	err = icrate.Map(ctx, tag)
 	catch(t, err)
 
 	internal, ok := icrate.(*model.Internal)
@@ -81,7 +84,7 @@ func TestHold(t *testing.T) {
 		t.Fatal("Missing tag mapping")
 	}
 
-	err = icrate.Unmap(tag)
+	err = icrate.Unmap(ctx, tag)
 	catch(t, err)
 
 	if len(internal.Tags) != 0 {
@@ -95,7 +98,7 @@ func TestHold(t *testing.T) {
 	err = icrate.Set("data", []byte{1})
 	catch(t, err)
 
-	err = icrate.Update()
+	err = icrate.Update(ctx)
 	catch(t, err)
 
 	ecrate, err := hold.NewCrate("external")
@@ -111,10 +114,10 @@ func TestHold(t *testing.T) {
 	err = ecrate.Set("body", []byte("test"))
 	catch(t, err)
 
-	err = ecrate.Save()
+	err = ecrate.Save(ctx)
 	catch(t, err)
 
-	err = ecrate.Map(tag)
+	err = ecrate.Map(ctx, tag)
 	catch(t, err)
 
 	external, ok := ecrate.(*model.External)
@@ -130,7 +133,7 @@ func TestHold(t *testing.T) {
 		t.Fatal("Missing tag mapping")
 	}
 
-	err = ecrate.Unmap(tag)
+	err = ecrate.Unmap(ctx, tag)
 	catch(t, err)
 
 	if len(external.Tags) != 0 {
@@ -147,10 +150,10 @@ func TestHold(t *testing.T) {
 	err = ecrate.Set("body", []byte("changed"))
 	catch(t, err)
 
-	err = ecrate.Update()
+	err = ecrate.Update(ctx)
 	catch(t, err)
 
-	err = external.Link(icrate)
+	err = external.Link(ctx, icrate)
 	catch(t, err)
 
 	if external.Meta.ID != internal.ID {
@@ -161,7 +164,20 @@ func TestHold(t *testing.T) {
 		t.Fatal("Failed to link UUID to data")
 	}
 
-	err = external.Unlink()
+	// links are loaded for the whole stream, without the linked data
+	linked, err := repo.NewExternal(hold.Vault()).All(ctx).Entities()
+	catch(t, err)
+
+	loaded := linked[0].(*model.External)
+	if loaded.Meta == nil || loaded.Meta.ID != internal.ID {
+		t.Fatal("Did not load link")
+	}
+
+	if loaded.Meta.Data != nil || string(loaded.Data) != string(internal.UUID) {
+		t.Fatalf("Invalid link: %#v", loaded.Meta)
+	}
+
+	err = external.Unlink(ctx)
 	catch(t, err)
 
 	if external.Meta != nil {
@@ -172,25 +188,28 @@ func TestHold(t *testing.T) {
 		t.Fatal("Failed to unlink UUID")
 	}
 
-	err = ecrate.Delete()
+	err = ecrate.Delete(ctx)
 	catch(t, err)
 
-	err = icrate.Delete()
+	err = icrate.Delete(ctx)
 	catch(t, err)
 
-	err = tag.Delete()
+	err = tag.Delete(ctx)
 	catch(t, err)
 }
 
-func StreamSize(stream repo.Stream) int {
+func StreamSize(stream *repo.Stream) int {
 	count := 0
-	for range stream {
-		count = count + 1
+	for item := range stream.Items {
+		if item.Err == nil {
+			count = count + 1
+		}
 	}
 	return count
 }
 
 func TestRepos(t *testing.T) {
+	ctx := context.Background()
 	now := Now()
 	hold, err := New(":memory:")
 	catch(t, err)
@@ -214,12 +233,13 @@ func TestRepos(t *testing.T) {
 		catch(t, err)
 		err = entity.Set("data", []byte{byte(i)})
 		catch(t, err)
-		err = entity.Save()
+		err = entity.Save(ctx)
 		catch(t, err)
 	}
 
-	istream := irepo.All()
-	irepo.Load(istream)
+	istream := irepo.All(ctx)
+	err = irepo.Load(istream)
+	catch(t, err)
 
 	iirepo, ok := irepo.(*repo.Internal)
 	if !ok {
@@ -230,37 +250,38 @@ func TestRepos(t *testing.T) {
 		t.Fatal("Did not load all entities")
 	}
 
-	count := StreamSize(irepo.Lookup(2))
+	count := StreamSize(irepo.Lookup(ctx, 2))
 	if count != 1 {
 		t.Fatal("Could not lookup entity")
 	}
 
-	count = StreamSize(irepo.Contains("origin", "1"))
+	count = StreamSize(irepo.Contains(ctx, "origin", "1"))
 	if count != 1 {
 		t.Fatal("Could not lookup entity")
 	}
 
-	count = StreamSize(irepo.Equals("origin", "test1"))
+	count = StreamSize(irepo.Equals(ctx, "origin", "test1"))
 	if count != 1 {
 		t.Fatal("Could not lookup entity")
 	}
 
-	count = StreamSize(irepo.Equals("origin", "test1"))
+	count = StreamSize(irepo.Equals(ctx, "origin", "test1"))
 	if count != 1 {
 		t.Fatal("Could not lookup entity")
 	}
 
-	count = StreamSize(irepo.Before("added", now.Add(1 * time.Minute)))
+	count = StreamSize(irepo.Before(ctx, "added", now.Add(1 * time.Minute)))
 	if count != ic {
 		t.Fatal("Could not lookup entities")
 	}
 
-	count = StreamSize(irepo.After("added", now.Add(-1 * time.Minute)))
+	count = StreamSize(irepo.After(ctx, "added", now.Add(-1 * time.Minute)))
 	if count != ic {
 		t.Fatal("Could not lookup entities")
 	}
 
 	count = StreamSize(irepo.Between(
+		ctx,
 		"added",
 		now.Add(-1 * time.Minute),
 		now.Add(1 * time.Minute),
@@ -282,12 +303,13 @@ func TestRepos(t *testing.T) {
 		catch(t, err)
 		err = entity.Set("body", []byte(fmt.Sprintf("body%d", i)))
 		catch(t, err)
-		err = entity.Save()
+		err = entity.Save(ctx)
 		catch(t, err)
 	}
 
-	estream := erepo.All()
-	erepo.Load(estream)
+	estream := erepo.All(ctx)
+	err = erepo.Load(estream)
+	catch(t, err)
 
 	eerepo, ok := erepo.(*repo.External)
 	if !ok {
@@ -298,32 +320,33 @@ func TestRepos(t *testing.T) {
 		t.Fatalf("Did not load all entities: %d", len(eerepo.Crates))
 	}
 
-	count = StreamSize(erepo.Lookup(2))
+	count = StreamSize(erepo.Lookup(ctx, 2))
 	if count != 1 {
 		t.Fatal("Could not lookup entity")
 	}
 
-	count = StreamSize(erepo.Contains("name", "1"))
+	count = StreamSize(erepo.Contains(ctx, "name", "1"))
 	if count != 1 {
 		t.Fatal("Could not lookup entity")
 	}
 
-	count = StreamSize(erepo.Equals("name", "test1"))
+	count = StreamSize(erepo.Equals(ctx, "name", "test1"))
 	if count != 1 {
 		t.Fatal("Could not lookup entity")
 	}
 
-	count = StreamSize(erepo.Before("added", now.Add(1 * time.Minute)))
+	count = StreamSize(erepo.Before(ctx, "added", now.Add(1 * time.Minute)))
 	if count != ec {
 		t.Fatal("Could not lookup entities")
 	}
 
-	count = StreamSize(erepo.After("added", now.Add(-1 * time.Minute)))
+	count = StreamSize(erepo.After(ctx, "added", now.Add(-1 * time.Minute)))
 	if count != ec {
 		t.Fatal("Could not lookup entities")
 	}
 
 	count = StreamSize(erepo.Between(
+		ctx,
 		"added",
 		now.Add(-1 * time.Minute),
 		now.Add(1 * time.Minute),
@@ -341,12 +364,13 @@ func TestRepos(t *testing.T) {
 		catch(t, err)
 		err = entity.Set("label", []byte(fmt.Sprintf("test%d", i)))
 		catch(t, err)
-		err = entity.Save()
+		err = entity.Save(ctx)
 		catch(t, err)
 	}
 
-	tstream := trepo.All()
-	trepo.Load(tstream)
+	tstream := trepo.All(ctx)
+	err = trepo.Load(tstream)
+	catch(t, err)
 
 	ttrepo, ok := trepo.(*repo.Tag)
 	if !ok {
@@ -357,32 +381,33 @@ func TestRepos(t *testing.T) {
 		t.Fatal("Did not load all entities")
 	}
 
-	count = StreamSize(trepo.Lookup(2))
+	count = StreamSize(trepo.Lookup(ctx, 2))
 	if count != 1 {
 		t.Fatal("Could not lookup entity")
 	}
 
-	count = StreamSize(trepo.Contains("label", "1"))
+	count = StreamSize(trepo.Contains(ctx, "label", "1"))
 	if count != 1 {
 		t.Fatal("Could not lookup entity")
 	}
 
-	count = StreamSize(trepo.Equals("label", "test1"))
+	count = StreamSize(trepo.Equals(ctx, "label", "test1"))
 	if count != 1 {
 		t.Fatal("Could not lookup entity")
 	}
 
-	count = StreamSize(trepo.Before("added", now.Add(1 * time.Minute)))
+	count = StreamSize(trepo.Before(ctx, "added", now.Add(1 * time.Minute)))
 	if count != tc {
 		t.Fatal("Could not lookup entities")
 	}
 
-	count = StreamSize(trepo.After("added", now.Add(-1 * time.Minute)))
+	count = StreamSize(trepo.After(ctx, "added", now.Add(-1 * time.Minute)))
 	if count != tc {
 		t.Fatal("Could not lookup entities")
 	}
 
 	count = StreamSize(trepo.Between(
+		ctx,
 		"added",
 		now.Add(-1 * time.Minute),
 		now.Add(1 * time.Minute),
@@ -391,3 +416,272 @@ func TestRepos(t *testing.T) {
 		t.Fatal("Could not lookup entities")
 	}
 }
+
+func TestTx(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:")
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	var internal *model.Internal
+	err = hold.Tx(ctx, func(session *Session) error {
+		icrate, err := session.NewCrate("internal")
+		if err != nil {
+			return err
+		}
+
+		icrate.Set("type", []byte("test"))
+		icrate.Set("origin", []byte("test"))
+		icrate.Set("data", []byte{0})
+		err = icrate.Save(ctx)
+		if err != nil {
+			return err
+		}
+
+		ecrate, err := session.NewCrate("external")
+		if err != nil {
+			return err
+		}
+
+		ecrate.Set("type", []byte("test"))
+		ecrate.Set("name", []byte("test"))
+		ecrate.Set("body", []byte("test"))
+		err = ecrate.Save(ctx)
+		if err != nil {
+			return err
+		}
+
+		tag, err := session.NewTag()
+		if err != nil {
+			return err
+		}
+
+		tag.Set("label", []byte("test"))
+		err = tag.Save(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = ecrate.Map(ctx, icrate)
+		if err != nil {
+			return err
+		}
+
+		err = ecrate.Map(ctx, tag)
+		if err != nil {
+			return err
+		}
+
+		internal = icrate.(*model.Internal)
+		return ecrate.(*model.External).Link(ctx, icrate)
+	})
+	catch(t, err)
+
+	erepo, err := hold.NewRepo("external")
+	catch(t, err)
+
+	entity, err := erepo.Get(ctx, 1)
+	catch(t, err)
+
+	external := entity.(*model.External)
+	if external.Meta == nil || external.Meta.ID != internal.ID {
+		t.Fatal("Did not commit link")
+	}
+
+	failure := fmt.Errorf("failure")
+	err = hold.Tx(ctx, func(session *Session) error {
+		icrate, err := session.NewCrate("internal")
+		if err != nil {
+			return err
+		}
+
+		icrate.Set("type", []byte("test"))
+		icrate.Set("origin", []byte("test"))
+		icrate.Set("data", []byte{1})
+		err = icrate.Save(ctx)
+		if err != nil {
+			return err
+		}
+
+		session.Bind(external)
+		err = external.Map(ctx, icrate)
+		if err != nil {
+			return err
+		}
+
+		return failure
+	})
+
+	if err != failure {
+		t.Fatalf("Did not return failure: %v", err)
+	}
+
+	irepo, err := hold.NewRepo("internal")
+	catch(t, err)
+
+	count := StreamSize(irepo.All(ctx))
+	if count != 1 {
+		t.Fatalf("Did not roll back crates: %d", count)
+	}
+
+	var mappings int
+	err = hold.Store.QueryRow(`SELECT COUNT(*) FROM mapping;`).Scan(&mappings)
+	catch(t, err)
+
+	if mappings != 2 {
+		t.Fatalf("Did not roll back mappings: %d", mappings)
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:")
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	irepo, err := hold.NewRepo("internal")
+	catch(t, err)
+
+	entity, err := irepo.Create()
+	catch(t, err)
+	catch(t, entity.Set("type", []byte("test")))
+	catch(t, entity.Set("origin", []byte("test")))
+	catch(t, entity.Set("data", []byte{0}))
+	catch(t, entity.Save(ctx))
+
+	stream := irepo.Equals(ctx, "missing", "test")
+	count := StreamSize(stream)
+	if count != 0 || stream.Err() == nil {
+		t.Fatal("Did not report query error")
+	}
+
+	entities, err := irepo.Lookup(ctx, 1, 2).Entities()
+	if len(entities) != 1 {
+		t.Fatalf("Did not return found entity: %d", len(entities))
+	}
+
+	rowErrors, ok := err.(*repo.RowErrors)
+	if !ok || len(rowErrors.Errors) != 1 {
+		t.Fatalf("Did not report missing entity: %v", err)
+	}
+}
+
+func TestStreamCancel(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:")
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	irepo, err := hold.NewRepo("internal")
+	catch(t, err)
+
+	for i := 0; i < 3; i++ {
+		entity, err := irepo.Create()
+		catch(t, err)
+		catch(t, entity.Set("type", []byte("test")))
+		catch(t, entity.Set("origin", []byte("test")))
+		catch(t, entity.Set("data", []byte{byte(i)}))
+		catch(t, entity.Save(ctx))
+	}
+
+	stream := irepo.All(ctx)
+	<-stream.Items
+	stream.Cancel()
+
+	if stream.Err() != context.Canceled {
+		t.Fatalf("Did not stop cancelled stream: %v", stream.Err())
+	}
+
+	count := StreamSize(irepo.All(ctx))
+	if count != 3 {
+		t.Fatalf("Did not release connection: %d", count)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	entity, err := irepo.Create()
+	catch(t, err)
+	catch(t, entity.Set("type", []byte("test")))
+	catch(t, entity.Set("origin", []byte("test")))
+	catch(t, entity.Set("data", []byte{3}))
+
+	err = entity.Save(cancelled)
+	if err == nil {
+		t.Fatal("Saved with cancelled context")
+	}
+
+	_, err = irepo.Get(cancelled, 1)
+	if err == nil {
+		t.Fatal("Read with cancelled context")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:")
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	tag, err := hold.NewTag()
+	catch(t, err)
+	catch(t, tag.Set("label", []byte("test")))
+	catch(t, tag.Save(ctx))
+
+	uuids := [][]byte{}
+	for _, crateType := range []string{"internal", "external"} {
+		crate, err := hold.NewCrate(crateType)
+		catch(t, err)
+		catch(t, crate.Set("type", []byte("test")))
+
+		if crateType == "internal" {
+			catch(t, crate.Set("origin", []byte("test")))
+			catch(t, crate.Set("data", []byte{0}))
+		} else {
+			catch(t, crate.Set("name", []byte("test")))
+			catch(t, crate.Set("body", []byte("test")))
+		}
+
+		catch(t, crate.Save(ctx))
+
+		switch typed := crate.(type) {
+		case *model.Internal:
+			uuids = append(uuids, typed.UUID)
+		case *model.External:
+			uuids = append(uuids, typed.UUID)
+		}
+	}
+
+	entity, err := hold.Resolve(ctx, tag.UUID)
+	catch(t, err)
+
+	_, mapper := entity.ExportMetadata()
+	if mapper != "tag" {
+		t.Fatalf("Resolved wrong crate: %s", mapper)
+	}
+
+	entity, err = hold.Resolve(ctx, uuids[1])
+	catch(t, err)
+
+	_, mapper = entity.ExportMetadata()
+	if mapper != "external" {
+		t.Fatalf("Resolved wrong crate: %s", mapper)
+	}
+
+	_, err = hold.Resolve(ctx, make([]byte, 32))
+	if err != sql.ErrNoRows {
+		t.Fatalf("Resolved missing crate: %v", err)
+	}
+
+	irepo, err := hold.NewRepo("internal")
+	catch(t, err)
+
+	count := StreamSize(irepo.LookupUUIDs(ctx, uuids...))
+	if count != 1 {
+		t.Fatalf("Could not lookup UUIDs: %d", count)
+	}
+}
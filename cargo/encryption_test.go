@@ -0,0 +1,244 @@
+package cargo
+
+import (
+	"testing"
+	"bytes"
+	"context"
+	"io/ioutil"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/aewens/nautical/cargo/model"
+	"github.com/aewens/nautical/cargo/repo"
+)
+
+func sealed(t *testing.T, hold *Hold, key string) (int, int) {
+	var bodies, data int
+	err := hold.Store.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM external
+			WHERE instr(CAST(body AS BLOB), CAST(? AS BLOB)) > 0),
+			(SELECT COUNT(*) FROM blob WHERE instr(codec, ?) > 0);
+	`, model.Sealed + key, model.Sealed + key).Scan(&bodies, &data)
+	catch(t, err)
+
+	return bodies, data
+}
+
+func TestEncryption(t *testing.T) {
+	ctx := context.Background()
+	first := model.Secret{ID: "first", Key: bytes.Repeat([]byte{1}, 32)}
+	second := model.Secret{ID: "second", Key: bytes.Repeat([]byte{2}, 16)}
+
+	_, err := New(":memory:", WithEncryption(model.Secret{
+		ID:  "short",
+		Key: []byte("too short"),
+	}))
+	if err == nil {
+		t.Fatal("Accepted invalid key")
+	}
+
+	hold, err := New(":memory:", WithEncryption(first))
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	external, err := hold.NewCrate("external")
+	catch(t, err)
+	catch(t, external.Set("type", []byte("note")))
+	catch(t, external.Set("name", []byte("journal")))
+	catch(t, external.Set("body", []byte("dear diary")))
+	catch(t, external.Save(ctx))
+
+	data := []byte("private capture")
+	internal, err := hold.NewCrate("internal")
+	catch(t, err)
+	catch(t, internal.Set("type", []byte("html")))
+	catch(t, internal.Set("origin", []byte("feed")))
+	catch(t, internal.Set("data", data))
+	catch(t, internal.Save(ctx))
+
+	var leaked int
+	err = hold.Store.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM external
+			WHERE instr(CAST(body AS BLOB), CAST('diary' AS BLOB)) > 0)
+			+ (SELECT COUNT(*) FROM blob
+			WHERE instr(data, CAST('private' AS BLOB)) > 0);
+	`).Scan(&leaked)
+	catch(t, err)
+
+	bodies, blobs := sealed(t, hold, "first")
+	if leaked != 0 || bodies != 1 || blobs != 1 {
+		t.Fatalf("Did not seal: %d bodies, %d blobs", bodies, blobs)
+	}
+
+	entity, err := hold.NewRepo("external")
+	catch(t, err)
+
+	erepo := entity.(*repo.External)
+	if StreamSize(erepo.Contains(ctx, "body", "diary")) != 1 {
+		t.Fatal("Could not filter sealed body")
+	}
+
+	if StreamSize(erepo.Contains(ctx, "type", "note")) != 1 {
+		t.Fatal("Could not filter type")
+	}
+
+	present, err := exists(hold.Store, "external_search")
+	catch(t, err)
+
+	if present && StreamSize(erepo.Search(ctx, "diary")) != 0 {
+		t.Fatal("Indexed sealed body")
+	}
+
+	if present && StreamSize(erepo.Search(ctx, "journal")) != 1 {
+		t.Fatal("Could not search name")
+	}
+
+	catch(t, external.Set("body", []byte("dear diary, again")))
+	catch(t, external.Update(ctx))
+
+	entity, err = hold.NewRepo("internal")
+	catch(t, err)
+
+	id, _ := internal.ExportMetadata()
+	keyring := hold.Config.Keyring
+	hold.Config.Keyring = nil
+
+	_, err = entity.Get(ctx, id)
+	if err == nil {
+		t.Fatal("Opened data without key")
+	}
+
+	hold.Config.Keyring = keyring
+	rotated, err := hold.Rotate(ctx, second)
+	catch(t, err)
+
+	// both bodies, one of them in the revision, and the blob
+	bodies, blobs = sealed(t, hold, "first")
+	if rotated != 3 || bodies != 0 || blobs != 0 {
+		t.Fatalf("Did not rotate key: %d", rotated)
+	}
+
+	hold.Config.Keyring, err = model.NewKeyring(second)
+	catch(t, err)
+
+	found, err := entity.Get(ctx, id)
+	catch(t, err)
+
+	if !bytes.Equal(found.(*model.Internal).Data, data) {
+		t.Fatal("Did not open data after rotating")
+	}
+
+	irepo := entity.(*repo.Internal)
+	digest := hold.Config.Keyring.Digest(data)
+	if StreamSize(irepo.LookupHash(ctx, digest)) != 1 {
+		t.Fatal("Did not hash again after rotating")
+	}
+
+	revisions, err := erepo.Revisions(ctx, external)
+	catch(t, err)
+
+	if len(revisions) != 1 {
+		t.Fatalf("Invalid revisions: %d", len(revisions))
+	}
+
+	if revisions[0].Entity.(*model.External).Body != "dear diary" {
+		t.Fatal("Did not open revision after rotating")
+	}
+}
+
+func TestSealScope(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:", WithEncryption(model.Secret{
+		ID:  "scope",
+		Key: bytes.Repeat([]byte{4}, 32),
+	}))
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	ids := []int64{}
+	for _, data := range []string{"private capture", "public capture"} {
+		internal, err := hold.NewCrate("internal")
+		catch(t, err)
+		catch(t, internal.Set("type", []byte("html")))
+		catch(t, internal.Set("origin", []byte("feed")))
+		catch(t, internal.Set("data", []byte(data)))
+		catch(t, internal.Save(ctx))
+
+		id, _ := internal.ExportMetadata()
+		ids = append(ids, id)
+	}
+
+	var keyed int
+	err = hold.Store.QueryRow(`
+		SELECT COUNT(*) FROM blob WHERE hash = ?;
+	`, model.Digest([]byte("private capture"))).Scan(&keyed)
+	catch(t, err)
+
+	if keyed != 0 {
+		t.Fatal("Stored plain hash of sealed data")
+	}
+
+	_, err = hold.Store.Exec(`
+		UPDATE blob SET data = (
+			SELECT blob.data FROM blob
+			JOIN internal ON internal.blob_id = blob.id WHERE internal.id = ?1
+		) WHERE id = (SELECT blob_id FROM internal WHERE id = ?2);
+	`, ids[0], ids[1])
+	catch(t, err)
+
+	entity, err := hold.NewRepo("internal")
+	catch(t, err)
+
+	_, err = entity.Get(ctx, ids[1])
+	if err == nil {
+		t.Fatal("Opened data copied from another blob")
+	}
+
+	found, err := entity.Get(ctx, ids[0])
+	catch(t, err)
+
+	if string(found.(*model.Internal).Data) != "private capture" {
+		t.Fatal("Did not open data")
+	}
+
+	size := model.ChunkSize
+	model.ChunkSize = 8
+
+	defer func() {
+		model.ChunkSize = size
+	}()
+
+	streamed := []*model.Internal{}
+	for _, data := range []string{"a private stream", "a public stream"} {
+		internal, err := model.NewInternal(hold.Vault())
+		catch(t, err)
+
+		internal.Type = "html"
+		internal.Origin = "stream"
+		catch(t, internal.SaveFrom(ctx, bytes.NewReader([]byte(data))))
+		streamed = append(streamed, internal)
+	}
+
+	// a chunk moved to the same position in another blob no longer opens
+	_, err = hold.Store.Exec(`
+		UPDATE blob_chunk SET data = (
+			SELECT moved.data FROM blob_chunk AS moved
+			JOIN internal ON internal.blob_id = moved.blob_id
+			WHERE internal.id = ?1 AND moved.seq = 0
+		) WHERE seq = 0 AND blob_id = (SELECT blob_id FROM internal WHERE id = ?2);
+	`, streamed[0].ID, streamed[1].ID)
+	catch(t, err)
+
+	_, err = streamed[1].CopyTo(ctx, ioutil.Discard)
+	if err == nil {
+		t.Fatal("Opened chunk moved from another blob")
+	}
+
+	_, err = entity.Get(ctx, streamed[1].ID)
+	if err == nil {
+		t.Fatal("Joined chunk moved from another blob")
+	}
+}
@@ -0,0 +1,102 @@
+package cargo
+
+import (
+	"testing"
+	"context"
+	"time"
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/aewens/nautical/cargo/model"
+	"github.com/aewens/nautical/cargo/repo"
+)
+
+func TestHistory(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:")
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	crate, err := hold.NewCrate("external")
+	catch(t, err)
+	catch(t, crate.Set("type", []byte("note")))
+	catch(t, crate.Set("name", []byte("draft")))
+	catch(t, crate.Set("body", []byte("one\ntwo\nthree")))
+	catch(t, crate.Save(ctx))
+
+	before := Now()
+	time.Sleep(time.Millisecond)
+
+	catch(t, crate.Set("body", []byte("one\n2\nthree\nfour")))
+	catch(t, crate.Update(ctx))
+
+	middle := Now()
+	time.Sleep(time.Millisecond)
+
+	catch(t, crate.Set("name", []byte("final")))
+	catch(t, crate.Update(ctx))
+
+	repository, err := hold.NewRepo("external")
+	catch(t, err)
+
+	erepo := repository.(*repo.External)
+	revisions, err := erepo.Revisions(ctx, crate)
+	catch(t, err)
+
+	if len(revisions) != 2 || revisions[1].Fields[0] != "name" {
+		t.Fatalf("Did not record revisions: %d", len(revisions))
+	}
+
+	id, _ := crate.ExportMetadata()
+	entity, err := erepo.AsOf(ctx, id, before)
+	catch(t, err)
+
+	if entity.(*model.External).Body != "one\ntwo\nthree" {
+		t.Fatalf("Did not read past body: %s", entity.(*model.External).Body)
+	}
+
+	entity, err = erepo.AsOf(ctx, id, middle)
+	catch(t, err)
+
+	past := entity.(*model.External)
+	if past.Name != "draft" || past.Body != "one\n2\nthree\nfour" {
+		t.Fatalf("Did not read intermediate crate: %s", past.Name)
+	}
+
+	_, err = erepo.AsOf(ctx, id, before.Add(-time.Hour))
+	if err != sql.ErrNoRows {
+		t.Fatalf("Found crate before it was added: %v", err)
+	}
+
+	changes, err := erepo.Diff(ctx, crate, revisions[0].ID, 0)
+	catch(t, err)
+
+	expected := []string{"  one", "- two", "+ 2", "  three", "+ four"}
+	if len(changes) != len(expected) {
+		t.Fatalf("Did not diff bodies: %v", changes)
+	}
+
+	for i, change := range changes {
+		if change.String() != expected[i] {
+			t.Fatalf("Expected %q, found %q", expected[i], change.String())
+		}
+	}
+
+	catch(t, erepo.Revert(ctx, crate, revisions[0].ID))
+
+	entity, err = erepo.Get(ctx, id)
+	catch(t, err)
+
+	current := entity.(*model.External)
+	if current.Name != "draft" || current.Body != "one\ntwo\nthree" {
+		t.Fatalf("Did not revert crate: %s", current.Name)
+	}
+
+	revisions, err = erepo.Revisions(ctx, crate)
+	catch(t, err)
+
+	if len(revisions) != 3 {
+		t.Fatalf("Did not record revert: %d", len(revisions))
+	}
+}
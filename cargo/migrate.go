@@ -0,0 +1,515 @@
+package cargo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"database/sql"
+)
+
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	// Requires names a SQLite compile option (e.g. ENABLE_FTS5) without
+	// which the migration is left pending instead of failing.
+	Requires string
+	// Unseals marks a Down that writes sealed data back in the clear, which
+	// a Hold with keys refuses to run.
+	Unseals  bool
+}
+
+// Migrations 2, 11 and 12 build the external_search index and need FTS5, which
+// go-sqlite3 only compiles in with the sqlite_fts5 build tag (go build -tags
+// sqlite_fts5). Without it they are skipped and Search reports that there is
+// no external_search table.
+var Migrations []Migration = []Migration{
+	{
+		Version: 1,
+		Name:    "tables",
+		Up:      Tables,
+		Down:    `
+			DROP TABLE mapping;
+			DROP TABLE tag;
+			DROP TABLE external;
+			DROP TABLE internal;
+		`,
+	},
+	{
+		Version:  2,
+		Name:     "search",
+		Up:       SearchTables,
+		Requires: "ENABLE_FTS5",
+		Down:     `
+			DROP TRIGGER external_search_update;
+			DROP TRIGGER external_search_delete;
+			DROP TRIGGER external_search_insert;
+			DROP TABLE external_search;
+		`,
+	},
+	{
+		Version: 3,
+		Name:    "tag_hierarchy",
+		Up:      TagHierarchy,
+		Down:    `
+			DROP INDEX tag_parent;
+			CREATE TABLE tag_rebuild (
+				id INTEGER PRIMARY KEY,
+				uuid BLOB(32) UNIQUE NOT NULL,
+				added DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+				updated DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+				flag INTEGER DEFAULT 0 NOT NULL,
+				label VARCHAR(128) UNIQUE NOT NULL,
+				CHECK (flag >= 0 AND flag <= 255) -- force unsigned int8
+			);
+			INSERT INTO tag_rebuild (id, uuid, added, updated, flag, label)
+			SELECT id, uuid, added, updated, flag, label FROM tag;
+			DROP TABLE tag;
+			ALTER TABLE tag_rebuild RENAME TO tag;
+		`,
+	},
+	{
+		Version: 4,
+		Name:    "tag_alias",
+		Up:      TagAliases,
+		Down:    `
+			DROP TABLE tag_alias;
+		`,
+	},
+	{
+		Version: 5,
+		Name:    "tag_values",
+		Up:      TagValues,
+		Down:    `
+			DROP INDEX tag_number;
+			DROP INDEX tag_namespace;
+			CREATE TABLE tag_rebuild (
+				id INTEGER PRIMARY KEY,
+				uuid BLOB(32) UNIQUE NOT NULL,
+				added DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+				updated DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+				flag INTEGER DEFAULT 0 NOT NULL,
+				label VARCHAR(128) UNIQUE NOT NULL,
+				parent INTEGER -- allowed to be null
+					REFERENCES tag(id) ON DELETE CASCADE,
+				CHECK (flag >= 0 AND flag <= 255) -- force unsigned int8
+			);
+			INSERT INTO tag_rebuild (id, uuid, added, updated, flag, label, parent)
+			SELECT id, uuid, added, updated, flag, label, parent FROM tag;
+			DROP TABLE tag;
+			ALTER TABLE tag_rebuild RENAME TO tag;
+			CREATE INDEX tag_parent ON tag (parent);
+		`,
+	},
+	{
+		Version: 6,
+		Name:    "trash",
+		Up:      TrashTable,
+		Down:    `
+			DROP TABLE trash;
+		`,
+	},
+	{
+		Version: 7,
+		Name:    "revisions",
+		Up:      RevisionTables,
+		Down:    `
+			DROP TRIGGER external_revision_update;
+			DROP TRIGGER internal_revision_update;
+			DROP TABLE external_revision;
+			DROP TABLE internal_revision;
+		`,
+	},
+	{
+		Version: 8,
+		Name:    "audit",
+		Up:      AuditTable,
+		Down:    `
+			DROP TABLE audit;
+		`,
+	},
+	{
+		Version: 9,
+		Name:    "blobs",
+		Up:      BlobTables,
+		Down:    BlobRollback,
+	},
+	{
+		Version: 10,
+		Name:    "compression",
+		Up:      CompressionTables,
+		Down:    CompressionRollback,
+		Unseals: true,
+	},
+	{
+		Version:  11,
+		Name:     "search_codec",
+		Up:       SearchCodec,
+		Requires: "ENABLE_FTS5",
+		Down:     `
+			DROP TRIGGER external_search_update;
+			DROP TRIGGER external_search_delete;
+			DROP TRIGGER external_search_insert;
+			DROP TABLE external_search;
+			DROP VIEW external_plain;
+			UPDATE external SET body = cargo_text(body)
+			WHERE typeof(body) = 'blob';
+		` + SearchTables,
+	},
+	{
+		Version:  12,
+		Name:     "search_sealed",
+		Up:       SearchSealed,
+		Requires: "ENABLE_FTS5",
+		Down:     `
+			DROP VIEW external_plain;
+		` + SearchCodec,
+	},
+	{
+		Version: 13,
+		Name:    "blob_chunks",
+		Up:      ChunkTables,
+		Down:    `
+			UPDATE blob SET codec = '', data = (
+				SELECT cargo_join(blob_id, seq, codec, data) FROM blob_chunk
+				WHERE blob_chunk.blob_id = blob.id
+			) WHERE id IN (SELECT blob_id FROM blob_chunk); -- joined in the clear
+			DROP TABLE blob_chunk;
+		`,
+		Unseals: true,
+	},
+}
+
+var SchemaVersion string = `
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR(64) NOT NULL,
+		applied DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL
+	);
+`
+
+func Sorted(migrations []Migration) ([]Migration, error) {
+	sorted := make([]Migration, len(migrations))
+	copy(sorted, migrations)
+
+	sort.Slice(sorted, func(i int, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+
+	seen := make(map[int]bool)
+	for _, migration := range sorted {
+		if migration.Version <= 0 {
+			return nil, fmt.Errorf("Invalid migration version: %d", migration.Version)
+		}
+
+		if seen[migration.Version] {
+			return nil, fmt.Errorf("Duplicate migration version: %d", migration.Version)
+		}
+
+		seen[migration.Version] = true
+	}
+
+	return sorted, nil
+}
+
+func exists(store *sql.DB, table string) (bool, error) {
+	var count int
+	err := store.QueryRow(`
+		SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?;
+	`, table).Scan(&count)
+
+	return count > 0, err
+}
+
+// Databases created before schema_version existed already carry the tables
+// from the first migration, so they are treated as being at that version.
+func legacy(store *sql.DB) (bool, error) {
+	tracked, err := exists(store, "schema_version")
+	if err != nil || tracked {
+		return false, err
+	}
+
+	return exists(store, "internal")
+}
+
+// baseline creates schema_version before the first migration runs, recording
+// a legacy database at the version it is treated as being at.
+func baseline(store *sql.DB) error {
+	old, err := legacy(store)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.Exec(SchemaVersion)
+	if err != nil || !old {
+		return err
+	}
+
+	_, err = store.Exec(`
+		INSERT OR IGNORE INTO schema_version (version, name) VALUES (1, ?);
+	`, Migrations[0].Name)
+
+	return err
+}
+
+func Supported(store *sql.DB, migration Migration) (bool, error) {
+	if len(migration.Requires) == 0 {
+		return true, nil
+	}
+
+	var used bool
+	err := store.QueryRow(`SELECT sqlite_compileoption_used(?);`,
+		migration.Requires,
+	).Scan(&used)
+
+	return used, err
+}
+
+// Applied only reads the database, so it reports a legacy database at the
+// first version before baseline has recorded it there.
+func Applied(store *sql.DB) (map[int]bool, error) {
+	applied := make(map[int]bool)
+
+	tracked, err := exists(store, "schema_version")
+	if err != nil {
+		return applied, err
+	}
+
+	if !tracked {
+		old, err := legacy(store)
+		if old {
+			applied[1] = true
+		}
+
+		return applied, err
+	}
+
+	rows, err := store.Query(`SELECT version FROM schema_version;`)
+	if err != nil {
+		return applied, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		err = rows.Scan(&version)
+		if err != nil {
+			return applied, err
+		}
+
+		applied[version] = true
+	}
+
+	return applied, rows.Err()
+}
+
+func Version(store *sql.DB) (int, error) {
+	tracked, err := exists(store, "schema_version")
+	if err != nil {
+		return 0, err
+	}
+
+	if !tracked {
+		old, err := legacy(store)
+		if old {
+			return 1, err
+		}
+
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	err = store.QueryRow(`SELECT MAX(version) FROM schema_version;`).Scan(
+		&version,
+	)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int(version.Int64), nil
+}
+
+// Migrations run on a single connection with foreign keys switched off, as
+// SQLite recommends for schema changes, so that a down step can rebuild a
+// table without cascading deletes. Violations are checked before commit.
+func step(store *sql.DB, migration Migration, up bool) error {
+	ctx := context.Background()
+	conn, err := store.Conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF;`)
+	if err != nil {
+		return err
+	}
+
+	defer conn.ExecContext(ctx, `PRAGMA foreign_keys = ON;`)
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	script := migration.Down
+	if up {
+		script = migration.Up
+	}
+
+	_, err = tx.Exec(script)
+	if err == nil && up {
+		_, err = tx.Exec(`
+			INSERT INTO schema_version (version, name) VALUES (?, ?);
+		`, migration.Version, migration.Name)
+	} else if err == nil {
+		_, err = tx.Exec(`
+			DELETE FROM schema_version WHERE version = ?;
+		`, migration.Version)
+	}
+
+	if err == nil {
+		err = check(tx)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf(
+			"Migration %d (%s) failed: %s",
+			migration.Version,
+			migration.Name,
+			err,
+		)
+	}
+
+	return tx.Commit()
+}
+
+func check(tx *sql.Tx) error {
+	rows, err := tx.Query(`PRAGMA foreign_key_check;`)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+	if rows.Next() {
+		var (
+			table  string
+			rowid  sql.NullInt64
+			parent string
+			index  int
+		)
+
+		err = rows.Scan(&table, &rowid, &parent, &index)
+		if err != nil {
+			return err
+		}
+
+		return fmt.Errorf(
+			"Foreign key violation in %s row %d referencing %s",
+			table,
+			rowid.Int64,
+			parent,
+		)
+	}
+
+	return rows.Err()
+}
+
+// Migrate brings the schema to target. The triggers and views it creates call
+// the cargo_ functions that Connect registers, so once migrated the database
+// can only be written through connections opened by Connect; the sqlite3 shell
+// or a backup or repair tool writing to it fails with "no such function".
+func Migrate(store *sql.DB, migrations []Migration, target int) error {
+	sorted, err := Sorted(migrations)
+	if err != nil {
+		return err
+	}
+
+	err = baseline(store)
+	if err != nil {
+		return err
+	}
+
+	applied, err := Applied(store)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range sorted {
+		if migration.Version > target || applied[migration.Version] {
+			continue
+		}
+
+		supported, err := Supported(store, migration)
+		if err != nil {
+			return err
+		}
+
+		if !supported {
+			continue
+		}
+
+		err = step(store, migration, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := len(sorted) - 1; i >= 0; i-- {
+		migration := sorted[i]
+		if migration.Version <= target || !applied[migration.Version] {
+			continue
+		}
+
+		err = step(store, migration, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func Latest(migrations []Migration) int {
+	latest := 0
+	for _, migration := range migrations {
+		if migration.Version > latest {
+			latest = migration.Version
+		}
+	}
+
+	return latest
+}
+
+func Pending(store *sql.DB, migrations []Migration) ([]Migration, error) {
+	pending := []Migration{}
+
+	sorted, err := Sorted(migrations)
+	if err != nil {
+		return pending, err
+	}
+
+	applied, err := Applied(store)
+	if err != nil {
+		return pending, err
+	}
+
+	for _, migration := range sorted {
+		if applied[migration.Version] {
+			continue
+		}
+
+		supported, err := Supported(store, migration)
+		if err != nil {
+			return pending, err
+		}
+
+		if supported {
+			pending = append(pending, migration)
+		}
+	}
+
+	return pending, nil
+}
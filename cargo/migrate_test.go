@@ -0,0 +1,144 @@
+package cargo
+
+import (
+	"testing"
+	"os"
+	"io/ioutil"
+	"path/filepath"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestMigrations(t *testing.T) {
+	hold, err := New(":memory:")
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	expected := 0
+	for _, migration := range Migrations {
+		supported, err := Supported(hold.Store, migration)
+		catch(t, err)
+
+		if supported && migration.Version > expected {
+			expected = migration.Version
+		}
+	}
+
+	version, err := hold.Version()
+	catch(t, err)
+
+	if version != expected {
+		t.Fatalf("Did not apply migrations: %d of %d", version, expected)
+	}
+
+	pending, err := hold.Pending()
+	catch(t, err)
+
+	if len(pending) != 0 {
+		t.Fatalf("Unexpected pending migrations: %d", len(pending))
+	}
+
+	err = hold.MigrateTo(0)
+	catch(t, err)
+
+	present, err := exists(hold.Store, "internal")
+	catch(t, err)
+
+	if present {
+		t.Fatal("Did not roll back migrations")
+	}
+
+	err = hold.Migrate()
+	catch(t, err)
+
+	present, err = exists(hold.Store, "internal")
+	catch(t, err)
+
+	if !present {
+		t.Fatal("Did not reapply migrations")
+	}
+
+	_, err = Sorted([]Migration{
+		{Version: 1, Name: "first"},
+		{Version: 1, Name: "second"},
+	})
+
+	if err == nil {
+		t.Fatal("Duplicate migration versions are not invalid")
+	}
+}
+
+func TestPending(t *testing.T) {
+	store, err := Open(":memory:")
+	catch(t, err)
+
+	defer store.Close()
+
+	pending, err := Pending(store, Migrations)
+	catch(t, err)
+
+	if len(pending) == 0 {
+		t.Fatal("Missing pending migrations")
+	}
+
+	present, err := exists(store, "schema_version")
+	catch(t, err)
+
+	if present {
+		t.Fatal("Wrote to database while listing pending migrations")
+	}
+}
+
+func TestAutoMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cargo")
+	catch(t, err)
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.db")
+	hold, err := New(path)
+	catch(t, err)
+
+	err = hold.Store.Close()
+	catch(t, err)
+
+	extra := Migration{
+		Version: Latest(Migrations) + 1,
+		Name:    "extra",
+		Up:      `CREATE TABLE extra (id INTEGER PRIMARY KEY);`,
+		Down:    `DROP TABLE extra;`,
+	}
+
+	hold, err = New(path, WithMigrations(extra))
+	catch(t, err)
+
+	pending, err := hold.Pending()
+	catch(t, err)
+
+	if len(pending) != 1 {
+		t.Fatalf("Applied migration without auto migrate: %d", len(pending))
+	}
+
+	err = hold.Store.Close()
+	catch(t, err)
+
+	hold, err = New(path, WithMigrations(extra), WithAutoMigrate())
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	version, err := hold.Version()
+	catch(t, err)
+
+	if version != extra.Version {
+		t.Fatalf("Did not apply pending migration: %d", version)
+	}
+
+	present, err := exists(hold.Store, "extra")
+	catch(t, err)
+
+	if !present {
+		t.Fatal("Missing table from pending migration")
+	}
+}
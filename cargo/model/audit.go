@@ -0,0 +1,181 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+type actorKey struct{}
+
+// WithActor names who is behind the writes made with ctx, overriding the
+// actor configured on the Hold.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func Actor(ctx context.Context, store Store) string {
+	actor, ok := ctx.Value(actorKey{}).(string)
+	if ok {
+		return actor
+	}
+
+	return Settings(store).Actor
+}
+
+// summaries describe a row in a line for the audit log, without copying the
+// payload itself.
+var summaries map[string]string = map[string]string{
+	"internal": `'type=' || type || ' origin=' || origin
+		|| ' data=' || COALESCE(
+			(SELECT blob.size FROM blob WHERE blob.id = blob_id),
+			length(data)
+		)`,
+	"external": `'type=' || type || ' name=' || name
+		|| ' body=' || length(cargo_text(body))`,
+	"tag":      `'label=' || label`,
+}
+
+func summary(table string) string {
+	return fmt.Sprintf(`%s || CASE WHEN id IN (
+		SELECT %s_id FROM trash WHERE %s_id IS NOT NULL
+	) THEN ' trashed' ELSE '' END`, summaries[table], table, table)
+}
+
+func summarize(
+	ctx    context.Context,
+	store  Store,
+	mapper string,
+	id     int64,
+) ([]byte, string, error) {
+	var (
+		uuid []byte
+		line string
+	)
+
+	statement := fmt.Sprintf(
+		"SELECT uuid, %s FROM %s WHERE id = ?;",
+		summary(mapper),
+		mapper,
+	)
+
+	err := store.QueryRowContext(ctx, statement, id).Scan(&uuid, &line)
+	if err == sql.ErrNoRows {
+		return nil, "", nil
+	}
+
+	return uuid, line, err
+}
+
+// Journal runs write against the crate's store and, when the store is
+// audited, records it in the audit log within the same transaction, which is
+// the store write is handed. The summaries describe the crate itself, or the
+// related entity for operations such as map and link.
+func (self *Common) Journal(
+	ctx       context.Context,
+	operation string,
+	related   Entity,
+	write     func(context.Context, Store) error,
+) error {
+	return self.record(ctx, self.Store, operation, related, write)
+}
+
+func (self *Common) record(
+	ctx       context.Context,
+	store     Store,
+	operation string,
+	related   Entity,
+	write     func(context.Context, Store) error,
+) error {
+	if !Settings(store).Audit {
+		return write(ctx, store)
+	}
+
+	return Atomic(ctx, store, func(tx Store) error {
+		mapper, id := self.Mapper, self.ID
+		if related != nil {
+			id, mapper = related.ExportMetadata()
+		}
+
+		_, before, err := summarize(ctx, tx, mapper, id)
+		if err != nil {
+			return err
+		}
+
+		err = write(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		if related == nil {
+			id = self.ID
+		}
+
+		uuid, after, err := summarize(ctx, tx, mapper, id)
+		if err != nil {
+			return err
+		}
+
+		switch operation {
+		case "map", "link":
+			before = ""
+		case "unmap", "unlink":
+			after = ""
+		}
+
+		var kind sql.NullString
+		if related != nil {
+			kind = sql.NullString{String: mapper, Valid: true}
+		} else {
+			uuid = nil
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO audit (
+				recorded, operation, kind, uuid, actor, before, after,
+				related_kind, related_uuid
+			)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);
+		`,
+			Now(),
+			operation,
+			self.Mapper,
+			self.UUID,
+			Actor(ctx, tx),
+			before,
+			after,
+			kind,
+			uuid,
+		)
+
+		return err
+	})
+}
+
+// journal records the purge of every crate in table whose row in the trash
+// matches condition.
+func journal(
+	ctx       context.Context,
+	store     Store,
+	table     string,
+	condition string,
+	args      ...interface{},
+) error {
+	if !Settings(store).Audit {
+		return nil
+	}
+
+	statement := fmt.Sprintf(`
+		INSERT INTO audit (
+			recorded, operation, kind, uuid, actor, before, after
+		)
+		SELECT ?, 'purge', '%s', uuid, ?, %s, ''
+		FROM %s WHERE id IN (
+			SELECT %s_id FROM trash WHERE %s_id IS NOT NULL AND %s
+		);
+	`, table, summary(table), table, table, table, condition)
+
+	args = append([]interface{}{Now(), Actor(ctx, store)}, args...)
+	_, err := store.ExecContext(ctx, statement, args...)
+	return err
+}
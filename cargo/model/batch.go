@@ -0,0 +1,99 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Batch is a transaction that prepares each statement once on the database
+// and hands out copies bound to the transaction, so writes repeated for many
+// crates do not prepare the same statements over and over.
+type Batch struct {
+	Tx         *sql.Tx
+	db         *sql.DB
+	statements map[string]*sql.Stmt
+}
+
+func (self *Batch) PrepareContext(
+	ctx   context.Context,
+	query string,
+) (*sql.Stmt, error) {
+	statement, ok := self.statements[query]
+	if !ok {
+		var err error
+		statement, err = self.db.PrepareContext(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+
+		self.statements[query] = statement
+	}
+
+	// closing the copy leaves the statement prepared for the next crate
+	return self.Tx.StmtContext(ctx, statement), nil
+}
+
+func (self *Batch) ExecContext(
+	ctx   context.Context,
+	query string,
+	args  ...interface{},
+) (sql.Result, error) {
+	return self.Tx.ExecContext(ctx, query, args...)
+}
+
+func (self *Batch) QueryContext(
+	ctx   context.Context,
+	query string,
+	args  ...interface{},
+) (*sql.Rows, error) {
+	return self.Tx.QueryContext(ctx, query, args...)
+}
+
+func (self *Batch) QueryRowContext(
+	ctx   context.Context,
+	query string,
+	args  ...interface{},
+) *sql.Row {
+	return self.Tx.QueryRowContext(ctx, query, args...)
+}
+
+func (self *Batch) close() {
+	for _, statement := range self.statements {
+		statement.Close()
+	}
+}
+
+// Batched runs fn inside a Batch, or inside the transaction store already is
+// (e.g. in a cargo Session) without caching statements.
+func Batched(ctx context.Context, store Store, fn func(Store) error) error {
+	base := store
+	vault, ok := store.(*Vault)
+	if ok {
+		base = vault.Store
+	}
+
+	db, ok := base.(*sql.DB)
+	if !ok {
+		return Atomic(ctx, store, fn)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	batch := &Batch{
+		Tx:         tx,
+		db:         db,
+		statements: make(map[string]*sql.Stmt),
+	}
+
+	defer batch.close()
+	err = fn(Wrap(store, batch))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
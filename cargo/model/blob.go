@@ -0,0 +1,118 @@
+package model
+
+import (
+	"context"
+	"crypto/sha256"
+)
+
+func Digest(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+// deposit stores data in the blob table under its hash unless an identical
+// blob is already there, returning the id of the row holding it. The caller
+// takes the reference by pointing an internal row at it, which the triggers
+// on internal count.
+func deposit(ctx context.Context, store Store, data []byte) (int64, error) {
+	hash := Settings(store).Keyring.Digest(data)
+	codec, encoded, err := encode(store, BlobScope(hash), data)
+	if err != nil {
+		return 0, err
+	}
+
+	// a sealed write never shares a copy of the data left in the clear
+	_, err = store.ExecContext(ctx, `
+		INSERT INTO blob (hash, size, codec, data) VALUES (?, ?, ?, ?)
+		ON CONFLICT (hash) DO UPDATE
+		SET codec = excluded.codec, data = excluded.data
+		WHERE instr(excluded.codec, ?) > 0 AND instr(blob.codec, ?) = 0;
+	`, hash, len(data), codec, encoded, Sealed, Sealed)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err = store.QueryRowContext(ctx, `
+		SELECT id FROM blob WHERE hash = ?;
+	`, hash).Scan(&id)
+
+	return id, err
+}
+
+// Collect deletes the blobs no longer referenced by any internal crate or
+// revision, returning how many were removed.
+func Collect(ctx context.Context, store Store) (int64, error) {
+	result, err := store.ExecContext(ctx, `
+		DELETE FROM blob WHERE refs <= 0;
+	`)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// Deduplicate moves data still stored inline, from before the blob table
+// existed, into blobs. The crates' updated times are left alone, so no
+// revisions are recorded for the move.
+func Deduplicate(ctx context.Context, store Store) (int64, error) {
+	var moved int64 = 0
+	err := Atomic(ctx, store, func(store Store) error {
+		for _, table := range []string{"internal", "internal_revision"} {
+			ids, err := column(ctx, store,
+				"SELECT id FROM " + table + " WHERE blob_id IS NULL;",
+			)
+			if err != nil {
+				return err
+			}
+
+			for _, id := range ids {
+				var data []byte
+				err = store.QueryRowContext(ctx,
+					"SELECT data FROM " + table + " WHERE id = ?;",
+					id,
+				).Scan(&data)
+
+				if err != nil {
+					return err
+				}
+
+				blob, err := deposit(ctx, store, data)
+				if err != nil {
+					return err
+				}
+
+				_, err = store.ExecContext(ctx,
+					"UPDATE " + table + " SET data = ?, blob_id = ? WHERE id = ?;",
+					[]byte{},
+					blob,
+					id,
+				)
+
+				if err != nil {
+					return err
+				}
+
+				// no trigger counts a revision being pointed at a blob
+				if table == "internal_revision" {
+					_, err = store.ExecContext(ctx, `
+						UPDATE blob SET refs = refs + 1 WHERE id = ?;
+					`, blob)
+
+					if err != nil {
+						return err
+					}
+				}
+
+				moved = moved + 1
+			}
+		}
+
+		return nil
+	})
+
+	return moved, err
+}
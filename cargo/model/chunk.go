@@ -0,0 +1,292 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"crypto/rand"
+	"database/sql"
+)
+
+// ChunkSize is how much of a streamed payload is stored in each chunk, and so
+// roughly how much of it is held in memory at once.
+var ChunkSize int = 1 << 20
+
+// chunk stores what r yields as a blob split into chunks, hashing it along the
+// way, and returns the id of the blob holding it. When an identical blob is
+// already stored that one is used instead, taking over the new chunks if they
+// are sealed so the data is not left behind in the clear.
+func chunk(ctx context.Context, store Store, r io.Reader) (int64, error) {
+	placeholder := make([]byte, 32)
+	_, err := rand.Read(placeholder)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := store.ExecContext(ctx, `
+		INSERT INTO blob (hash, size, data) VALUES (?, 0, ?);
+	`, placeholder, []byte{})
+
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	hash := Settings(store).Keyring.hasher()
+	buffer := make([]byte, ChunkSize)
+	size := 0
+
+	for seq := 0; ; seq++ {
+		read, err := io.ReadFull(r, buffer)
+		if read > 0 {
+			hash.Write(buffer[:read])
+			size = size + read
+
+			scope := ChunkScope(id, int64(seq))
+			codec, data, err := encode(store, scope, buffer[:read])
+			if err != nil {
+				return 0, err
+			}
+
+			_, err = store.ExecContext(ctx, `
+				INSERT INTO blob_chunk (blob_id, seq, codec, data)
+				VALUES (?, ?, ?, ?);
+			`, id, seq, codec, data)
+
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if size == 0 {
+		return 0, fmt.Errorf("Data is missing")
+	}
+
+	digest := hash.Sum(nil)
+	var existing int64
+	err = store.QueryRowContext(ctx, `
+		SELECT id FROM blob WHERE hash = ?;
+	`, digest).Scan(&existing)
+
+	if err == sql.ErrNoRows {
+		_, err = store.ExecContext(ctx, `
+			UPDATE blob SET hash = ?, size = ? WHERE id = ?;
+		`, digest, size, id)
+
+		return id, err
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if Settings(store).Keyring != nil {
+		_, err = store.ExecContext(ctx, `
+			DELETE FROM blob_chunk WHERE blob_id = ?;
+		`, existing)
+
+		if err != nil {
+			return 0, err
+		}
+
+		// the chunks are sealed to their blob, so they are sealed again
+		chunks, err := column(ctx, store, `
+			SELECT id FROM blob_chunk WHERE blob_id = ?;
+		`, id)
+
+		if err != nil {
+			return 0, err
+		}
+
+		for _, chunk := range chunks {
+			err = reseal(ctx, store, chunk, existing)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		_, err = store.ExecContext(ctx, `
+			UPDATE blob SET codec = '', data = X'' WHERE id = ?;
+		`, existing)
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	_, err = store.ExecContext(ctx, `
+		DELETE FROM blob WHERE id = ?;
+	`, id)
+
+	return existing, err
+}
+
+// SaveFrom saves the crate, or updates it when it has been saved before, with
+// its data streamed from r in chunks so it is never held in memory whole. Data
+// is left as it is; Open reads the stored data back the same way.
+func (self *Internal) SaveFrom(ctx context.Context, r io.Reader) error {
+	operation := "save"
+	if self.ID > 0 {
+		operation = "update"
+	}
+
+	write := func(ctx context.Context, store Store) error {
+		return self.saveFrom(ctx, store, r)
+	}
+
+	return self.Journal(ctx, operation, nil, write)
+}
+
+func (self *Internal) saveFrom(
+	ctx   context.Context,
+	store Store,
+	r     io.Reader,
+) error {
+	err := self.validate()
+	if err != nil {
+		return err
+	}
+
+	return Atomic(ctx, store, func(store Store) error {
+		blob, err := chunk(ctx, store, r)
+		if err != nil {
+			return err
+		}
+
+		if self.ID > 0 {
+			return self.update(ctx, store, blob)
+		}
+
+		return self.insert(ctx, store, blob)
+	})
+}
+
+type chunks struct {
+	ctx     context.Context
+	store   Store
+	keyring *Keyring
+	blob    int64
+	seq     int
+	buffer  []byte
+}
+
+func (self *chunks) Read(p []byte) (int, error) {
+	for len(self.buffer) == 0 {
+		var (
+			codec string
+			data  []byte
+		)
+
+		err := self.store.QueryRowContext(self.ctx, `
+			SELECT codec, data FROM blob_chunk WHERE blob_id = ? AND seq = ?;
+		`, self.blob, self.seq).Scan(&codec, &data)
+
+		if err == sql.ErrNoRows {
+			return 0, io.EOF
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		scope := ChunkScope(self.blob, int64(self.seq))
+		self.buffer, err = self.keyring.Decode(scope, codec, data)
+		if err != nil {
+			return 0, err
+		}
+
+		self.seq = self.seq + 1
+	}
+
+	read := copy(p, self.buffer)
+	self.buffer = self.buffer[read:]
+	return read, nil
+}
+
+func (self *chunks) Close() error {
+	self.buffer = nil
+	return nil
+}
+
+// Open reads the stored data of the crate, a chunk at a time when it was
+// streamed in, whether or not Data has been loaded.
+func (self *Internal) Open(ctx context.Context) (io.ReadCloser, error) {
+	var (
+		blob   sql.NullInt64
+		inline []byte
+		count  int
+	)
+
+	err := self.Store.QueryRowContext(ctx, `
+		SELECT
+			blob_id, data,
+			(SELECT COUNT(*) FROM blob_chunk WHERE blob_id = internal.blob_id)
+		FROM internal WHERE id = ?;
+	`, self.ID).Scan(&blob, &inline, &count)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keyring := Settings(self.Store).Keyring
+	if !blob.Valid {
+		return ioutil.NopCloser(bytes.NewReader(inline)), nil
+	}
+
+	if count > 0 {
+		return &chunks{
+			ctx:     ctx,
+			store:   self.Store,
+			keyring: keyring,
+			blob:    blob.Int64,
+		}, nil
+	}
+
+	var (
+		hash  []byte
+		codec string
+		data  []byte
+	)
+
+	err = self.Store.QueryRowContext(ctx, `
+		SELECT hash, codec, data FROM blob WHERE id = ?;
+	`, blob.Int64).Scan(&hash, &codec, &data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = keyring.Decode(BlobScope(hash), codec, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// CopyTo writes the stored data of the crate to w, returning how much was
+// written.
+func (self *Internal) CopyTo(ctx context.Context, w io.Writer) (int64, error) {
+	reader, err := self.Open(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	defer reader.Close()
+	return io.Copy(w, reader)
+}
@@ -0,0 +1,261 @@
+package model
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+)
+
+// Sealed prefixes the codec of a value sealed with AES-GCM, followed by the ID
+// of the key that sealed it.
+const Sealed string = "aes-gcm:"
+
+// Secret is a 16, 24 or 32 byte AES key, named by an ID stored beside every
+// value it seals.
+type Secret struct {
+	ID  string
+	Key []byte
+}
+
+// Keyring holds the keys that seal internal data and external bodies. The
+// first key seals new values, the rest are kept to open values sealed before
+// the keyring was rotated. Blob hashes are keyed by the first key as well, so
+// identical payloads are still stored once without the hash giving away what
+// they hold.
+type Keyring struct {
+	Keys []Secret
+}
+
+// BlobScope and ChunkScope name where sealed data is stored, the hash of its
+// blob or the blob and position of its chunk, which the seal is bound to so
+// that the data no longer opens when copied into another blob. Bodies are
+// only bound to their column, as revisions keep copies of them, so a sealed
+// body copied to another row still opens.
+func BlobScope(hash []byte) []byte {
+	return scope("blob", hash)
+}
+
+func ChunkScope(blob int64, seq int64) []byte {
+	position := strconv.FormatInt(blob, 10) + ":" + strconv.FormatInt(seq, 10)
+	return scope("blob_chunk", []byte(position))
+}
+
+var bodies []byte = scope("body", nil)
+
+func scope(table string, key []byte) []byte {
+	return append([]byte(table + "\x00"), key...)
+}
+
+func NewKeyring(keys ...Secret) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("Missing encryption key")
+	}
+
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if len(key.ID) == 0 || strings.ContainsAny(key.ID, ",\x00") {
+			return nil, fmt.Errorf("Invalid key ID: %q", key.ID)
+		}
+
+		if seen[key.ID] {
+			return nil, fmt.Errorf("Duplicate key ID: %s", key.ID)
+		}
+
+		switch len(key.Key) {
+		case 16, 24, 32:
+		default:
+			return nil, fmt.Errorf(
+				"Invalid key size for %s: %d",
+				key.ID,
+				len(key.Key),
+			)
+		}
+
+		seen[key.ID] = true
+	}
+
+	return &Keyring{Keys: keys}, nil
+}
+
+// Rotate returns a keyring that seals with key and can still open everything
+// self could.
+func (self *Keyring) Rotate(key Secret) (*Keyring, error) {
+	keys := []Secret{key}
+	if self != nil {
+		for _, old := range self.Keys {
+			if old.ID != key.ID {
+				keys = append(keys, old)
+			}
+		}
+	}
+
+	return NewKeyring(keys...)
+}
+
+func (self *Keyring) aead(id string) (cipher.AEAD, error) {
+	if self != nil {
+		for _, key := range self.Keys {
+			if key.ID != id {
+				continue
+			}
+
+			block, err := aes.NewCipher(key.Key)
+			if err != nil {
+				return nil, err
+			}
+
+			return cipher.NewGCM(block)
+		}
+	}
+
+	return nil, fmt.Errorf("Missing key: %s", id)
+}
+
+// Digest hashes data for the blob table: an HMAC under a key derived from the
+// current key, or plain sha256 without keys.
+func (self *Keyring) Digest(data []byte) []byte {
+	digest := self.hasher()
+	digest.Write(data)
+	return digest.Sum(nil)
+}
+
+func (self *Keyring) hasher() hash.Hash {
+	if self == nil || len(self.Keys) == 0 {
+		return sha256.New()
+	}
+
+	derive := hmac.New(sha256.New, self.Keys[0].Key)
+	derive.Write([]byte("cargo blob hash"))
+	return hmac.New(sha256.New, derive.Sum(nil))
+}
+
+// Seal encrypts data, already encoded with codec, under the current key with a
+// fresh nonce and bound to scope, returning codec with the seal added. Without
+// keys data is left as it is.
+func (self *Keyring) Seal(
+	scope []byte,
+	codec string,
+	data  []byte,
+) (string, []byte, error) {
+	if self == nil || len(self.Keys) == 0 {
+		return codec, data, nil
+	}
+
+	layer := Sealed + self.Keys[0].ID
+	aead, err := self.aead(self.Keys[0].ID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", nil, err
+	}
+
+	sealed := aead.Seal(nonce, nonce, data, associated(layer, scope))
+	if len(codec) > 0 {
+		layer = codec + "," + layer
+	}
+
+	return layer, sealed, nil
+}
+
+// associated is the additional data a seal is bound to: the layer naming the
+// key, and where the value is stored.
+func associated(layer string, scope []byte) []byte {
+	return append([]byte(layer + "\x00"), scope...)
+}
+
+func (self *Keyring) open(
+	layer string,
+	scope []byte,
+	data  []byte,
+) ([]byte, error) {
+	aead, err := self.aead(strings.TrimPrefix(layer, Sealed))
+	if err != nil {
+		return nil, err
+	}
+
+	size := aead.NonceSize()
+	if len(data) < size {
+		return nil, fmt.Errorf("Invalid sealed value")
+	}
+
+	return aead.Open(nil, data[:size], data[size:], associated(layer, scope))
+}
+
+// Decode reverses every codec in the comma separated chain, last applied
+// first, opening sealed layers with the matching key and scope.
+func (self *Keyring) Decode(
+	scope []byte,
+	codec string,
+	data  []byte,
+) ([]byte, error) {
+	if len(codec) == 0 {
+		return data, nil
+	}
+
+	layers := strings.Split(codec, ",")
+	for index := len(layers) - 1; index >= 0; index-- {
+		var err error
+		if strings.HasPrefix(layers[index], Sealed) {
+			data, err = self.open(layers[index], scope, data)
+		} else {
+			data, err = Decode(layers[index], data)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+// Text reverses the encoding of a text column: strings come back as they are
+// and packed values are decoded.
+func (self *Keyring) Text(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case []byte:
+		codec, data, err := Unpack(value)
+		if err != nil {
+			return "", err
+		}
+
+		decoded, err := self.Decode(bodies, codec, data)
+		return string(decoded), err
+	}
+
+	return fmt.Sprint(value), nil
+}
+
+// Index is the text of a body column to put in the search index. Sealed
+// bodies are left out, as the index would hold their words in the clear.
+func Index(value interface{}) (string, error) {
+	packed, ok := value.([]byte)
+	if ok {
+		codec, _, err := Unpack(packed)
+		if err != nil {
+			return "", err
+		}
+
+		if strings.Contains(codec, Sealed) {
+			return "", nil
+		}
+	}
+
+	var keyring *Keyring
+	return keyring.Text(value)
+}
@@ -0,0 +1,437 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"compress/gzip"
+	"database/sql"
+)
+
+type Codec interface {
+	Encode([]byte) ([]byte, error)
+	Decode([]byte) ([]byte, error)
+}
+
+type Gzip struct{}
+
+func (self Gzip) Encode(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+
+	_, err := writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.Close()
+	return buffer.Bytes(), err
+}
+
+func (self Gzip) Decode(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// Codecs are looked up by the marker stored beside each encoded value, so a
+// codec must keep its name once anything has been written with it.
+var Codecs map[string]Codec = map[string]Codec{
+	"gzip": Gzip{},
+}
+
+func Encode(codec string, data []byte) ([]byte, error) {
+	if len(codec) == 0 {
+		return data, nil
+	}
+
+	encoder, ok := Codecs[codec]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported codec: %s", codec)
+	}
+
+	return encoder.Encode(data)
+}
+
+func Decode(codec string, data []byte) ([]byte, error) {
+	if len(codec) == 0 {
+		return data, nil
+	}
+
+	decoder, ok := Codecs[codec]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported codec: %s", codec)
+	}
+
+	return decoder.Decode(data)
+}
+
+// compress encodes data with codec, falling back to storing it as is when
+// encoding would not make it smaller; the codec actually used is returned.
+func compress(codec string, data []byte) (string, []byte, error) {
+	encoded, err := Encode(codec, data)
+	if err != nil || len(encoded) >= len(data) {
+		return "", data, err
+	}
+
+	return codec, encoded, nil
+}
+
+// Pack marks an encoded text value with its codec. Plain text is stored as
+// TEXT and packed values as BLOB, which tells the two apart.
+func Pack(codec string, data []byte) []byte {
+	packed := append([]byte(codec), 0)
+	return append(packed, data...)
+}
+
+func Unpack(packed []byte) (string, []byte, error) {
+	index := bytes.IndexByte(packed, 0)
+	if index < 0 {
+		return "", nil, fmt.Errorf("Missing codec marker")
+	}
+
+	return string(packed[:index]), packed[index+1:], nil
+}
+
+// encode prepares data for storage under the store's settings: compressed
+// when that makes it smaller, then sealed to scope when the store has keys.
+// The chain of codecs applied is returned with it.
+func encode(
+	store Store,
+	scope []byte,
+	data  []byte,
+) (string, []byte, error) {
+	config := Settings(store)
+	codec, data, err := compress(config.Compression, data)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return config.Keyring.Seal(scope, codec, data)
+}
+
+// body prepares text for a column, packing it when the store compresses or
+// seals it.
+func body(store Store, text string) (interface{}, error) {
+	codec, data, err := encode(store, bodies, []byte(text))
+	if err != nil || len(codec) == 0 {
+		return text, err
+	}
+
+	return Pack(codec, data), nil
+}
+
+// Recompress rewrites stored blobs and text bodies with the store's codec and
+// keys, or back to plain values when it has neither. Sealed values are always
+// rewritten, which moves them to the current key. Updated times are left
+// alone, so no revisions are recorded; the number of rows rewritten is
+// returned. Blobs are hashed again as well, since their hashes are keyed.
+func Recompress(ctx context.Context, store Store) (int64, error) {
+	var rewritten int64 = 0
+	err := Atomic(ctx, store, func(store Store) error {
+		count, err := recode(ctx, store)
+		if err != nil {
+			return err
+		}
+
+		rewritten = rewritten + count
+		count, err = reblob(ctx, store)
+		if err != nil {
+			return err
+		}
+
+		rewritten = rewritten + count
+
+		for _, table := range []string{"external", "external_revision"} {
+			count, err := rewrite(ctx, store, table)
+			if err != nil {
+				return err
+			}
+
+			rewritten = rewritten + count
+		}
+
+		return nil
+	})
+
+	return rewritten, err
+}
+
+// recode rewrites the encoded data of blob chunks.
+func recode(ctx context.Context, store Store) (int64, error) {
+	var rewritten int64 = 0
+	config := Settings(store)
+	ids, err := column(ctx, store, `
+		SELECT id FROM blob_chunk
+		WHERE codec != ? OR instr(codec, ?) > 0 OR ?;
+	`, config.Compression, Sealed, config.Keyring != nil)
+
+	if err != nil {
+		return rewritten, err
+	}
+
+	for _, id := range ids {
+		err = reseal(ctx, store, id, 0)
+		if err != nil {
+			return rewritten, err
+		}
+
+		rewritten = rewritten + 1
+	}
+
+	return rewritten, nil
+}
+
+// reseal encodes a chunk again for the blob it is moved to, or for the blob
+// it is in when blob is 0.
+func reseal(ctx context.Context, store Store, id int64, blob int64) error {
+	var (
+		owner int64
+		seq   int64
+		codec string
+		data  []byte
+	)
+
+	err := store.QueryRowContext(ctx, `
+		SELECT blob_id, seq, codec, data FROM blob_chunk WHERE id = ?;
+	`, id).Scan(&owner, &seq, &codec, &data)
+
+	if err != nil {
+		return err
+	}
+
+	if blob == 0 {
+		blob = owner
+	}
+
+	keyring := Settings(store).Keyring
+	plain, err := keyring.Decode(ChunkScope(owner, seq), codec, data)
+	if err != nil {
+		return err
+	}
+
+	codec, data, err = encode(store, ChunkScope(blob, seq), plain)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.ExecContext(ctx, `
+		UPDATE blob_chunk SET blob_id = ?, codec = ?, data = ? WHERE id = ?;
+	`, blob, codec, data, id)
+
+	return err
+}
+
+// reblob hashes every blob again under the current keys, rewriting the data
+// of whole blobs along the way as it is sealed to the hash. Chunked blobs are
+// read back a chunk at a time to be hashed, their empty data is left alone.
+func reblob(ctx context.Context, store Store) (int64, error) {
+	var rewritten int64 = 0
+	config := Settings(store)
+	ids, err := column(ctx, store, `SELECT id FROM blob;`)
+	if err != nil {
+		return rewritten, err
+	}
+
+	for _, id := range ids {
+		var (
+			hash  []byte
+			codec string
+			data  []byte
+			count int
+		)
+
+		err = store.QueryRowContext(ctx, `
+			SELECT
+				hash, codec, data,
+				(SELECT COUNT(*) FROM blob_chunk WHERE blob_id = blob.id)
+			FROM blob WHERE id = ?;
+		`, id).Scan(&hash, &codec, &data, &count)
+
+		if err != nil {
+			return rewritten, err
+		}
+
+		digest := config.Keyring.hasher()
+		recoded := false
+		if count > 0 {
+			_, err = io.Copy(digest, &chunks{
+				ctx:     ctx,
+				store:   store,
+				keyring: config.Keyring,
+				blob:    id,
+			})
+
+			if err != nil {
+				return rewritten, err
+			}
+		} else {
+			plain, err := config.Keyring.Decode(BlobScope(hash), codec, data)
+			if err != nil {
+				return rewritten, err
+			}
+
+			digest.Write(plain)
+			recoded = codec != config.Compression ||
+				strings.Contains(codec, Sealed) ||
+				config.Keyring != nil
+
+			if recoded {
+				codec, data, err = encode(store, BlobScope(digest.Sum(nil)), plain)
+				if err != nil {
+					return rewritten, err
+				}
+
+				_, err = store.ExecContext(ctx, `
+					UPDATE blob SET codec = ?, data = ? WHERE id = ?;
+				`, codec, data, id)
+
+				if err != nil {
+					return rewritten, err
+				}
+			}
+		}
+
+		rehashed := !bytes.Equal(hash, digest.Sum(nil))
+		if rehashed {
+			err = rehash(ctx, store, id, digest.Sum(nil))
+			if err != nil {
+				return rewritten, err
+			}
+		}
+
+		if recoded || rehashed {
+			rewritten = rewritten + 1
+		}
+	}
+
+	return rewritten, nil
+}
+
+// rehash moves a blob to a new hash, or folds it into the blob already stored
+// under that hash. References from revisions are carried over by hand, as no
+// trigger follows them being moved.
+func rehash(
+	ctx   context.Context,
+	store Store,
+	id    int64,
+	hash  []byte,
+) error {
+	var existing int64
+	err := store.QueryRowContext(ctx, `
+		SELECT id FROM blob WHERE hash = ?;
+	`, hash).Scan(&existing)
+
+	if err == sql.ErrNoRows {
+		_, err = store.ExecContext(ctx, `
+			UPDATE blob SET hash = ? WHERE id = ?;
+		`, hash, id)
+
+		return err
+	}
+
+	if err != nil {
+		return err
+	}
+
+	statements := []string{
+		`UPDATE blob SET refs = refs + (
+			SELECT COUNT(*) FROM internal_revision WHERE blob_id = ?1
+		) WHERE id = ?2;`,
+		"UPDATE internal_revision SET blob_id = ?2 WHERE blob_id = ?1;",
+		"UPDATE internal SET blob_id = ?2 WHERE blob_id = ?1;",
+		"DELETE FROM blob WHERE id = ?1;",
+	}
+
+	for _, statement := range statements {
+		_, err = store.ExecContext(ctx, statement, id, existing)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func rewrite(ctx context.Context, store Store, table string) (int64, error) {
+	var rewritten int64 = 0
+	config := Settings(store)
+	ids, err := column(ctx, store, fmt.Sprintf(`
+		SELECT id FROM %s WHERE typeof(body) = 'blob' OR ?;
+	`, table), config.Compression != "" || config.Keyring != nil)
+
+	if err != nil {
+		return rewritten, err
+	}
+
+	for _, id := range ids {
+		var value interface{}
+		err = store.QueryRowContext(ctx, fmt.Sprintf(`
+			SELECT body FROM %s WHERE id = ?;
+		`, table), id).Scan(&value)
+
+		if err != nil {
+			return rewritten, err
+		}
+
+		plain, err := config.Keyring.Text(value)
+		if err != nil {
+			return rewritten, err
+		}
+
+		text, err := body(store, plain)
+		if err != nil {
+			return rewritten, err
+		}
+
+		_, unchanged := text.(string)
+		if _, plainly := value.(string); plainly && unchanged {
+			continue
+		}
+
+		_, err = store.ExecContext(ctx, fmt.Sprintf(`
+			UPDATE %s SET body = ? WHERE id = ?;
+		`, table), text, id)
+
+		if err != nil {
+			return rewritten, err
+		}
+
+		rewritten = rewritten + 1
+	}
+
+	return rewritten, nil
+}
+
+func column(
+	ctx       context.Context,
+	store     Store,
+	statement string,
+	args      ...interface{},
+) ([]int64, error) {
+	ids := []int64{}
+	rows, err := store.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return ids, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return ids, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
@@ -1,15 +1,35 @@
 package model
 
 import (
+	"context"
 	"time"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
 	"database/sql"
+	"fmt"
 )
 
+type Store interface {
+	PrepareContext(context.Context, string) (*sql.Stmt, error)
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+}
+
+// Key identifies the other side of a mapping row, since internal, external
+// and tag ids are drawn from separate tables and can collide.
+type Key struct {
+	Mapper string
+	ID     int64
+}
+
+type Beginner interface {
+	BeginTx(context.Context, *sql.TxOptions) (*sql.Tx, error)
+}
+
 type Common struct {
-	Store   *sql.DB   `json:"-"`
+	Store   Store     `json:"-"`
 	Mapper  string    `json:"-"`
 	ID      int64     `json:"-"`
 	UUID    []byte    `json:"uuid"`
@@ -42,7 +62,7 @@ func Now() time.Time {
 	return time.Now().UTC()
 }
 
-func NewCommon(store *sql.DB, mapper string) (Common, error) {
+func NewCommon(store Store, mapper string) (Common, error) {
 	var self Common
 
 	uuid, err := NewUUID()
@@ -59,3 +79,143 @@ func NewCommon(store *sql.DB, mapper string) (Common, error) {
 
 	return self, nil
 }
+
+func (self *Common) Bind(store Store) {
+	self.Store = store
+}
+
+// Snapshot returns a function that puts back the ID, UUID and times the crate
+// has now, for when a write to it is rolled back.
+func (self *Common) Snapshot() func() {
+	id, uuid, added, updated := self.ID, self.UUID, self.Added, self.Updated
+	return func() {
+		self.ID = id
+		self.UUID = uuid
+		self.Added = added
+		self.Updated = updated
+	}
+}
+
+// Nullable maps the zero id to NULL for optional foreign keys.
+func Nullable(id int64) sql.NullInt64 {
+	return sql.NullInt64{
+		Int64: id,
+		Valid: id != 0,
+	}
+}
+
+// Atomic runs fn inside a transaction, or directly against store when it is
+// already one (e.g. inside a cargo Session).
+func Atomic(ctx context.Context, store Store, fn func(Store) error) error {
+	vault, ok := store.(*Vault)
+	if ok {
+		return vault.begin(ctx, fn)
+	}
+
+	db, ok := store.(Beginner)
+	if !ok {
+		return fn(store)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// remove moves the crate to the trash when the store asks for soft deletes,
+// reporting false when it was already there and should be deleted outright.
+func (self *Common) remove(ctx context.Context, store Store) (bool, error) {
+	if !Settings(store).SoftDelete {
+		return false, nil
+	}
+
+	statement := fmt.Sprintf(`
+		INSERT OR IGNORE INTO trash (%s_id, deleted) VALUES (?, ?);
+	`, self.Mapper)
+
+	result, err := store.ExecContext(ctx, statement, self.ID, Now())
+	if err != nil {
+		return false, err
+	}
+
+	trashed, err := result.RowsAffected()
+	return trashed > 0, err
+}
+
+// Restore takes the crate back out of the trash, along with the mappings it
+// kept while it was there.
+func (self *Common) Restore(ctx context.Context) error {
+	return self.Journal(ctx, "restore", nil, self.restore)
+}
+
+func (self *Common) restore(ctx context.Context, store Store) error {
+	statement := fmt.Sprintf(`
+		DELETE FROM trash WHERE %s_id = ?;
+	`, self.Mapper)
+
+	_, err := store.ExecContext(ctx, statement, self.ID)
+	return err
+}
+
+// Purge permanently deletes every crate that has been in the trash since
+// before the given time, returning how many were removed.
+func Purge(ctx context.Context, store Store, before time.Time) (int64, error) {
+	return purge(ctx, store, "deleted < ?", before)
+}
+
+// Empty permanently deletes every crate in the trash, returning how many were
+// removed.
+func Empty(ctx context.Context, store Store) (int64, error) {
+	return purge(ctx, store, "1")
+}
+
+// purge permanently deletes the crates whose rows in the trash match
+// condition.
+func purge(
+	ctx       context.Context,
+	store     Store,
+	condition string,
+	args      ...interface{},
+) (int64, error) {
+	var purged int64 = 0
+	err := Atomic(ctx, store, func(store Store) error {
+		for _, table := range []string{"internal", "external", "tag"} {
+			err := journal(ctx, store, table, condition, args...)
+			if err != nil {
+				return err
+			}
+
+			statement := fmt.Sprintf(`
+				DELETE FROM %s WHERE id IN (
+					SELECT %s_id FROM trash
+					WHERE %s_id IS NOT NULL AND %s
+				);
+			`, table, table, table, condition)
+
+			result, err := store.ExecContext(ctx, statement, args...)
+			if err != nil {
+				return err
+			}
+
+			count, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+
+			purged = purged + count
+		}
+
+		return nil
+	})
+
+	return purged, err
+}
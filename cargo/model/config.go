@@ -0,0 +1,55 @@
+package model
+
+import (
+	"context"
+	"time"
+)
+
+// Config holds the settings of a Hold that change how crates are written.
+type Config struct {
+	SoftDelete  bool
+	Retention   time.Duration
+	Audit       bool
+	Actor       string
+	Compression string
+	Keyring     *Keyring
+	NaturalKeys map[string][]string
+}
+
+// Vault is a Store carrying the Config of the Hold it came from, so models and
+// repos built on it follow the Hold's settings.
+type Vault struct {
+	Store
+	Config *Config
+}
+
+// Settings returns the Config carried by store, or the defaults when it is a
+// bare connection or transaction.
+func Settings(store Store) *Config {
+	vault, ok := store.(*Vault)
+	if !ok || vault.Config == nil {
+		return &Config{}
+	}
+
+	return vault.Config
+}
+
+// Wrap binds store to the Config of base, leaving store as is when base has no
+// Config of its own.
+func Wrap(base Store, store Store) Store {
+	vault, ok := base.(*Vault)
+	if !ok {
+		return store
+	}
+
+	return &Vault{
+		Store:  store,
+		Config: vault.Config,
+	}
+}
+
+func (self *Vault) begin(ctx context.Context, fn func(Store) error) error {
+	return Atomic(ctx, self.Store, func(store Store) error {
+		return fn(Wrap(self, store))
+	})
+}
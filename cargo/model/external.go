@@ -1,11 +1,11 @@
 package model
 
 import (
+	"context"
 	"io"
 	"fmt"
 	"log"
 	"encoding/json"
-	"database/sql"
 )
 
 type External struct {
@@ -15,11 +15,11 @@ type External struct {
 	Body    string          `json:"body"`
 	Data    []byte          `json:"data"`
 	Tags    []Entity        `json:"tags"`
-	Mapping map[int64]int64 `json:"-"`
+	Mapping map[Key]int64   `json:"-"`
 	Meta    *Internal       `json:"-"`
 }
 
-func NewExternal(store *sql.DB) (*External, error) {
+func NewExternal(store Store) (*External, error) {
 	var self *External
 	var data []byte
 
@@ -32,7 +32,7 @@ func NewExternal(store *sql.DB) (*External, error) {
 		Common:  common,
 		Data:    data,
 		Tags:    []Entity{},
-		Mapping: make(map[int64]int64),
+		Mapping: make(map[Key]int64),
 	}
 
 	return self, nil
@@ -79,7 +79,11 @@ func (self *External) Set(key string, value []byte) error {
 	return nil
 }
 
-func (self *External) Save() error {
+func (self *External) Save(ctx context.Context) error {
+	return self.Journal(ctx, "save", nil, self.save)
+}
+
+func (self *External) save(ctx context.Context, store Store) error {
 	if len(self.UUID) != 32 {
 		return fmt.Errorf("UUID is not 32 bytes: %x", self.UUID)
 	}
@@ -100,7 +104,12 @@ func (self *External) Save() error {
 		return fmt.Errorf("Data is invalid: %x", self.Data)
 	}
 
-	statement, err := self.Store.Prepare(`
+	text, err := body(store, self.Body)
+	if err != nil {
+		return err
+	}
+
+	statement, err := store.PrepareContext(ctx, `
 		INSERT INTO external (uuid, flag, type, name, body)
 		VALUES (?, ?, ?, ?, ?);
 	`)
@@ -110,12 +119,13 @@ func (self *External) Save() error {
 	}
 
 	defer statement.Close()
-	result, err := statement.Exec(
+	result, err := statement.ExecContext(
+		ctx,
 		self.UUID,
 		self.Flag,
 		self.Type,
 		self.Name,
-		self.Body,
+		text,
 	)
 
 	if err != nil {
@@ -131,11 +141,27 @@ func (self *External) Save() error {
 	return nil
 }
 
-func (self *External) Update() error {
+// Update writes the crate back. A Body left empty, as Metadata loads it,
+// keeps the body already stored.
+func (self *External) Update(ctx context.Context) error {
+	return self.Journal(ctx, "update", nil, self.revise)
+}
+
+func (self *External) revise(ctx context.Context, store Store) error {
+	var text interface{}
+	if len(self.Body) > 0 {
+		var err error
+		text, err = body(store, self.Body)
+		if err != nil {
+			return err
+		}
+	}
+
 	self.Updated = Now()
-	statement, err := self.Store.Prepare(`
+	statement, err := store.PrepareContext(ctx, `
 		UPDATE external
-		SET updated = ?, flag = ?, type = ?, name = ?, body = ?
+		SET updated = ?, flag = ?, type = ?, name = ?,
+			body = COALESCE(?, body)
 		WHERE id = ?
 	`)
 
@@ -144,12 +170,13 @@ func (self *External) Update() error {
 	}
 
 	defer statement.Close()
-	_, err = statement.Exec(
+	_, err = statement.ExecContext(
+		ctx,
 		self.Updated,
 		self.Flag,
 		self.Type,
 		self.Name,
-		self.Body,
+		text,
 		self.ID,
 	)
 
@@ -160,8 +187,17 @@ func (self *External) Update() error {
 	return nil
 }
 
-func (self *External) Delete() error {
-	statement, err := self.Store.Prepare(`
+func (self *External) Delete(ctx context.Context) error {
+	return self.Journal(ctx, "delete", nil, self.erase)
+}
+
+func (self *External) erase(ctx context.Context, store Store) error {
+	trashed, err := self.remove(ctx, store)
+	if err != nil || trashed {
+		return err
+	}
+
+	statement, err := store.PrepareContext(ctx, `
 		DELETE FROM external WHERE id = ?;
 	`)
 
@@ -170,7 +206,8 @@ func (self *External) Delete() error {
 	}
 
 	defer statement.Close()
-	_, err = statement.Exec(
+	_, err = statement.ExecContext(
+		ctx,
 		self.ID,
 	)
 
@@ -185,13 +222,25 @@ func (self *External) ExportMetadata() (int64, string) {
 	return self.ID, self.Mapper
 }
 
-func (self *External) Map(entity Entity) error {
+func (self *External) Map(ctx context.Context, entity Entity) error {
+	write := func(ctx context.Context, store Store) error {
+		return self.attach(ctx, store, entity)
+	}
+
+	return self.Journal(ctx, "map", entity, write)
+}
+
+func (self *External) attach(
+	ctx    context.Context,
+	store  Store,
+	entity Entity,
+) error {
 	id, mapper := entity.ExportMetadata()
 	if self.Mapper == mapper {
 		return fmt.Errorf("Cannot create mapping with: %s", mapper)
 	}
 
-	statement, err := self.Store.Prepare(fmt.Sprintf(`
+	statement, err := store.PrepareContext(ctx, fmt.Sprintf(`
 		INSERT INTO mapping (external_id, %s_id) VALUES (?, ?);
 	`, mapper))
 
@@ -200,7 +249,8 @@ func (self *External) Map(entity Entity) error {
 	}
 
 	defer statement.Close()
-	result, err := statement.Exec(
+	result, err := statement.ExecContext(
+		ctx,
 		self.ID,
 		id,
 	)
@@ -214,7 +264,7 @@ func (self *External) Map(entity Entity) error {
 		return err
 	}
 
-	self.Mapping[id] = mappingID
+	self.Mapping[Key{mapper, id}] = mappingID
 	if mapper == "tag" {
 		self.Tags = append(self.Tags, entity)
 	}
@@ -222,15 +272,27 @@ func (self *External) Map(entity Entity) error {
 	return nil
 }
 
-func (self *External) Unmap(entity Entity) error {
+func (self *External) Unmap(ctx context.Context, entity Entity) error {
+	write := func(ctx context.Context, store Store) error {
+		return self.detach(ctx, store, entity)
+	}
+
+	return self.Journal(ctx, "unmap", entity, write)
+}
+
+func (self *External) detach(
+	ctx    context.Context,
+	store  Store,
+	entity Entity,
+) error {
 	id, mapper := entity.ExportMetadata()
 	if self.Mapper == mapper {
 		return fmt.Errorf("Cannot delete mapping with: %s", mapper)
 	}
 
-	mappingID, ok := self.Mapping[id]
+	mappingID, ok := self.Mapping[Key{mapper, id}]
 	if !ok {
-		statement, err := self.Store.Prepare(fmt.Sprintf(`
+		statement, err := store.PrepareContext(ctx, fmt.Sprintf(`
 			DELETE FROM mapping
 			WHERE external_id = ? AND %s_id = ?;
 		`, mapper))
@@ -240,7 +302,8 @@ func (self *External) Unmap(entity Entity) error {
 		}
 
 		defer statement.Close()
-		_, err = statement.Exec(
+		_, err = statement.ExecContext(
+			ctx,
 			self.ID,
 			id,
 		)
@@ -249,9 +312,9 @@ func (self *External) Unmap(entity Entity) error {
 			return err
 		}
 	} else {
-		delete(self.Mapping, id)
+		delete(self.Mapping, Key{mapper, id})
 
-		statement, err := self.Store.Prepare(`
+		statement, err := store.PrepareContext(ctx, `
 			DELETE FROM mapping WHERE id = ?;
 		`)
 
@@ -260,7 +323,8 @@ func (self *External) Unmap(entity Entity) error {
 		}
 
 		defer statement.Close()
-		_, err = statement.Exec(
+		_, err = statement.ExecContext(
+			ctx,
 			mappingID,
 		)
 
@@ -272,7 +336,8 @@ func (self *External) Unmap(entity Entity) error {
 	if mapper == "tag" {
 		tags := []Entity{}
 		for _, tag := range self.Tags {
-			if tag == entity {
+			tagID, _ := tag.ExportMetadata()
+			if tagID == id {
 				continue
 			}
 
@@ -284,7 +349,19 @@ func (self *External) Unmap(entity Entity) error {
 	return nil
 }
 
-func (self *External) Link(entity Entity) error {
+func (self *External) Link(ctx context.Context, entity Entity) error {
+	write := func(ctx context.Context, store Store) error {
+		return self.link(ctx, store, entity)
+	}
+
+	return self.Journal(ctx, "link", entity, write)
+}
+
+func (self *External) link(
+	ctx    context.Context,
+	store  Store,
+	entity Entity,
+) error {
 	meta, ok := entity.(*Internal)
 	if !ok {
 		return fmt.Errorf("Cannot cast to Internal: %#v", entity)
@@ -294,7 +371,7 @@ func (self *External) Link(entity Entity) error {
 	self.Data = self.Meta.UUID
 
 	self.Updated = Now()
-	statement, err := self.Store.Prepare(`
+	statement, err := store.PrepareContext(ctx, `
 		UPDATE external SET updated = ?, data = ? WHERE id = ?;
 	`)
 
@@ -303,7 +380,8 @@ func (self *External) Link(entity Entity) error {
 	}
 
 	defer statement.Close()
-	_, err = statement.Exec(
+	_, err = statement.ExecContext(
+		ctx,
 		self.Updated,
 		self.Meta.ID,
 		self.ID,
@@ -316,14 +394,23 @@ func (self *External) Link(entity Entity) error {
 	return nil
 }
 
-func (self *External) Unlink() error {
+func (self *External) Unlink(ctx context.Context) error {
+	var related Entity = nil
+	if self.Meta != nil {
+		related = self.Meta
+	}
+
+	return self.Journal(ctx, "unlink", related, self.unlink)
+}
+
+func (self *External) unlink(ctx context.Context, store Store) error {
 	var meta *Internal = nil
 
 	self.Meta = meta
 	self.Data = []byte{}
 
 	self.Updated = Now()
-	statement, err := self.Store.Prepare(`
+	statement, err := store.PrepareContext(ctx, `
 		UPDATE external SET updated = ?, data = NULL WHERE id = ?;
 	`)
 
@@ -332,7 +419,8 @@ func (self *External) Unlink() error {
 	}
 
 	defer statement.Close()
-	_, err = statement.Exec(
+	_, err = statement.ExecContext(
+		ctx,
 		self.Updated,
 		self.ID,
 	)
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"context"
 	"io"
 )
 
@@ -18,32 +19,52 @@ type Setter interface {
 
 type Mapper interface {
 	ExportMetadata() (int64, string)
-	Map(Entity) error
-	Unmap(Entity) error
+	Map(context.Context, Entity) error
+	Unmap(context.Context, Entity) error
 }
 
 type Saver interface {
-	Save() error
+	Save(context.Context) error
 }
 
 type Updater interface {
-	Update() error
+	Update(context.Context) error
 }
 
 type Deleter interface {
-	Delete() error
+	Delete(context.Context) error
+}
+
+type Restorer interface {
+	Restore(context.Context) error
+}
+
+type Upserter interface {
+	Upsert(context.Context) error
 }
 
 type Writer interface {
 	Saver
 	Updater
+	Upserter
 	Deleter
 }
 
+type Binder interface {
+	Bind(Store)
+}
+
+type Snapshotter interface {
+	Snapshot() func()
+}
+
 type Entity interface {
+	Binder
+	Snapshotter
 	Displayer
 	Encoder
 	Setter
 	Writer
+	Restorer
 	Mapper
 }
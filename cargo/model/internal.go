@@ -1,11 +1,11 @@
 package model
 
 import (
+	"context"
 	"io"
 	"fmt"
 	"log"
 	"encoding/json"
-	"database/sql"
 )
 
 type Internal struct {
@@ -14,10 +14,10 @@ type Internal struct {
 	Origin  string          `json:"origin"`
 	Data    []byte          `json:"data"`
 	Tags    []Entity        `json:"tags"`
-	Mapping map[int64]int64 `json:"-"`
+	Mapping map[Key]int64   `json:"-"`
 }
 
-func NewInternal(store *sql.DB) (*Internal, error) {
+func NewInternal(store Store) (*Internal, error) {
 	var self *Internal
 
 	common, err := NewCommon(store, "internal")
@@ -28,12 +28,18 @@ func NewInternal(store *sql.DB) (*Internal, error) {
 	self = &Internal{
 		Common:  common,
 		Tags:    []Entity{},
-		Mapping: make(map[int64]int64),
+		Mapping: make(map[Key]int64),
 	}
 
 	return self, nil
 }
 
+// Hash is the content address the data is stored under, keyed when the store
+// seals its data.
+func (self *Internal) Hash() []byte {
+	return Settings(self.Store).Keyring.Digest(self.Data)
+}
+
 func (self *Internal) Display() {
 	//log.Printf("%#v\n", self)
 	log.Printf(
@@ -76,7 +82,7 @@ func (self *Internal) Set(key string, value []byte) error {
 	return nil
 }
 
-func (self *Internal) Save() error {
+func (self *Internal) validate() error {
 	if len(self.UUID) != 32 {
 		return fmt.Errorf("UUID is not 32 bytes: %x", self.UUID)
 	}
@@ -89,13 +95,37 @@ func (self *Internal) Save() error {
 		return fmt.Errorf("Origin is over 64 characters: %s", self.Origin)
 	}
 
+	return nil
+}
+
+func (self *Internal) Save(ctx context.Context) error {
+	return self.Journal(ctx, "save", nil, self.save)
+}
+
+func (self *Internal) save(ctx context.Context, store Store) error {
+	err := self.validate()
+	if err != nil {
+		return err
+	}
+
 	if len(self.Data) == 0 {
 		return fmt.Errorf("Data is missing: %x", self.Data)
 	}
 
-	statement, err := self.Store.Prepare(`
-		INSERT INTO internal (uuid, flag, type, origin, data)
-		VALUES (?, ?, ?, ?, ?);
+	return Atomic(ctx, store, func(store Store) error {
+		blob, err := deposit(ctx, store, self.Data)
+		if err != nil {
+			return err
+		}
+
+		return self.insert(ctx, store, blob)
+	})
+}
+
+func (self *Internal) insert(ctx context.Context, store Store, blob int64) error {
+	statement, err := store.PrepareContext(ctx, `
+		INSERT INTO internal (uuid, flag, type, origin, data, blob_id)
+		VALUES (?, ?, ?, ?, ?, ?);
 	`)
 
 	if err != nil {
@@ -103,12 +133,14 @@ func (self *Internal) Save() error {
 	}
 
 	defer statement.Close()
-	result, err := statement.Exec(
+	result, err := statement.ExecContext(
+		ctx,
 		self.UUID,
 		self.Flag,
 		self.Type,
 		self.Origin,
-		self.Data,
+		[]byte{},
+		blob,
 	)
 
 	if err != nil {
@@ -124,12 +156,37 @@ func (self *Internal) Save() error {
 	return nil
 }
 
-func (self *Internal) Update() error {
-	self.Updated = Now()
-	statement, err := self.Store.Prepare(`
+// Update writes the crate back. Data left nil, as Metadata loads it or
+// SaveFrom leaves it, keeps the data already stored.
+func (self *Internal) Update(ctx context.Context) error {
+	return self.Journal(ctx, "update", nil, self.revise)
+}
+
+func (self *Internal) revise(ctx context.Context, store Store) error {
+	if self.Data == nil {
+		return self.update(ctx, store, 0)
+	}
+
+	return Atomic(ctx, store, func(store Store) error {
+		blob, err := deposit(ctx, store, self.Data)
+		if err != nil {
+			return err
+		}
+
+		return self.update(ctx, store, blob)
+	})
+}
+
+// update writes the crate's fields and points it at blob, or leaves its data
+// where it is when blob is 0.
+func (self *Internal) update(ctx context.Context, store Store, blob int64) error {
+	updated := Now()
+	statement, err := store.PrepareContext(ctx, `
 		UPDATE internal
-		SET updated = ?, flag = ?, type = ?, origin = ?, data = ?
-		WHERE id = ?
+		SET updated = ?1, flag = ?2, type = ?3, origin = ?4,
+			data = CASE WHEN ?5 > 0 THEN X'' ELSE data END,
+			blob_id = CASE WHEN ?5 > 0 THEN ?5 ELSE blob_id END
+		WHERE id = ?6
 	`)
 
 	if err != nil {
@@ -137,12 +194,13 @@ func (self *Internal) Update() error {
 	}
 
 	defer statement.Close()
-	_, err = statement.Exec(
-		self.Updated,
+	_, err = statement.ExecContext(
+		ctx,
+		updated,
 		self.Flag,
 		self.Type,
 		self.Origin,
-		self.Data,
+		blob,
 		self.ID,
 	)
 
@@ -150,11 +208,21 @@ func (self *Internal) Update() error {
 		return err
 	}
 
+	self.Updated = updated
 	return nil
 }
 
-func (self *Internal) Delete() error {
-	statement, err := self.Store.Prepare(`
+func (self *Internal) Delete(ctx context.Context) error {
+	return self.Journal(ctx, "delete", nil, self.erase)
+}
+
+func (self *Internal) erase(ctx context.Context, store Store) error {
+	trashed, err := self.remove(ctx, store)
+	if err != nil || trashed {
+		return err
+	}
+
+	statement, err := store.PrepareContext(ctx, `
 		DELETE FROM internal WHERE id = ?;
 	`)
 
@@ -163,7 +231,8 @@ func (self *Internal) Delete() error {
 	}
 
 	defer statement.Close()
-	_, err = statement.Exec(
+	_, err = statement.ExecContext(
+		ctx,
 		self.ID,
 	)
 
@@ -178,13 +247,25 @@ func (self *Internal) ExportMetadata() (int64, string) {
 	return self.ID, self.Mapper
 }
 
-func (self *Internal) Map(entity Entity) error {
+func (self *Internal) Map(ctx context.Context, entity Entity) error {
+	write := func(ctx context.Context, store Store) error {
+		return self.attach(ctx, store, entity)
+	}
+
+	return self.Journal(ctx, "map", entity, write)
+}
+
+func (self *Internal) attach(
+	ctx    context.Context,
+	store  Store,
+	entity Entity,
+) error {
 	id, mapper := entity.ExportMetadata()
 	if self.Mapper == mapper {
 		return fmt.Errorf("Cannot create mapping with: %s", mapper)
 	}
 
-	statement, err := self.Store.Prepare(fmt.Sprintf(`
+	statement, err := store.PrepareContext(ctx, fmt.Sprintf(`
 		INSERT INTO mapping (internal_id, %s_id) VALUES (?, ?);
 	`, mapper))
 
@@ -193,7 +274,8 @@ func (self *Internal) Map(entity Entity) error {
 	}
 
 	defer statement.Close()
-	result, err := statement.Exec(
+	result, err := statement.ExecContext(
+		ctx,
 		self.ID,
 		id,
 	)
@@ -207,7 +289,7 @@ func (self *Internal) Map(entity Entity) error {
 		return err
 	}
 
-	self.Mapping[id] = mappingID
+	self.Mapping[Key{mapper, id}] = mappingID
 	if mapper == "tag" {
 		self.Tags = append(self.Tags, entity)
 	}
@@ -215,15 +297,27 @@ func (self *Internal) Map(entity Entity) error {
 	return nil
 }
 
-func (self *Internal) Unmap(entity Entity) error {
+func (self *Internal) Unmap(ctx context.Context, entity Entity) error {
+	write := func(ctx context.Context, store Store) error {
+		return self.detach(ctx, store, entity)
+	}
+
+	return self.Journal(ctx, "unmap", entity, write)
+}
+
+func (self *Internal) detach(
+	ctx    context.Context,
+	store  Store,
+	entity Entity,
+) error {
 	id, mapper := entity.ExportMetadata()
 	if self.Mapper == mapper {
 		return fmt.Errorf("Cannot delete mapping with: %s", mapper)
 	}
 
-	mappingID, ok := self.Mapping[id]
+	mappingID, ok := self.Mapping[Key{mapper, id}]
 	if !ok {
-		statement, err := self.Store.Prepare(fmt.Sprintf(`
+		statement, err := store.PrepareContext(ctx, fmt.Sprintf(`
 			DELETE FROM mapping
 			WHERE internal_id = ? AND %s_id = ?;
 		`, mapper))
@@ -233,7 +327,8 @@ func (self *Internal) Unmap(entity Entity) error {
 		}
 
 		defer statement.Close()
-		_, err = statement.Exec(
+		_, err = statement.ExecContext(
+			ctx,
 			self.ID,
 			id,
 		)
@@ -242,9 +337,9 @@ func (self *Internal) Unmap(entity Entity) error {
 			return err
 		}
 	} else {
-		delete(self.Mapping, id)
+		delete(self.Mapping, Key{mapper, id})
 
-		statement, err := self.Store.Prepare(`
+		statement, err := store.PrepareContext(ctx, `
 			DELETE FROM mapping WHERE id = ?;
 		`)
 
@@ -253,7 +348,8 @@ func (self *Internal) Unmap(entity Entity) error {
 		}
 
 		defer statement.Close()
-		_, err = statement.Exec(
+		_, err = statement.ExecContext(
+			ctx,
 			mappingID,
 		)
 
@@ -265,7 +361,8 @@ func (self *Internal) Unmap(entity Entity) error {
 	if mapper == "tag" {
 		tags := []Entity{}
 		for _, tag := range self.Tags {
-			if tag == entity {
+			tagID, _ := tag.ExportMetadata()
+			if tagID == id {
 				continue
 			}
 
@@ -1,19 +1,27 @@
 package model
 
 import (
+	"database/sql"
+	"strings"
+	"strconv"
+	"time"
+	"unicode/utf8"
+	"context"
 	"io"
 	"fmt"
 	"log"
 	"encoding/json"
-	"database/sql"
 )
 
 type Tag struct {
 	Common
-	Label  string `json:"label"`
+	Label     string `json:"label"`
+	Parent    int64  `json:"-"`
+	Namespace string `json:"namespace,omitempty"`
+	Value     string `json:"value,omitempty"`
 }
 
-func NewTag(store *sql.DB) (*Tag, error) {
+func NewTag(store Store) (*Tag, error) {
 	var self *Tag
 
 	common, err := NewCommon(store, "tag")
@@ -53,7 +61,24 @@ func (self *Tag) Set(key string, value []byte) error {
 		if len(val) > 128 {
 			return fmt.Errorf("Type is over 128 characters: %s", val)
 		}
+
 		self.Label = val
+		self.Namespace, self.Value = Split(val)
+	case "namespace":
+		val := string(value)
+		if len(val) > 64 || strings.ContainsAny(val, "=/") {
+			return fmt.Errorf("Invalid namespace: %s", val)
+		}
+
+		self.Namespace = val
+		return self.label()
+	case "value":
+		if len(self.Namespace) == 0 {
+			return fmt.Errorf("Value needs a namespace: %s", self.Label)
+		}
+
+		self.Value = string(value)
+		return self.label()
 	default:
 		return fmt.Errorf("Invalid key: %s", key)
 	}
@@ -61,7 +86,13 @@ func (self *Tag) Set(key string, value []byte) error {
 	return nil
 }
 
-func (self *Tag) Save() error {
+// Save inserts the tag. A tag labelled with an alias becomes the tag the alias
+// stands for instead, taking over its id and UUID as Upsert does.
+func (self *Tag) Save(ctx context.Context) error {
+	return self.Journal(ctx, "save", nil, self.save)
+}
+
+func (self *Tag) save(ctx context.Context, store Store) error {
 	if len(self.UUID) != 32 {
 		return fmt.Errorf("UUID is not 32 bytes: %x", self.UUID)
 	}
@@ -74,20 +105,42 @@ func (self *Tag) Save() error {
 		return fmt.Errorf("Label is over 128 characters: %s", self.Label)
 	}
 
-	statement, err := self.Store.Prepare(`
-		INSERT INTO tag (uuid, flag, label)
-		VALUES (?, ?, ?);
+	alias := self.Label
+	err := self.resolve(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	if self.Label != alias {
+		return self.adopt(ctx, store)
+	}
+
+	err = self.lineage(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	statement, err := store.PrepareContext(ctx, `
+		INSERT INTO tag (uuid, flag, label, parent, namespace, value, number)
+		VALUES (?, ?, ?, ?, ?, ?, ?);
 	`)
 
 	if err != nil {
 		return err
 	}
 
+	namespace, value, number := self.columns()
+
 	defer statement.Close()
-	result, err := statement.Exec(
+	result, err := statement.ExecContext(
+		ctx,
 		self.UUID,
 		self.Flag,
 		self.Label,
+		Nullable(self.Parent),
+		namespace,
+		value,
+		number,
 	)
 
 	if err != nil {
@@ -103,11 +156,87 @@ func (self *Tag) Save() error {
 	return nil
 }
 
-func (self *Tag) Update() error {
+// Update writes the tag back. A label changed with Set carries the tag's
+// descendants along, as Move and Rename do.
+func (self *Tag) Update(ctx context.Context) error {
+	return self.Journal(ctx, "update", nil, self.revise)
+}
+
+func (self *Tag) revise(ctx context.Context, store Store) error {
+	err := self.resolve(ctx, store)
+	if err == nil {
+		err = self.lineage(ctx, store)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return Atomic(ctx, store, func(store Store) error {
+		err := self.carry(ctx, store)
+		if err != nil {
+			return err
+		}
+
+		return self.update(ctx, store)
+	})
+}
+
+// adopt takes over the id, UUID and added time of the tag stored under the
+// label and writes the tag over it.
+func (self *Tag) adopt(ctx context.Context, store Store) error {
+	var (
+		id    int64
+		uuid  []byte
+		added time.Time
+	)
+
+	err := store.QueryRowContext(ctx, `
+		SELECT id, uuid, added FROM tag WHERE label = ?;
+	`, self.Label).Scan(&id, &uuid, &added)
+
+	if err != nil {
+		return err
+	}
+
+	self.ID = id
+	self.UUID = uuid
+	self.Added = added
+	return self.revise(ctx, store)
+}
+
+// carry rewrites the labels beneath the tag when its label no longer matches
+// the stored one.
+func (self *Tag) carry(ctx context.Context, store Store) error {
+	var stored string
+	err := store.QueryRowContext(ctx, `
+		SELECT label FROM tag WHERE id = ?;
+	`, self.ID).Scan(&stored)
+
+	if err != nil || stored == self.Label {
+		return err
+	}
+
+	if strings.HasPrefix(self.Label, stored + "/") {
+		return fmt.Errorf("Cannot move %s beneath %s", stored, self.Label)
+	}
+
+	label := self.Label
+	self.Label = stored
+	err = self.relabel(ctx, store, label, self.Parent)
+	if err != nil {
+		self.Label = label
+	}
+
+	return err
+}
+
+func (self *Tag) update(ctx context.Context, store Store) error {
 	self.Updated = Now()
-	statement, err := self.Store.Prepare(`
+	statement, err := store.PrepareContext(ctx, `
 		UPDATE tag
-		SET updated = ?, flag = ?, label = ?
+		SET updated = ?, flag = ?, label = ?, parent = ?,
+			namespace = ?, value = ?, number = ?
 		WHERE id = ?
 	`)
 
@@ -115,11 +244,18 @@ func (self *Tag) Update() error {
 		return err
 	}
 
+	namespace, value, number := self.columns()
+
 	defer statement.Close()
-	_, err = statement.Exec(
+	_, err = statement.ExecContext(
+		ctx,
 		self.Updated,
 		self.Flag,
 		self.Label,
+		Nullable(self.Parent),
+		namespace,
+		value,
+		number,
 		self.ID,
 	)
 
@@ -130,8 +266,41 @@ func (self *Tag) Update() error {
 	return nil
 }
 
-func (self *Tag) Delete() error {
-	statement, err := self.Store.Prepare(`
+// Delete takes the tag's whole subtree with it, into the trash under soft
+// deletes just as the parent foreign key cascades a hard delete.
+func (self *Tag) Delete(ctx context.Context) error {
+	return self.Journal(ctx, "delete", nil, self.erase)
+}
+
+func (self *Tag) erase(ctx context.Context, store Store) error {
+	if Settings(store).SoftDelete {
+		trashed := false
+		err := Atomic(ctx, store, func(store Store) error {
+			var count int
+			err := store.QueryRowContext(ctx, `
+				SELECT COUNT(*) FROM trash WHERE tag_id = ?;
+			`, self.ID).Scan(&count)
+
+			if err != nil || count > 0 {
+				return err
+			}
+
+			prefix := self.Label + "/"
+			_, err = store.ExecContext(ctx, `
+				INSERT OR IGNORE INTO trash (tag_id, deleted)
+				SELECT id, ? FROM tag WHERE id = ? OR substr(label, 1, ?) = ?;
+			`, Now(), self.ID, utf8.RuneCountInString(prefix), prefix)
+
+			trashed = err == nil
+			return err
+		})
+
+		if err != nil || trashed {
+			return err
+		}
+	}
+
+	statement, err := store.PrepareContext(ctx, `
 		DELETE FROM tag WHERE id = ?;
 	`)
 
@@ -140,7 +309,8 @@ func (self *Tag) Delete() error {
 	}
 
 	defer statement.Close()
-	_, err = statement.Exec(
+	_, err = statement.ExecContext(
+		ctx,
 		self.ID,
 	)
 
@@ -151,14 +321,459 @@ func (self *Tag) Delete() error {
 	return nil
 }
 
+// Restore brings back the tag along with the descendants that were trashed
+// with it, leaving those deleted separately in the trash.
+func (self *Tag) Restore(ctx context.Context) error {
+	return self.Journal(ctx, "restore", nil, self.restore)
+}
+
+func (self *Tag) restore(ctx context.Context, store Store) error {
+	prefix := self.Label + "/"
+	_, err := store.ExecContext(ctx, `
+		DELETE FROM trash
+		WHERE tag_id IN (
+			SELECT id FROM tag WHERE id = ? OR substr(label, 1, ?) = ?
+		)
+		AND deleted = (SELECT deleted FROM trash WHERE tag_id = ?);
+	`, self.ID, utf8.RuneCountInString(prefix), prefix, self.ID)
+
+	return err
+}
+
 func (self *Tag) ExportMetadata() (int64, string) {
 	return self.ID, self.Mapper
 }
 
-func (self *Tag) Map(entity Entity) error {
+func (self *Tag) Map(ctx context.Context, entity Entity) error {
 	return fmt.Errorf("Cannot create mapping from %s", self.Mapper)
 }
 
-func (self *Tag) Unmap(entity Entity) error {
+func (self *Tag) Unmap(ctx context.Context, entity Entity) error {
 	return fmt.Errorf("Cannot delete mapping from %s", self.Mapper)
 }
+
+// Split breaks a label of the form namespace=value into its parts; labels
+// without a namespace come back with both parts empty.
+func Split(label string) (string, string) {
+	index := strings.Index(label, "=")
+	if index < 1 || index > 64 || strings.Contains(label[:index], "/") {
+		return "", ""
+	}
+
+	return label[:index], label[index+1:]
+}
+
+func (self *Tag) label() error {
+	label := self.Namespace + "=" + self.Value
+	if len(self.Namespace) == 0 {
+		label = self.Value
+	}
+
+	if len(label) > 128 {
+		return fmt.Errorf("Label is over 128 characters: %s", label)
+	}
+
+	self.Label = label
+	return nil
+}
+
+// Number parses the value of a namespaced tag, reporting false when it is not
+// numeric.
+func (self *Tag) Number() (float64, bool) {
+	if len(self.Namespace) == 0 {
+		return 0, false
+	}
+
+	number, err := strconv.ParseFloat(self.Value, 64)
+	return number, err == nil
+}
+
+func (self *Tag) columns() (sql.NullString, sql.NullString, sql.NullFloat64) {
+	if len(self.Namespace) == 0 {
+		return sql.NullString{}, sql.NullString{}, sql.NullFloat64{}
+	}
+
+	number, ok := self.Number()
+	return sql.NullString{String: self.Namespace, Valid: true},
+		sql.NullString{String: self.Value, Valid: true},
+		sql.NullFloat64{Float64: number, Valid: ok}
+}
+
+func (self *Tag) flat() error {
+	if len(self.Namespace) > 0 {
+		return fmt.Errorf("Namespaced tags cannot be nested: %s", self.Label)
+	}
+
+	return nil
+}
+
+// Name is the last segment of a slash separated label, so the tag labelled
+// project/armada/backend is named backend.
+func (self *Tag) Name() string {
+	return self.Label[strings.LastIndex(self.Label, "/")+1:]
+}
+
+func (self *Tag) Contains(label string) bool {
+	return label == self.Label || strings.HasPrefix(label, self.Label + "/")
+}
+
+// SetParent places an unsaved tag beneath parent, prefixing its label with
+// the parent's path. Saved tags should use Move so descendants follow.
+func (self *Tag) SetParent(parent *Tag) error {
+	label := self.Name()
+	if parent == nil {
+		if len(self.Namespace) > 0 {
+			return nil
+		}
+
+		self.Parent = 0
+		self.Label = label
+		return nil
+	}
+
+	if parent.ID == 0 {
+		return fmt.Errorf("Parent is not saved: %s", parent.Label)
+	}
+
+	err := self.flat()
+	if err == nil {
+		err = parent.flat()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	label = parent.Label + "/" + label
+	if len(label) > 128 {
+		return fmt.Errorf("Label is over 128 characters: %s", label)
+	}
+
+	self.Parent = parent.ID
+	self.Label = label
+	return nil
+}
+
+// resolve replaces a label that is an alias with the label of the tag it
+// stands for.
+func (self *Tag) resolve(ctx context.Context, store Store) error {
+	label, err := Canonical(ctx, store, self.Label)
+	if err != nil || label == self.Label {
+		return err
+	}
+
+	self.Label = label
+	self.Namespace, self.Value = Split(label)
+	return nil
+}
+
+// lineage points Parent at the tag labelled with everything before the last
+// slash, so that a tag saved with a path as its label sits where both
+// Children and Subtree expect it. That tag has to be saved already.
+func (self *Tag) lineage(ctx context.Context, store Store) error {
+	index := strings.LastIndex(self.Label, "/")
+	if len(self.Namespace) > 0 || index < 0 {
+		self.Parent = 0
+		return nil
+	}
+
+	var parent int64
+	path := self.Label[:index]
+	err := store.QueryRowContext(ctx, `
+		SELECT id FROM tag WHERE label = ?;
+	`, path).Scan(&parent)
+
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("Parent is not saved: %s", path)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	self.Parent = parent
+	return nil
+}
+
+// relabel rewrites the label of the tag and every label beneath it, setting
+// the tag's own parent along the way.
+func (self *Tag) relabel(
+	ctx    context.Context,
+	store  Store,
+	label  string,
+	parent int64,
+) error {
+	prefix := self.Label + "/"
+	size := utf8.RuneCountInString(prefix)
+
+	var longest int
+	err := store.QueryRowContext(ctx, `
+		SELECT COALESCE(MAX(LENGTH(CAST(label AS BLOB))), 0) FROM tag
+		WHERE id = ? OR substr(label, 1, ?) = ?;
+	`, self.ID, size, prefix).Scan(&longest)
+
+	if err != nil {
+		return err
+	}
+
+	if longest - len(self.Label) + len(label) > 128 {
+		return fmt.Errorf("Label is over 128 characters: %s", label)
+	}
+
+	updated := Now()
+	statement, err := store.PrepareContext(ctx, `
+		UPDATE tag
+		SET updated = ?,
+			label = ? || substr(label, ?),
+			parent = CASE WHEN id = ? THEN ? ELSE parent END
+		WHERE id = ? OR substr(label, 1, ?) = ?;
+	`)
+
+	if err != nil {
+		return err
+	}
+
+	defer statement.Close()
+	_, err = statement.ExecContext(
+		ctx,
+		updated,
+		label,
+		size,
+		self.ID,
+		Nullable(parent),
+		self.ID,
+		size,
+		prefix,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	self.Updated = updated
+	self.Label = label
+	self.Parent = parent
+	return nil
+}
+
+// Move re-parents the tag and rewrites the labels of its whole subtree; a nil
+// parent moves it to the root.
+func (self *Tag) Move(ctx context.Context, parent *Tag) error {
+	write := func(ctx context.Context, store Store) error {
+		return self.move(ctx, store, parent)
+	}
+
+	return self.Journal(ctx, "move", nil, write)
+}
+
+func (self *Tag) move(ctx context.Context, store Store, parent *Tag) error {
+	label := self.Name()
+	var parentID int64 = 0
+
+	if err := self.flat(); err != nil {
+		return err
+	}
+
+	if parent != nil {
+		if parent.ID == 0 {
+			return fmt.Errorf("Parent is not saved: %s", parent.Label)
+		}
+
+		if err := parent.flat(); err != nil {
+			return err
+		}
+
+		if self.Contains(parent.Label) {
+			return fmt.Errorf(
+				"Cannot move %s beneath %s",
+				self.Label,
+				parent.Label,
+			)
+		}
+
+		label = parent.Label + "/" + label
+		parentID = parent.ID
+	}
+
+	return Atomic(ctx, store, func(store Store) error {
+		return self.relabel(ctx, store, label, parentID)
+	})
+}
+
+// Rename replaces the last segment of the label, keeping the tag beneath the
+// same parent and carrying its descendants along.
+func (self *Tag) Rename(ctx context.Context, name string) error {
+	write := func(ctx context.Context, store Store) error {
+		return self.rename(ctx, store, name)
+	}
+
+	return self.Journal(ctx, "rename", nil, write)
+}
+
+func (self *Tag) rename(ctx context.Context, store Store, name string) error {
+	if len(name) == 0 || strings.Contains(name, "/") {
+		return fmt.Errorf("Invalid tag name: %s", name)
+	}
+
+	if err := self.flat(); err != nil {
+		return err
+	}
+
+	label := self.Label[:len(self.Label)-len(self.Name())] + name
+	return Atomic(ctx, store, func(store Store) error {
+		return self.relabel(ctx, store, label, self.Parent)
+	})
+}
+
+// Merge folds the tag into target: mappings and aliases are re-pointed (the
+// mapping table's ON CONFLICT IGNORE constraints leave duplicates behind to be
+// removed with the tag), children are moved beneath target, or merged into
+// target's child of the same name, and the old label becomes an alias of
+// target.
+func (self *Tag) Merge(ctx context.Context, target *Tag) error {
+	write := func(ctx context.Context, store Store) error {
+		return self.merge(ctx, store, target)
+	}
+
+	return self.Journal(ctx, "merge", nil, write)
+}
+
+func (self *Tag) merge(ctx context.Context, store Store, target *Tag) error {
+	if target.ID == 0 || target.ID == self.ID {
+		return fmt.Errorf("Cannot merge %s into %s", self.Label, target.Label)
+	}
+
+	if self.Contains(target.Label) {
+		return fmt.Errorf(
+			"Cannot merge %s into its descendant %s",
+			self.Label,
+			target.Label,
+		)
+	}
+
+	return Atomic(ctx, store, func(store Store) error {
+		return self.fold(ctx, store, target)
+	})
+}
+
+// fold moves the mappings and aliases of the tag over to target, then each of
+// its children beneath target, folding a child into the one of target's that
+// has the same name, before deleting the tag and keeping its label as an
+// alias of target.
+func (self *Tag) fold(ctx context.Context, store Store, target *Tag) error {
+	statements := []string{
+		`UPDATE mapping SET tag_id = ? WHERE tag_id = ?;`,
+		`UPDATE tag_alias SET tag_id = ? WHERE tag_id = ?;`,
+	}
+
+	for _, statement := range statements {
+		_, err := store.ExecContext(ctx, statement, target.ID, self.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	children, err := store.QueryContext(ctx, `
+		SELECT id, label FROM tag WHERE parent = ?;
+	`, self.ID)
+
+	if err != nil {
+		return err
+	}
+
+	moves := []*Tag{}
+	for children.Next() {
+		child := &Tag{}
+		err = children.Scan(&child.ID, &child.Label)
+		if err != nil {
+			children.Close()
+			return err
+		}
+
+		moves = append(moves, child)
+	}
+
+	children.Close()
+	for _, child := range moves {
+		sibling := &Tag{Label: target.Label + "/" + child.Name()}
+		err = store.QueryRowContext(ctx, `
+			SELECT id FROM tag WHERE label = ?;
+		`, sibling.Label).Scan(&sibling.ID)
+
+		if err == sql.ErrNoRows {
+			err = child.relabel(ctx, store, sibling.Label, target.ID)
+		} else if err == nil {
+			err = child.fold(ctx, store, sibling)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = store.ExecContext(ctx, `
+		DELETE FROM tag WHERE id = ?;
+	`, self.ID)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = store.ExecContext(ctx, `
+		INSERT INTO tag_alias (alias, tag_id) VALUES (?, ?);
+	`, self.Label, target.ID)
+
+	return err
+}
+
+func (self *Tag) Alias(ctx context.Context, alias string) error {
+	if len(alias) == 0 || len(alias) > 128 {
+		return fmt.Errorf("Invalid alias: %s", alias)
+	}
+
+	return Atomic(ctx, self.Store, func(store Store) error {
+		var count int
+		err := store.QueryRowContext(ctx, `
+			SELECT COUNT(*) FROM tag WHERE label = ?;
+		`, alias).Scan(&count)
+
+		if err != nil {
+			return err
+		}
+
+		if count > 0 {
+			return fmt.Errorf("Alias is already a tag: %s", alias)
+		}
+
+		_, err = store.ExecContext(ctx, `
+			INSERT INTO tag_alias (alias, tag_id) VALUES (?, ?);
+		`, alias, self.ID)
+
+		return err
+	})
+}
+
+func (self *Tag) Unalias(ctx context.Context, alias string) error {
+	_, err := self.Store.ExecContext(ctx, `
+		DELETE FROM tag_alias WHERE alias = ? AND tag_id = ?;
+	`, alias, self.ID)
+
+	return err
+}
+
+// Canonical returns the label that alias stands for, or alias itself when it
+// is not an alias of any tag.
+func Canonical(ctx context.Context, store Store, alias string) (string, error) {
+	var label string
+	err := store.QueryRowContext(ctx, `
+		SELECT tag.label FROM tag_alias
+		JOIN tag ON tag.id = tag_alias.tag_id
+		WHERE tag_alias.alias = ?;
+	`, alias).Scan(&label)
+
+	if err == sql.ErrNoRows {
+		return alias, nil
+	}
+
+	return label, err
+}
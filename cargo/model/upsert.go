@@ -0,0 +1,225 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// NaturalFields are the fields that can make up the natural key of each crate
+// type, which Upsert matches on when no crate has the UUID being written.
+var NaturalFields map[string][]string = map[string][]string{
+	"internal": {"flag", "type", "origin", "hash"},
+	"external": {"flag", "type", "name", "body"},
+	"tag":      {"flag", "label", "namespace", "value"},
+}
+
+// CheckNaturalKey reports whether fields can be used as the natural key of the
+// crate type.
+func CheckNaturalKey(mapper string, fields []string) error {
+	allowed, ok := NaturalFields[mapper]
+	if !ok {
+		return fmt.Errorf("Invalid crate type: %s", mapper)
+	}
+
+	if len(fields) == 0 {
+		return fmt.Errorf("Natural key for %s is empty", mapper)
+	}
+
+	for _, field := range fields {
+		found := false
+		for _, name := range allowed {
+			found = found || name == field
+		}
+
+		if !found {
+			return fmt.Errorf("Invalid natural key field for %s: %s", mapper, field)
+		}
+	}
+
+	return nil
+}
+
+// NaturalIndexes creates an index over the columns of each natural key in the
+// store's settings, so that Upsert does not scan the table for a match. Hashes
+// are matched through the blob table's own index instead, and bodies are only
+// decoded for the rows the other columns leave.
+func NaturalIndexes(ctx context.Context, store Store) error {
+	for mapper, fields := range Settings(store).NaturalKeys {
+		columns := []string{}
+		for _, field := range fields {
+			if field != "hash" && field != "body" {
+				columns = append(columns, field)
+			}
+		}
+
+		if len(columns) == 0 {
+			continue
+		}
+
+		_, err := store.ExecContext(ctx, fmt.Sprintf(`
+			CREATE INDEX IF NOT EXISTS natural_%s_%s ON %s (%s);
+		`, mapper, strings.Join(columns, "_"), mapper, strings.Join(columns, ", ")))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// existing finds the crate an upsert writes over: the one with the same UUID
+// or, failing that, the first one matching the natural key configured for its
+// type, in the trash or not. The id is zero when there is none.
+func (self *Common) existing(
+	ctx     context.Context,
+	store   Store,
+	natural func(string) (string, []interface{}),
+) (int64, []byte, error) {
+	var id int64
+	err := store.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT id FROM %s WHERE uuid = ?;
+	`, self.Mapper), self.UUID).Scan(&id)
+
+	if err != sql.ErrNoRows {
+		return id, self.UUID, err
+	}
+
+	fields := Settings(store).NaturalKeys[self.Mapper]
+	if len(fields) == 0 {
+		return 0, self.UUID, nil
+	}
+
+	clauses := []string{}
+	args := []interface{}{}
+	for _, field := range fields {
+		clause, values := natural(field)
+		clauses = append(clauses, clause)
+		args = append(args, values...)
+	}
+
+	var uuid []byte
+	err = store.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT id, uuid FROM %s WHERE %s ORDER BY id LIMIT 1;
+	`, self.Mapper, strings.Join(clauses, " AND ")), args...).Scan(&id, &uuid)
+
+	if err == sql.ErrNoRows {
+		return 0, self.UUID, nil
+	}
+
+	return id, uuid, err
+}
+
+// upsert runs save for a new crate or update for an existing one, which the
+// crate takes the id and UUID of and restores from the trash, in one
+// transaction.
+func (self *Common) upsert(
+	ctx     context.Context,
+	natural func(string) (string, []interface{}),
+	save    func(context.Context, Store) error,
+	update  func(context.Context, Store) error,
+	restore func(context.Context, Store) error,
+) error {
+	return Atomic(ctx, self.Store, func(tx Store) error {
+		id, uuid, err := self.existing(ctx, tx, natural)
+		if err != nil {
+			return err
+		}
+
+		if id == 0 {
+			return self.record(ctx, tx, "save", nil, save)
+		}
+
+		self.ID = id
+		self.UUID = uuid
+		err = restore(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		return self.record(ctx, tx, "update", nil, update)
+	})
+}
+
+// Hashed is the hash of an internal row's data, taken from its blob or, for
+// data still stored inline, hashed as it is read.
+var Hashed string = `COALESCE(
+	(SELECT blob.hash FROM blob WHERE blob.id = internal.blob_id),
+	cargo_digest(internal.data)
+)`
+
+// matches compares a column with value, which may be NULL.
+func matches(column string, value interface{}) (string, []interface{}) {
+	return column + " IS ?", []interface{}{value}
+}
+
+// Upsert saves the crate, or updates the one already stored with its UUID or
+// natural key. The crate takes over the id and UUID of the one it updates.
+func (self *Internal) Upsert(ctx context.Context) error {
+	return self.upsert(ctx, self.natural, self.save, self.revise, self.restore)
+}
+
+func (self *Internal) natural(field string) (string, []interface{}) {
+	switch field {
+	case "flag":
+		return matches("flag", self.Flag)
+	case "type":
+		return matches("type", self.Type)
+	case "origin":
+		return matches("origin", self.Origin)
+	}
+
+	// only data still stored inline is hashed row by row
+	hash := self.Hash()
+	return `(
+		blob_id IN (SELECT id FROM blob WHERE hash = ?)
+		OR (blob_id IS NULL AND cargo_digest(data) = ?)
+	)`, []interface{}{hash, hash}
+}
+
+// Upsert saves the crate, or updates the one already stored with its UUID or
+// natural key. The crate takes over the id and UUID of the one it updates.
+func (self *External) Upsert(ctx context.Context) error {
+	return self.upsert(ctx, self.natural, self.save, self.revise, self.restore)
+}
+
+func (self *External) natural(field string) (string, []interface{}) {
+	switch field {
+	case "flag":
+		return matches("flag", self.Flag)
+	case "type":
+		return matches("type", self.Type)
+	case "name":
+		return matches("name", self.Name)
+	}
+
+	return matches("cargo_text(body)", self.Body)
+}
+
+// Upsert saves the tag, or updates the one already stored with its UUID or
+// natural key. The tag takes over the id and UUID of the one it updates, and
+// a label that is an alias matches the tag it stands for.
+func (self *Tag) Upsert(ctx context.Context) error {
+	err := self.resolve(ctx, self.Store)
+	if err != nil {
+		return err
+	}
+
+	return self.upsert(ctx, self.natural, self.save, self.revise, self.restore)
+}
+
+func (self *Tag) natural(field string) (string, []interface{}) {
+	namespace, value, _ := self.columns()
+	switch field {
+	case "flag":
+		return matches("flag", self.Flag)
+	case "label":
+		return matches("label", self.Label)
+	case "namespace":
+		return matches("namespace", namespace)
+	}
+
+	return matches("value", value)
+}
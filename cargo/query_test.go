@@ -0,0 +1,589 @@
+package cargo
+
+import (
+	"testing"
+	"fmt"
+	"strings"
+	"context"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/aewens/nautical/cargo/model"
+	"github.com/aewens/nautical/cargo/repo"
+)
+
+func TestQuery(t *testing.T) {
+	ctx := context.Background()
+	now := Now()
+	hold, err := New(":memory:")
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	unread, err := hold.NewTag()
+	catch(t, err)
+	catch(t, unread.Set("label", []byte("unread")))
+	catch(t, unread.Save(ctx))
+
+	feeds := []struct {
+		itype  string
+		origin string
+		tagged bool
+	}{
+		{"rss", "feedA", true},
+		{"rss", "feedA", false},
+		{"rss", "feedB", true},
+		{"atom", "feedA", true},
+		{"rss", "feedA", true},
+	}
+
+	for i, feed := range feeds {
+		crate, err := hold.NewCrate("internal")
+		catch(t, err)
+		catch(t, crate.Set("type", []byte(feed.itype)))
+		catch(t, crate.Set("origin", []byte(feed.origin)))
+		catch(t, crate.Set("data", []byte{byte(i)}))
+		catch(t, crate.Save(ctx))
+
+		if feed.tagged {
+			catch(t, crate.Map(ctx, unread))
+		}
+	}
+
+	irepo, err := hold.NewRepo("internal")
+	catch(t, err)
+
+	query := repo.NewQuery().
+		Where(repo.And(
+			repo.Eq("type", "rss"),
+			repo.Eq("origin", "feedA"),
+			repo.Gt("added", now.Add(-1 * time.Minute)),
+			repo.HasTag("unread"),
+		)).
+		OrderBy("added", repo.Descending).
+		OrderBy("id", repo.Descending)
+
+	entities, err := irepo.Find(ctx, query).Entities()
+	catch(t, err)
+
+	if len(entities) != 2 {
+		t.Fatalf("Did not filter entities: %d", len(entities))
+	}
+
+	first := entities[0].(*model.Internal)
+	if first.ID != 5 {
+		t.Fatalf("Did not order entities: %d", first.ID)
+	}
+
+	query = repo.NewQuery().
+		Where(repo.Or(
+			repo.Eq("type", "atom"),
+			repo.Eq("origin", "feedB"),
+		)).
+		Where(repo.Not(repo.HasTag("unread")))
+
+	count := StreamSize(irepo.Find(ctx, query))
+	if count != 0 {
+		t.Fatalf("Did not combine predicates: %d", count)
+	}
+
+	query = repo.NewQuery().
+		Where(repo.In("origin", "feedA", "feedB")).
+		OrderBy("id", repo.Ascending).
+		Limit(2).
+		Offset(1)
+
+	entities, err = irepo.Find(ctx, query).Entities()
+	catch(t, err)
+
+	if len(entities) != 2 || entities[0].(*model.Internal).ID != 2 {
+		t.Fatalf("Did not page entities: %d", len(entities))
+	}
+
+	trepo, err := hold.NewRepo("tag")
+	catch(t, err)
+
+	stream := trepo.Find(ctx, repo.NewQuery().Where(repo.HasTag("unread")))
+	StreamSize(stream)
+	if stream.Err() == nil {
+		t.Fatal("Filtered tags by tag")
+	}
+}
+
+func TestQueryFields(t *testing.T) {
+	ctx := context.Background()
+	now := Now()
+	hold, err := New(":memory:")
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	trepo, err := hold.NewRepo("tag")
+	catch(t, err)
+
+	stream := trepo.Equals(ctx, "1=1; DROP TABLE tag; --", "test")
+	StreamSize(stream)
+
+	_, ok := stream.Err().(*repo.UnknownFieldError)
+	if !ok {
+		t.Fatalf("Did not reject unknown field: %v", stream.Err())
+	}
+
+	stream = trepo.Before(ctx, "label", now)
+	StreamSize(stream)
+
+	_, ok = stream.Err().(*repo.FieldKindError)
+	if !ok {
+		t.Fatalf("Did not reject time comparison: %v", stream.Err())
+	}
+
+	for _, predicate := range []repo.Predicate{
+		&repo.Condition{Field: "label", Operator: "= 'x' OR 1=1 --"},
+		&repo.Group{
+			Operator:   "OR 1=1 OR",
+			Predicates: []repo.Predicate{repo.Eq("label", "a")},
+		},
+	} {
+		stream = trepo.Find(ctx, repo.NewQuery().Where(predicate))
+		StreamSize(stream)
+
+		_, ok = stream.Err().(*repo.OperatorError)
+		if !ok {
+			t.Fatalf("Did not reject operator: %v", stream.Err())
+		}
+	}
+
+	query := repo.NewQuery().OrderBy("label; DROP TABLE tag", repo.Ascending)
+	stream = trepo.Find(ctx, query)
+	StreamSize(stream)
+
+	_, ok = stream.Err().(*repo.UnknownFieldError)
+	if !ok {
+		t.Fatalf("Did not reject unknown order: %v", stream.Err())
+	}
+
+	_, err = hold.Store.Exec(`SELECT COUNT(*) FROM tag;`)
+	catch(t, err)
+
+	column, err := trepo.Schema().Column("added")
+	catch(t, err)
+
+	if column.Kind != repo.Time {
+		t.Fatalf("Did not describe column: %s", column.Kind)
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:")
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	irepo, err := hold.NewRepo("internal")
+	catch(t, err)
+
+	create := func(i int) {
+		crate, err := irepo.Create()
+		catch(t, err)
+		catch(t, crate.Set("type", []byte(fmt.Sprintf("test%d", i % 2))))
+		catch(t, crate.Set("origin", []byte("test")))
+		catch(t, crate.Set("data", []byte{byte(i)}))
+		catch(t, crate.Save(ctx))
+	}
+
+	for i := 0; i < 7; i++ {
+		create(i)
+	}
+
+	seen := []int64{}
+	token := ""
+	for {
+		page, err := irepo.Paginate(ctx, nil, token, 3)
+		catch(t, err)
+
+		for _, entity := range page.Entities {
+			id, _ := entity.ExportMetadata()
+			seen = append(seen, id)
+		}
+
+		if len(seen) == 3 {
+			create(7)
+		}
+
+		if len(page.Next) == 0 {
+			break
+		}
+
+		token = page.Next
+	}
+
+	if len(seen) != 8 {
+		t.Fatalf("Did not page through entities: %v", seen)
+	}
+
+	for i, id := range seen {
+		if id != int64(i + 1) {
+			t.Fatalf("Did not keep pages stable: %v", seen)
+		}
+	}
+
+	query := repo.NewQuery().
+		Where(repo.Eq("type", "test0")).
+		OrderBy("added", repo.Descending)
+
+	page, err := irepo.Paginate(ctx, query, "", 3)
+	catch(t, err)
+
+	first, _ := page.Entities[0].ExportMetadata()
+	if len(page.Entities) != 3 || first != 7 {
+		t.Fatalf("Did not page filtered entities: %d", first)
+	}
+
+	page, err = irepo.Paginate(ctx, query, page.Next, 3)
+	catch(t, err)
+
+	first, _ = page.Entities[0].ExportMetadata()
+	if len(page.Entities) != 1 || first != 1 || len(page.Next) != 0 {
+		t.Fatalf("Did not finish filtered pages: %d", first)
+	}
+
+	// the cursor holds once the row it was read from is gone
+	page, err = irepo.Paginate(ctx, query.Metadata(), "", 2)
+	catch(t, err)
+	catch(t, page.Entities[1].Delete(ctx))
+
+	page, err = irepo.Paginate(ctx, query, page.Next, 3)
+	catch(t, err)
+
+	first, _ = page.Entities[0].ExportMetadata()
+	if len(page.Entities) != 2 || first != 3 {
+		t.Fatalf("Did not page past deleted row: %d", first)
+	}
+
+	_, err = irepo.Paginate(ctx, query, "invalid", 3)
+	if err == nil {
+		t.Fatal("Accepted invalid cursor")
+	}
+}
+
+func TestEager(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:")
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	labels := []string{"work", "urgent"}
+	tags := []*model.Tag{}
+	for _, label := range labels {
+		tag, err := hold.NewTag()
+		catch(t, err)
+		catch(t, tag.Set("label", []byte(label)))
+		catch(t, tag.Save(ctx))
+		tags = append(tags, tag)
+	}
+
+	ecrate, err := hold.NewCrate("external")
+	catch(t, err)
+	catch(t, ecrate.Set("type", []byte("test")))
+	catch(t, ecrate.Set("name", []byte("test")))
+	catch(t, ecrate.Set("body", []byte("test")))
+	catch(t, ecrate.Save(ctx))
+
+	external := ecrate.(*model.External)
+	for i := 0; i < repo.BatchSize + 2; i++ {
+		crate, err := hold.NewCrate("internal")
+		catch(t, err)
+		catch(t, crate.Set("type", []byte("test")))
+		catch(t, crate.Set("origin", []byte("test")))
+		catch(t, crate.Set("data", []byte{byte(i)}))
+		catch(t, crate.Save(ctx))
+
+		for _, tag := range tags {
+			catch(t, crate.Map(ctx, tag))
+		}
+
+		catch(t, crate.Map(ctx, ecrate))
+	}
+
+	irepo, err := hold.NewRepo("internal")
+	catch(t, err)
+
+	entities, err := irepo.Find(ctx, repo.NewQuery()).Entities()
+	catch(t, err)
+
+	if len(entities[0].(*model.Internal).Tags) != 0 {
+		t.Fatal("Loaded tags without asking")
+	}
+
+	entities, err = irepo.Find(ctx, repo.NewQuery().Eager()).Entities()
+	catch(t, err)
+
+	if len(entities) != repo.BatchSize + 2 {
+		t.Fatalf("Did not load all entities: %d", len(entities))
+	}
+
+	for _, entity := range entities {
+		internal := entity.(*model.Internal)
+		_, mapped := internal.Mapping[model.Key{Mapper: "external", ID: external.ID}]
+		if len(internal.Tags) != len(tags) || !mapped {
+			t.Fatalf("Did not hydrate %d: %d", internal.ID, len(internal.Tags))
+		}
+	}
+
+	internal := entities[0].(*model.Internal)
+	catch(t, internal.Unmap(ctx, tags[0]))
+
+	if len(internal.Tags) != 1 {
+		t.Fatal("Did not remove hydrated tag")
+	}
+
+	var buffer strings.Builder
+	catch(t, internal.Encode(&buffer))
+
+	if !strings.Contains(buffer.String(), `"label":"urgent"`) {
+		t.Fatalf("Did not encode tags: %s", buffer.String())
+	}
+
+	erepo, err := hold.NewRepo("external")
+	catch(t, err)
+
+	page, err := erepo.Paginate(ctx, repo.NewQuery().Eager(), "", 1)
+	catch(t, err)
+
+	external = page.Entities[0].(*model.External)
+	if len(external.Mapping) != repo.BatchSize + 2 {
+		t.Fatalf("Did not hydrate page: %d", len(external.Mapping))
+	}
+}
+
+func TestTagged(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:")
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	tags := map[string]*model.Tag{}
+	for _, label := range []string{"work", "urgent", "review", "archived"} {
+		tag, err := hold.NewTag()
+		catch(t, err)
+		catch(t, tag.Set("label", []byte(label)))
+		catch(t, tag.Save(ctx))
+		tags[label] = tag
+	}
+
+	crates := [][]string{
+		{"work", "urgent"},
+		{"work", "review", "archived"},
+		{"work"},
+		{"urgent", "review"},
+		{"work", "review"},
+	}
+
+	for i, labels := range crates {
+		crate, err := hold.NewCrate("external")
+		catch(t, err)
+		catch(t, crate.Set("type", []byte("test")))
+		catch(t, crate.Set("name", []byte(fmt.Sprintf("test%d", i))))
+		catch(t, crate.Set("body", []byte("test")))
+		catch(t, crate.Save(ctx))
+
+		for _, label := range labels {
+			catch(t, crate.Map(ctx, tags[label]))
+		}
+	}
+
+	entity, err := hold.NewRepo("external")
+	catch(t, err)
+
+	erepo := entity.(repo.Tagger)
+	expressions := map[string]int{
+		`work AND (urgent OR review) AND NOT archived`: 2,
+		`work (urgent OR review) NOT archived`:         2,
+		`urgent OR review`:                             4,
+		`NOT work`:                                     1,
+		`"work"`:                                       4,
+	}
+
+	for expr, expected := range expressions {
+		stream := erepo.Tagged(ctx, expr)
+		count := StreamSize(stream)
+		catch(t, stream.Err())
+
+		if count != expected {
+			t.Fatalf("Did not match %s: %d", expr, count)
+		}
+	}
+
+	for _, expr := range []string{`work AND`, `(work`, `work)`, `"work`, ``} {
+		stream := erepo.Tagged(ctx, expr)
+		StreamSize(stream)
+
+		_, ok := stream.Err().(*repo.ExpressionError)
+		if !ok {
+			t.Fatalf("Did not reject %q: %v", expr, stream.Err())
+		}
+	}
+}
+
+func TestRelated(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:")
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	raw, err := hold.NewCrate("internal")
+	catch(t, err)
+	catch(t, raw.Set("type", []byte("html")))
+	catch(t, raw.Set("origin", []byte("test")))
+	catch(t, raw.Set("data", []byte("<p>test</p>")))
+	catch(t, raw.Save(ctx))
+
+	other, err := hold.NewCrate("internal")
+	catch(t, err)
+	catch(t, other.Set("type", []byte("json")))
+	catch(t, other.Set("origin", []byte("test")))
+	catch(t, other.Set("data", []byte("{}")))
+	catch(t, other.Save(ctx))
+
+	tag, err := hold.NewTag()
+	catch(t, err)
+	catch(t, tag.Set("label", []byte("derived")))
+	catch(t, tag.Save(ctx))
+
+	for i := 0; i < 3; i++ {
+		crate, err := hold.NewCrate("external")
+		catch(t, err)
+		catch(t, crate.Set("type", []byte("note")))
+		catch(t, crate.Set("name", []byte(fmt.Sprintf("note%d", i))))
+		catch(t, crate.Set("body", []byte("test")))
+		catch(t, crate.Save(ctx))
+		catch(t, crate.Map(ctx, raw))
+
+		if i == 0 {
+			catch(t, crate.Map(ctx, other))
+			catch(t, crate.Map(ctx, tag))
+			catch(t, crate.(*model.External).Link(ctx, raw))
+		}
+	}
+
+	irepo, err := hold.NewRepo("internal")
+	catch(t, err)
+
+	erepo, err := hold.NewRepo("external")
+	catch(t, err)
+
+	trepo, err := hold.NewRepo("tag")
+	catch(t, err)
+
+	count := StreamSize(erepo.Related(ctx, raw))
+	if count != 3 {
+		t.Fatalf("Did not find externals of internal: %d", count)
+	}
+
+	first, err := erepo.Get(ctx, 1)
+	catch(t, err)
+
+	count = StreamSize(irepo.Related(ctx, first))
+	if count != 2 {
+		t.Fatalf("Did not find internals of external: %d", count)
+	}
+
+	count = StreamSize(erepo.(*repo.External).Linked(ctx, raw))
+	if count != 1 {
+		t.Fatalf("Did not find linked externals: %d", count)
+	}
+
+	tags, err := trepo.Related(ctx, first).Entities()
+	catch(t, err)
+
+	if len(tags) != 1 || tags[0].(*model.Tag).Label != "derived" {
+		t.Fatalf("Did not find tags of external: %d", len(tags))
+	}
+
+	count = StreamSize(erepo.Related(ctx, tag))
+	if count != 1 {
+		t.Fatalf("Did not find externals of tag: %d", count)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:")
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	for i := 0; i < 3; i++ {
+		internal, err := hold.NewCrate("internal")
+		catch(t, err)
+		catch(t, internal.Set("type", []byte("capture")))
+		catch(t, internal.Set("origin", []byte(fmt.Sprintf("origin%d", i))))
+		catch(t, internal.Set("data", []byte(fmt.Sprintf("payload%d", i))))
+		catch(t, internal.Save(ctx))
+
+		external, err := hold.NewCrate("external")
+		catch(t, err)
+		catch(t, external.Set("type", []byte("note")))
+		catch(t, external.Set("name", []byte(fmt.Sprintf("title%d", i))))
+		catch(t, external.Set("body", []byte(fmt.Sprintf("body%d", i))))
+		catch(t, external.Save(ctx))
+	}
+
+	query := repo.NewQuery().Metadata()
+	statement, _, err := query.Build(repo.InternalSchema)
+	catch(t, err)
+
+	if strings.Contains(statement, "blob") {
+		t.Fatalf("Selected payload: %s", statement)
+	}
+
+	entity, err := hold.NewRepo("internal")
+	catch(t, err)
+
+	irepo := entity.(*repo.Internal)
+	internals, err := irepo.Find(ctx, query).Entities()
+	catch(t, err)
+
+	for _, internal := range internals {
+		crate := internal.(*model.Internal)
+		if crate.Data != nil || !strings.HasPrefix(crate.Origin, "origin") {
+			t.Fatalf("Invalid metadata: %#v", crate)
+		}
+	}
+
+	// crates loaded without their payload keep it when written back
+	internals[0].(*model.Internal).Origin = "updated"
+	catch(t, internals[0].Update(ctx))
+	catch(t, irepo.UpdateAll(ctx, internals[1:]...))
+
+	catch(t, irepo.Fill(ctx, internals...))
+	for i, internal := range internals {
+		if string(internal.(*model.Internal).Data) != fmt.Sprintf("payload%d", i) {
+			t.Fatalf("Did not fill data: %d", i)
+		}
+	}
+
+	entity, err = hold.NewRepo("external")
+	catch(t, err)
+
+	erepo := entity.(*repo.External)
+	page, err := erepo.Paginate(ctx, repo.NewQuery().Metadata(), "", 2)
+	catch(t, err)
+
+	for _, external := range page.Entities {
+		crate := external.(*model.External)
+		if len(crate.Body) != 0 || !strings.HasPrefix(crate.Name, "title") {
+			t.Fatalf("Invalid metadata: %#v", crate)
+		}
+	}
+
+	catch(t, erepo.UpdateAll(ctx, page.Entities...))
+	catch(t, erepo.Fill(ctx, page.Entities...))
+	if page.Entities[1].(*model.External).Body != "body1" {
+		t.Fatal("Did not fill body")
+	}
+}
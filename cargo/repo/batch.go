@@ -0,0 +1,202 @@
+package repo
+
+import (
+	"context"
+
+	"github.com/aewens/nautical/cargo/model"
+)
+
+// batch writes every entity in one transaction, each under its own savepoint
+// so that a failure only undoes that entity, in the database and in the ID,
+// UUID and times it holds. The failures are returned together as BatchErrors once the
+// rest have been committed, and the entities are left bound to store.
+func batch(
+	ctx      context.Context,
+	store    model.Store,
+	entities []model.Entity,
+	write    func(context.Context, model.Entity) error,
+) error {
+	failures := &BatchErrors{Total: len(entities)}
+
+	defer func() {
+		for _, entity := range entities {
+			entity.Bind(store)
+		}
+	}()
+
+	err := model.Batched(ctx, store, func(tx model.Store) error {
+		for index, entity := range entities {
+			entity.Bind(tx)
+			_, err := tx.ExecContext(ctx, "SAVEPOINT item;")
+			if err != nil {
+				return err
+			}
+
+			restore := entity.Snapshot()
+			err = write(ctx, entity)
+			if err != nil {
+				restore()
+				failures.Errors = append(failures.Errors, &ItemError{
+					Index:  index,
+					Entity: entity,
+					Err:    err,
+				})
+
+				_, err = tx.ExecContext(ctx, "ROLLBACK TO item;")
+				if err != nil {
+					return err
+				}
+			}
+
+			_, err = tx.ExecContext(ctx, "RELEASE item;")
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if len(failures.Errors) > 0 {
+		return failures
+	}
+
+	return nil
+}
+
+func save(ctx context.Context, entity model.Entity) error {
+	return entity.Save(ctx)
+}
+
+func update(ctx context.Context, entity model.Entity) error {
+	return entity.Update(ctx)
+}
+
+func upsert(ctx context.Context, entity model.Entity) error {
+	return entity.Upsert(ctx)
+}
+
+func remove(ctx context.Context, entity model.Entity) error {
+	return entity.Delete(ctx)
+}
+
+func mapTo(related model.Entity) func(context.Context, model.Entity) error {
+	return func(ctx context.Context, entity model.Entity) error {
+		return entity.Map(ctx, related)
+	}
+}
+
+func (self *Internal) SaveAll(
+	ctx      context.Context,
+	entities ...model.Entity,
+) error {
+	return batch(ctx, self.Store, entities, save)
+}
+
+func (self *Internal) UpdateAll(
+	ctx      context.Context,
+	entities ...model.Entity,
+) error {
+	return batch(ctx, self.Store, entities, update)
+}
+
+func (self *Internal) UpsertAll(
+	ctx      context.Context,
+	entities ...model.Entity,
+) error {
+	return batch(ctx, self.Store, entities, upsert)
+}
+
+func (self *Internal) DeleteAll(
+	ctx      context.Context,
+	entities ...model.Entity,
+) error {
+	return batch(ctx, self.Store, entities, remove)
+}
+
+// MapAll maps each of entities to related.
+func (self *Internal) MapAll(
+	ctx      context.Context,
+	related  model.Entity,
+	entities ...model.Entity,
+) error {
+	return batch(ctx, self.Store, entities, mapTo(related))
+}
+
+func (self *External) SaveAll(
+	ctx      context.Context,
+	entities ...model.Entity,
+) error {
+	return batch(ctx, self.Store, entities, save)
+}
+
+func (self *External) UpdateAll(
+	ctx      context.Context,
+	entities ...model.Entity,
+) error {
+	return batch(ctx, self.Store, entities, update)
+}
+
+func (self *External) UpsertAll(
+	ctx      context.Context,
+	entities ...model.Entity,
+) error {
+	return batch(ctx, self.Store, entities, upsert)
+}
+
+func (self *External) DeleteAll(
+	ctx      context.Context,
+	entities ...model.Entity,
+) error {
+	return batch(ctx, self.Store, entities, remove)
+}
+
+// MapAll maps each of entities to related.
+func (self *External) MapAll(
+	ctx      context.Context,
+	related  model.Entity,
+	entities ...model.Entity,
+) error {
+	return batch(ctx, self.Store, entities, mapTo(related))
+}
+
+func (self *Tag) SaveAll(
+	ctx      context.Context,
+	entities ...model.Entity,
+) error {
+	return batch(ctx, self.Store, entities, save)
+}
+
+func (self *Tag) UpdateAll(
+	ctx      context.Context,
+	entities ...model.Entity,
+) error {
+	return batch(ctx, self.Store, entities, update)
+}
+
+func (self *Tag) UpsertAll(
+	ctx      context.Context,
+	entities ...model.Entity,
+) error {
+	return batch(ctx, self.Store, entities, upsert)
+}
+
+func (self *Tag) DeleteAll(
+	ctx      context.Context,
+	entities ...model.Entity,
+) error {
+	return batch(ctx, self.Store, entities, remove)
+}
+
+// MapAll maps each of entities, tags, to related.
+func (self *Tag) MapAll(
+	ctx      context.Context,
+	related  model.Entity,
+	entities ...model.Entity,
+) error {
+	return batch(ctx, self.Store, entities, mapTo(related))
+}
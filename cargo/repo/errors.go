@@ -0,0 +1,95 @@
+package repo
+
+import (
+	"fmt"
+
+	"github.com/aewens/nautical/cargo/model"
+)
+
+type RowErrors struct {
+	Errors []error
+}
+
+func (self *RowErrors) Error() string {
+	return fmt.Sprintf("%d rows failed, first: %s", len(self.Errors), self.Errors[0])
+}
+
+// ItemError is the failure of one entity of a batch, by its position.
+type ItemError struct {
+	Index  int
+	Entity model.Entity
+	Err    error
+}
+
+func (self *ItemError) Error() string {
+	return fmt.Sprintf("Item %d failed: %s", self.Index, self.Err)
+}
+
+func (self *ItemError) Unwrap() error {
+	return self.Err
+}
+
+// BatchErrors lists the entities of a batch that were not written; the rest
+// were.
+type BatchErrors struct {
+	Total  int
+	Errors []*ItemError
+}
+
+func (self *BatchErrors) Error() string {
+	return fmt.Sprintf(
+		"%d of %d items failed, first: %s",
+		len(self.Errors),
+		self.Total,
+		self.Errors[0],
+	)
+}
+
+type UnknownFieldError struct {
+	Table string
+	Field string
+}
+
+func (self *UnknownFieldError) Error() string {
+	return fmt.Sprintf("Unknown field for %s: %q", self.Table, self.Field)
+}
+
+type OperatorError struct {
+	Operator string
+}
+
+func (self *OperatorError) Error() string {
+	return fmt.Sprintf("Unknown operator: %q", self.Operator)
+}
+
+type FieldKindError struct {
+	Table    string
+	Field    string
+	Kind     Kind
+	Expected []Kind
+}
+
+func (self *FieldKindError) Error() string {
+	return fmt.Sprintf(
+		"Field %s.%s is %s, expected %v",
+		self.Table,
+		self.Field,
+		self.Kind,
+		self.Expected,
+	)
+}
+
+type ExpressionError struct {
+	Expr     string
+	Position int
+	Reason   string
+}
+
+func (self *ExpressionError) Error() string {
+	return fmt.Sprintf(
+		"Invalid tag expression at %d (%s): %s",
+		self.Position,
+		self.Reason,
+		self.Expr,
+	)
+}
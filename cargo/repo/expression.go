@@ -0,0 +1,228 @@
+package repo
+
+import (
+	"strings"
+	"unicode"
+)
+
+type token struct {
+	text     string
+	quoted   bool
+	position int
+}
+
+func tokenize(expr string) ([]token, error) {
+	tokens := []token{}
+	runes := []rune(expr)
+
+	for i := 0; i < len(runes); {
+		current := runes[i]
+		switch {
+		case unicode.IsSpace(current):
+			i = i + 1
+		case current == '(' || current == ')':
+			tokens = append(tokens, token{string(current), false, i})
+			i = i + 1
+		case current == '"':
+			start := i
+			i = i + 1
+			for i < len(runes) && runes[i] != '"' {
+				i = i + 1
+			}
+
+			if i >= len(runes) {
+				return nil, &ExpressionError{expr, start, "unterminated quote"}
+			}
+
+			tokens = append(tokens, token{string(runes[start+1:i]), true, start})
+			i = i + 1
+		default:
+			start := i
+			for i < len(runes) {
+				next := runes[i]
+				if unicode.IsSpace(next) || next == '(' || next == ')' {
+					break
+				}
+
+				i = i + 1
+			}
+
+			tokens = append(tokens, token{string(runes[start:i]), false, start})
+		}
+	}
+
+	return tokens, nil
+}
+
+type parser struct {
+	expr   string
+	tokens []token
+	index  int
+}
+
+func (self *parser) peek() (token, bool) {
+	if self.index >= len(self.tokens) {
+		return token{}, false
+	}
+
+	return self.tokens[self.index], true
+}
+
+func (self *parser) keyword(word string) bool {
+	next, ok := self.peek()
+	if !ok || next.quoted || strings.ToUpper(next.text) != word {
+		return false
+	}
+
+	self.index = self.index + 1
+	return true
+}
+
+func (self *parser) fail(reason string) error {
+	position := len(self.expr)
+	next, ok := self.peek()
+	if ok {
+		position = next.position
+	}
+
+	return &ExpressionError{self.expr, position, reason}
+}
+
+func (self *parser) or() (Predicate, error) {
+	left, err := self.and()
+	if err != nil {
+		return nil, err
+	}
+
+	predicates := []Predicate{left}
+	for self.keyword("OR") {
+		right, err := self.and()
+		if err != nil {
+			return nil, err
+		}
+
+		predicates = append(predicates, right)
+	}
+
+	if len(predicates) == 1 {
+		return left, nil
+	}
+
+	return Or(predicates...), nil
+}
+
+// Adjacent terms without an operator between them are joined with AND.
+func (self *parser) and() (Predicate, error) {
+	left, err := self.not()
+	if err != nil {
+		return nil, err
+	}
+
+	predicates := []Predicate{left}
+	for {
+		next, ok := self.peek()
+		if !ok || next.text == ")" {
+			break
+		}
+
+		if !next.quoted && strings.ToUpper(next.text) == "OR" {
+			break
+		}
+
+		self.keyword("AND")
+		right, err := self.not()
+		if err != nil {
+			return nil, err
+		}
+
+		predicates = append(predicates, right)
+	}
+
+	if len(predicates) == 1 {
+		return left, nil
+	}
+
+	return And(predicates...), nil
+}
+
+func (self *parser) not() (Predicate, error) {
+	if self.keyword("NOT") {
+		predicate, err := self.not()
+		if err != nil {
+			return nil, err
+		}
+
+		return Not(predicate), nil
+	}
+
+	return self.term()
+}
+
+func (self *parser) term() (Predicate, error) {
+	next, ok := self.peek()
+	if !ok {
+		return nil, self.fail("expected tag")
+	}
+
+	if !next.quoted && next.text == "(" {
+		self.index = self.index + 1
+		predicate, err := self.or()
+		if err != nil {
+			return nil, err
+		}
+
+		closing, ok := self.peek()
+		if !ok || closing.quoted || closing.text != ")" {
+			return nil, self.fail("expected )")
+		}
+
+		self.index = self.index + 1
+		return predicate, nil
+	}
+
+	if !next.quoted {
+		switch strings.ToUpper(next.text) {
+		case ")", "AND", "OR", "NOT":
+			return nil, self.fail("expected tag")
+		}
+	}
+
+	self.index = self.index + 1
+	if !next.quoted && strings.HasSuffix(next.text, "/*") {
+		return Under(strings.TrimSuffix(next.text, "/*")), nil
+	}
+
+	if !next.quoted && strings.HasSuffix(next.text, "=*") {
+		return InNamespace(strings.TrimSuffix(next.text, "=*")), nil
+	}
+
+	return HasTag(next.text), nil
+}
+
+// ParseTags turns an expression such as `work AND (urgent OR review) AND NOT
+// archived` into a Predicate over tag labels. NOT binds tightest, then AND,
+// then OR; labels containing spaces or keywords can be double quoted, and a
+// label ending in /* also matches every tag beneath it, while namespace=*
+// matches every tag in that namespace.
+func ParseTags(expr string) (Predicate, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &parser{
+		expr:   expr,
+		tokens: tokens,
+	}
+
+	predicate, err := state.or()
+	if err != nil {
+		return nil, err
+	}
+
+	if state.index < len(state.tokens) {
+		return nil, state.fail("unexpected token")
+	}
+
+	return predicate, nil
+}
@@ -1,6 +1,7 @@
 package repo
 
 import (
+	"context"
 	"fmt"
 	"time"
 	"database/sql"
@@ -9,11 +10,11 @@ import (
 )
 
 type External struct {
-	Store  *sql.DB
+	Store  model.Store
 	Crates map[int64]*model.External
 }
 
-func NewExternal(store *sql.DB) *External {
+func NewExternal(store model.Store) *External {
 	return &External{
 		Store:  store,
 		Crates: make(map[int64]*model.External),
@@ -24,17 +25,29 @@ func (self *External) Create() (model.Entity, error) {
 	return model.NewExternal(self.Store)
 }
 
-func (self *External) Load(stream Stream) {
-	for entity := range stream {
-		external, ok := entity.(*model.External)
+func (self *External) Schema() *Schema {
+	return ExternalSchema
+}
+
+func (self *External) Load(stream *Stream) error {
+	for item := range stream.Items {
+		if item.Err != nil {
+			continue
+		}
+
+		external, ok := item.Entity.(*model.External)
 		if !ok {
 			continue
 		}
 
 		self.Crates[external.ID] = external
 	}
+
+	return stream.Err()
 }
 
+// Import builds a crate from a row. A linked crate is left as a stub holding
+// only its id, which links loads for a whole batch of crates at once.
 func (self *External) Import(
 	id      int64,
 	uuid    []byte,
@@ -66,26 +79,71 @@ func (self *External) Import(
 	external.Body = body
 
 	if link.Valid {
-		internals := NewInternal(self.Store)
-		ientity, err := internals.Get(link.Int64)
-		if err != nil {
-			return entity, err
+		external.Meta = &model.Internal{}
+		external.Meta.ID = link.Int64
+	}
+
+	return entity, nil
+}
+
+// links replaces the stubs Import leaves for linked crates with the crates
+// themselves, without their data, in a single query. Crates linked to data in
+// the trash are left without a link.
+func (self *External) links(
+	ctx      context.Context,
+	entities []model.Entity,
+) error {
+	owners := make(map[int64][]*model.External)
+	args := []interface{}{}
+	for _, entity := range entities {
+		external, ok := entity.(*model.External)
+		if !ok {
+			return fmt.Errorf("Cannot cast to External: %#v", entity)
 		}
 
-		err = external.Link(ientity)
-		if err != nil {
-			return entity, err
+		if external.Meta == nil {
+			continue
 		}
+
+		id := external.Meta.ID
+		if _, ok := owners[id]; !ok {
+			args = append(args, id)
+		}
+
+		owners[id] = append(owners[id], external)
+		external.Meta = nil
 	}
 
-	return entity, nil
+	if len(args) == 0 {
+		return nil
+	}
+
+	query := NewQuery().Metadata().Where(In("id", args...))
+	internals, err := NewInternal(self.Store).Find(ctx, query).Entities()
+	if err != nil {
+		return err
+	}
+
+	for _, entity := range internals {
+		meta, ok := entity.(*model.Internal)
+		if !ok {
+			return fmt.Errorf("Cannot cast to Internal: %#v", entity)
+		}
+
+		for _, external := range owners[meta.ID] {
+			external.Meta = meta
+			external.Data = meta.UUID
+		}
+	}
+
+	return nil
 }
 
-func (self *External) Get(id int64) (model.Entity, error) {
-	statement, err := self.Store.Prepare(`
-		SELECT uuid, added, updated, flag, type, name, body, data
-		FROM external WHERE id = ?;
-	`)
+func (self *External) Get(ctx context.Context, id int64) (model.Entity, error) {
+	statement, err := self.Store.PrepareContext(ctx, fmt.Sprintf(`
+		SELECT uuid, added, updated, flag, type, name, %s, data
+		FROM external WHERE id = ? AND NOT %s;
+	`, ExternalSchema.Expression("body"), trash("external")))
 
 	if err != nil {
 		return nil, err
@@ -103,7 +161,7 @@ func (self *External) Get(id int64) (model.Entity, error) {
 	)
 
 	defer statement.Close()
-	err = statement.QueryRow(id).Scan(
+	err = statement.QueryRowContext(ctx, id).Scan(
 		&uuid,
 		&added,
 		&updated,
@@ -118,7 +176,7 @@ func (self *External) Get(id int64) (model.Entity, error) {
 		return nil, err
 	}
 
-	return self.Import(
+	entity, err := self.Import(
 		id,
 		uuid,
 		added,
@@ -129,24 +187,60 @@ func (self *External) Get(id int64) (model.Entity, error) {
 		body,
 		link,
 	)
+
+	if err != nil {
+		return entity, err
+	}
+
+	return entity, self.links(ctx, []model.Entity{entity})
+}
+
+func (self *External) GetByUUID(
+	ctx  context.Context,
+	uuid []byte,
+) (model.Entity, error) {
+	return first(self.Find(ctx, NewQuery().Where(Eq("uuid", uuid))))
+}
+
+func (self *External) LookupUUIDs(ctx context.Context, uuids ...[]byte) *Stream {
+	values := []interface{}{}
+	for _, uuid := range uuids {
+		values = append(values, uuid)
+	}
+
+	return self.Find(ctx, NewQuery().Where(In("uuid", values...)))
+}
+
+// Process streams the crates read from rows, loading their links a batch at a
+// time.
+func (self *External) Process(stream *Stream, rows *sql.Rows) {
+	ctx := stream.Context()
+	source := NewStream(ctx)
+	go self.scan(source, rows)
+	relay(source, stream, BatchSize, func(entities []model.Entity) error {
+		return self.links(ctx, entities)
+	})
 }
 
-func (self *External) Process(stream Stream, rows *sql.Rows) {
+func (self *External) scan(stream *Stream, rows *sql.Rows) {
 	defer rows.Close()
 	for rows.Next() {
 		var (
-			id      int64
-			uuid    []byte
-			added   time.Time
-			updated time.Time
-			flag    uint8
-			etype   string
-			name    string
-			body    string
-			link    sql.NullInt64
+			id       int64
+			uuid     []byte
+			added    time.Time
+			updated  time.Time
+			flag     uint8
+			etype    string
+			name     string
+			body     string
+			link     sql.NullInt64
+			position string
 		)
 
-		err := rows.Scan(
+		err := rows.Scan(positioned(
+			rows,
+			&position,
 			&id,
 			&uuid,
 			&added,
@@ -156,9 +250,13 @@ func (self *External) Process(stream Stream, rows *sql.Rows) {
 			&name,
 			&body,
 			&link,
-		)
+		)...)
 
 		if err != nil {
+			if !stream.Fail(err) {
+				break
+			}
+
 			continue
 		}
 
@@ -175,181 +273,175 @@ func (self *External) Process(stream Stream, rows *sql.Rows) {
 		)
 
 		if err != nil {
+			if !stream.Fail(err) {
+				break
+			}
+
 			continue
 		}
 
-		stream <- entity
+		if !stream.mark(entity, position) {
+			break
+		}
 	}
 
-	close(stream)
+	stream.Close(rows.Err())
 }
 
-func (self *External) All() Stream {
-	stream := make(Stream)
-
-	go func() {
-		rows, err := self.Store.Query(`
-			SELECT id, uuid, added, updated, flag, type, name, body, data
-			FROM external;
-		`)
-
-		if err != nil {
-			return
-		}
-
-		self.Process(stream, rows)
-	}()
+func (self *External) All(ctx context.Context) *Stream {
+	return self.Find(ctx, NewQuery())
+}
 
-	return stream
+// Trash streams the crates that were soft deleted and not yet purged.
+func (self *External) Trash(ctx context.Context) *Stream {
+	return self.Find(ctx, NewQuery().InTrash())
 }
 
-func (self *External) Lookup(ids ...int64) Stream {
-	stream := make(Stream)
+func (self *External) Lookup(ctx context.Context, ids ...int64) *Stream {
+	stream := NewStream(ctx)
+	ctx = stream.Context()
 
 	go func() {
 		for _, id := range ids {
-			entity, err := self.Get(id)
-			if err == nil {
-				stream <- entity
+			entity, err := self.Get(ctx, id)
+			if err != nil {
+				if !stream.Fail(err) {
+					break
+				}
+
+				continue
+			}
+
+			if !stream.Send(entity) {
+				break
 			}
 		}
 
-		close(stream)
+		stream.Close(nil)
 	}()
 
 	return stream
 }
 
-func (self *External) Contains(field string, search string) Stream {
-	stream := make(Stream)
-
-	go func() {
-		statement, err := self.Store.Prepare(fmt.Sprintf(`
-			SELECT id, uuid, added, updated, flag, type, name, body, data
-			FROM external WHERE %s LIKE ?;
-		`, field))
-
-		if err != nil {
-			return
-		}
-
-		defer statement.Close()
-		rows, err := statement.Query("%" + search + "%")
-
-		if err != nil {
-			return
-		}
+func (self *External) Contains(
+	ctx    context.Context,
+	field  string,
+	search string,
+) *Stream {
+	return self.Find(ctx, NewQuery().Where(Like(field, search)))
+}
 
-		self.Process(stream, rows)
-	}()
+func (self *External) Equals(
+	ctx    context.Context,
+	field  string,
+	search string,
+) *Stream {
+	return self.Find(ctx, NewQuery().Where(Eq(field, search)))
+}
 
-	return stream
+func (self *External) Before(
+	ctx    context.Context,
+	field  string,
+	search time.Time,
+) *Stream {
+	return self.Find(ctx, NewQuery().Where(Lt(field, search)))
 }
 
-func (self *External) Equals(field string, search string) Stream {
-	stream := make(Stream)
+func (self *External) After(
+	ctx    context.Context,
+	field  string,
+	search time.Time,
+) *Stream {
+	return self.Find(ctx, NewQuery().Where(Gt(field, search)))
+}
 
-	go func() {
-		statement, err := self.Store.Prepare(fmt.Sprintf(`
-			SELECT id, uuid, added, updated, flag, type, name, body, data
-			FROM external WHERE %s = ?;
-		`, field))
+func (self *External) Between(
+	ctx    context.Context,
+	field  string,
+	before time.Time,
+	after  time.Time,
+) *Stream {
+	return self.Find(ctx, NewQuery().Where(And(
+		Gt(field, before),
+		Lt(field, after),
+	)))
+}
 
-		if err != nil {
-			return
-		}
+func (self *External) Tagged(ctx context.Context, expr string) *Stream {
+	predicate, err := ParseTags(expr)
+	if err != nil {
+		return Failed(ctx, err)
+	}
 
-		defer statement.Close()
-		rows, err := statement.Query(search)
+	return self.Find(ctx, NewQuery().Where(predicate))
+}
 
-		if err != nil {
-			return
-		}
+// Related streams the crates that share a mapping row with entity.
+func (self *External) Related(
+	ctx    context.Context,
+	entity model.Entity,
+) *Stream {
+	return self.Find(ctx, NewQuery().Where(MappedTo(entity)))
+}
 
-		self.Process(stream, rows)
-	}()
+// Linked streams the externals whose data column points at internal.
+func (self *External) Linked(
+	ctx      context.Context,
+	internal model.Entity,
+) *Stream {
+	id, mapper := internal.ExportMetadata()
+	if mapper != "internal" {
+		return Failed(ctx, fmt.Errorf("Cannot link to: %s", mapper))
+	}
 
-	return stream
+	return self.Find(ctx, NewQuery().Where(Eq("data", id)))
 }
 
-func (self *External) Before(field string, search time.Time) Stream {
-	stream := make(Stream)
+func (self *External) Find(ctx context.Context, query *Query) *Stream {
+	stream := NewStream(ctx)
+	ctx = stream.Context()
 
 	go func() {
-		statement, err := self.Store.Prepare(fmt.Sprintf(`
-			SELECT id, uuid, added, updated, flag, type, name, body, data
-			FROM external WHERE %s < ?;
-		`, field))
+		statement, args, err := query.Build(self.Schema())
 
 		if err != nil {
+			stream.Close(err)
 			return
 		}
 
-		defer statement.Close()
-		rows, err := statement.Query(search)
-
-		if err != nil {
-			return
-		}
-
-		self.Process(stream, rows)
-	}()
-
-	return stream
-}
-
-func (self *External) After(field string, search time.Time) Stream {
-	stream := make(Stream)
-
-	go func() {
-		statement, err := self.Store.Prepare(fmt.Sprintf(`
-			SELECT id, uuid, added, updated, flag, type, name, body, data
-			FROM external WHERE %s > ?;
-		`, field))
-
+		rows, err := self.Store.QueryContext(ctx, statement, args...)
 		if err != nil {
+			stream.Close(err)
 			return
 		}
 
-		defer statement.Close()
-		rows, err := statement.Query(search)
-
-		if err != nil {
+		if !query.Hydrate {
+			self.Process(stream, rows)
 			return
 		}
 
-		self.Process(stream, rows)
+		source := NewStream(ctx)
+		go self.Process(source, rows)
+		relay(source, stream, BatchSize, func(entities []model.Entity) error {
+			return self.Hydrate(ctx, entities...)
+		})
 	}()
 
 	return stream
 }
 
-func (self *External) Between(
-	field string,
-	before time.Time,
-	after time.Time,
-) Stream {
-	stream := make(Stream)
-
-	go func() {
-		statement, err := self.Store.Prepare(fmt.Sprintf(`
-			SELECT id, uuid, added, updated, flag, type, name, body, data
-			FROM external WHERE %s > ? AND %s < ?;
-		`, field, field))
-
-		if err != nil {
-			return
-		}
-
-		defer statement.Close()
-		rows, err := statement.Query(before, after)
-
-		if err != nil {
-			return
-		}
-
-		self.Process(stream, rows)
-	}()
+func (self *External) Hydrate(
+	ctx      context.Context,
+	entities ...model.Entity,
+) error {
+	return hydrate(ctx, self.Store, "external", entities)
+}
 
-	return stream
+func (self *External) Paginate(
+	ctx   context.Context,
+	query *Query,
+	token string,
+	size  int,
+) (*Page, error) {
+	return paginate(ctx, self, query, token, size)
 }
@@ -0,0 +1,121 @@
+package repo
+
+import (
+	"fmt"
+	"context"
+	"strings"
+
+	"github.com/aewens/nautical/cargo/model"
+)
+
+// fill loads the payload columns of schema into entities, a batch of ids at a
+// time, handing each value to assign.
+func fill(
+	ctx      context.Context,
+	store    model.Store,
+	schema   *Schema,
+	entities []model.Entity,
+	assign   func(model.Entity, string, []byte) error,
+) error {
+	selected := []string{schema.Table + ".id"}
+	for _, field := range schema.Payload {
+		selected = append(selected, schema.Expression(field))
+	}
+
+	for start := 0; start < len(entities); start = start + BatchSize {
+		end := start + BatchSize
+		if end > len(entities) {
+			end = len(entities)
+		}
+
+		owners := make(map[int64]model.Entity)
+		args := []interface{}{}
+		for _, entity := range entities[start:end] {
+			id, _ := entity.ExportMetadata()
+			owners[id] = entity
+			args = append(args, id)
+		}
+
+		marks := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+		statement := fmt.Sprintf(
+			"SELECT %s FROM %s WHERE %s.id IN (%s);",
+			strings.Join(selected, ", "),
+			schema.Table,
+			schema.Table,
+			marks,
+		)
+
+		err := func() error {
+			rows, err := store.QueryContext(ctx, statement, args...)
+			if err != nil {
+				return err
+			}
+
+			defer rows.Close()
+			for rows.Next() {
+				var id int64
+				values := make([][]byte, len(schema.Payload))
+				targets := []interface{}{&id}
+				for index := range values {
+					targets = append(targets, &values[index])
+				}
+
+				err = rows.Scan(targets...)
+				if err != nil {
+					return err
+				}
+
+				for index, field := range schema.Payload {
+					err = assign(owners[id], field, values[index])
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			return rows.Err()
+		}()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Fill loads the data that a Metadata query left out of entities.
+func (self *Internal) Fill(
+	ctx      context.Context,
+	entities ...model.Entity,
+) error {
+	return fill(ctx, self.Store, InternalSchema, entities,
+		func(entity model.Entity, field string, value []byte) error {
+			internal, ok := entity.(*model.Internal)
+			if !ok {
+				return fmt.Errorf("Cannot cast to Internal: %#v", entity)
+			}
+
+			internal.Data = value
+			return nil
+		},
+	)
+}
+
+// Fill loads the bodies that a Metadata query left out of entities.
+func (self *External) Fill(
+	ctx      context.Context,
+	entities ...model.Entity,
+) error {
+	return fill(ctx, self.Store, ExternalSchema, entities,
+		func(entity model.Entity, field string, value []byte) error {
+			external, ok := entity.(*model.External)
+			if !ok {
+				return fmt.Errorf("Cannot cast to External: %#v", entity)
+			}
+
+			external.Body = string(value)
+			return nil
+		},
+	)
+}
@@ -0,0 +1,527 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"database/sql"
+
+	"github.com/aewens/nautical/cargo/model"
+)
+
+// Revision holds the values a crate had before an update replaced them: they
+// were written at Updated and stood until Recorded.
+type Revision struct {
+	ID       int64
+	Crate    int64
+	Recorded time.Time
+	Updated  time.Time
+	Fields   []string
+	Entity   model.Entity
+}
+
+type Operation string
+
+const (
+	Keep   Operation = " "
+	Insert Operation = "+"
+	Remove Operation = "-"
+)
+
+type Change struct {
+	Operation Operation
+	Line      string
+}
+
+func (self Change) String() string {
+	return string(self.Operation) + " " + self.Line
+}
+
+// Diff compares two texts line by line, returning the changes that turn
+// before into after.
+func Diff(before string, after string) []Change {
+	left := strings.Split(before, "\n")
+	right := strings.Split(after, "\n")
+
+	// common[i][j] is the longest common subsequence of left[i:] and right[j:]
+	common := make([][]int, len(left)+1)
+	for i := range common {
+		common[i] = make([]int, len(right)+1)
+	}
+
+	for i := len(left) - 1; i >= 0; i-- {
+		for j := len(right) - 1; j >= 0; j-- {
+			if left[i] == right[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+
+	changes := []Change{}
+	i, j := 0, 0
+	for i < len(left) && j < len(right) {
+		switch {
+		case left[i] == right[j]:
+			changes = append(changes, Change{Keep, left[i]})
+			i, j = i+1, j+1
+		case common[i+1][j] >= common[i][j+1]:
+			changes = append(changes, Change{Remove, left[i]})
+			i = i + 1
+		default:
+			changes = append(changes, Change{Insert, right[j]})
+			j = j + 1
+		}
+	}
+
+	for ; i < len(left); i++ {
+		changes = append(changes, Change{Remove, left[i]})
+	}
+
+	for ; j < len(right); j++ {
+		changes = append(changes, Change{Insert, right[j]})
+	}
+
+	return changes
+}
+
+func fields(list string) []string {
+	if len(list) == 0 {
+		return []string{}
+	}
+
+	return strings.Split(list, ",")
+}
+
+func (self *Internal) revisions(
+	ctx     context.Context,
+	current *model.Internal,
+	clause  string,
+	args    ...interface{},
+) ([]*Revision, error) {
+	revisions := []*Revision{}
+	rows, err := self.Store.QueryContext(ctx, `
+		SELECT
+			id, recorded, updated, fields, flag, type, origin,
+			` + payload("internal_revision") + `
+		FROM internal_revision
+		WHERE internal_id = ? ` + clause + `;
+	`, append([]interface{}{current.ID}, args...)...)
+
+	if err != nil {
+		return revisions, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			revision Revision
+			changed  string
+			flag     uint8
+			itype    string
+			origin   string
+			data     []byte
+		)
+
+		err = rows.Scan(
+			&revision.ID,
+			&revision.Recorded,
+			&revision.Updated,
+			&changed,
+			&flag,
+			&itype,
+			&origin,
+			&data,
+		)
+
+		if err != nil {
+			return revisions, err
+		}
+
+		revision.Crate = current.ID
+		revision.Fields = fields(changed)
+		revision.Entity, err = self.Import(
+			current.ID,
+			current.UUID,
+			current.Added,
+			revision.Updated,
+			flag,
+			itype,
+			origin,
+			data,
+		)
+
+		if err != nil {
+			return revisions, err
+		}
+
+		revisions = append(revisions, &revision)
+	}
+
+	return revisions, rows.Err()
+}
+
+func (self *Internal) current(
+	ctx    context.Context,
+	entity model.Entity,
+) (*model.Internal, error) {
+	id, _ := entity.ExportMetadata()
+	current, err := self.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return current.(*model.Internal), nil
+}
+
+// Revisions lists the earlier versions of entity, oldest first.
+func (self *Internal) Revisions(
+	ctx    context.Context,
+	entity model.Entity,
+) ([]*Revision, error) {
+	current, err := self.current(ctx, entity)
+	if err != nil {
+		return nil, err
+	}
+
+	return self.revisions(ctx, current, "ORDER BY id")
+}
+
+// AsOf returns the crate as it stood at the given time, or sql.ErrNoRows if
+// it did not exist yet.
+func (self *Internal) AsOf(
+	ctx  context.Context,
+	id   int64,
+	when time.Time,
+) (model.Entity, error) {
+	entity, err := self.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	current := entity.(*model.Internal)
+	if when.Before(current.Added) {
+		return nil, sql.ErrNoRows
+	}
+
+	revisions, err := self.revisions(
+		ctx,
+		current,
+		"AND recorded > ? ORDER BY id LIMIT 1",
+		when,
+	)
+
+	if err != nil || len(revisions) == 0 {
+		return entity, err
+	}
+
+	return revisions[0].Entity, nil
+}
+
+// Revert writes the values of an earlier revision back over entity, which
+// records the values being replaced as a revision of their own.
+func (self *Internal) Revert(
+	ctx      context.Context,
+	entity   model.Entity,
+	revision int64,
+) error {
+	internal, ok := entity.(*model.Internal)
+	if !ok {
+		return fmt.Errorf("Cannot cast to Internal: %#v", entity)
+	}
+
+	current, err := self.current(ctx, entity)
+	if err != nil {
+		return err
+	}
+
+	revisions, err := self.revisions(ctx, current, "AND id = ?", revision)
+	if err != nil {
+		return err
+	}
+
+	if len(revisions) == 0 {
+		return fmt.Errorf("Invalid revision for %d: %d", internal.ID, revision)
+	}
+
+	previous := revisions[0].Entity.(*model.Internal)
+	revert := func(ctx context.Context, store model.Store) error {
+		updated := model.Now()
+		_, err := store.ExecContext(ctx, `
+			UPDATE internal
+			SET updated = ?, flag = ?, type = ?, origin = ?,
+				data = (SELECT data FROM internal_revision WHERE id = ?),
+				blob_id = (SELECT blob_id FROM internal_revision WHERE id = ?)
+			WHERE id = ?;
+		`,
+			updated,
+			previous.Flag,
+			previous.Type,
+			previous.Origin,
+			revision,
+			revision,
+			internal.ID,
+		)
+
+		if err != nil {
+			return err
+		}
+
+		internal.Updated = updated
+		internal.Flag = previous.Flag
+		internal.Type = previous.Type
+		internal.Origin = previous.Origin
+		internal.Data = previous.Data
+		return nil
+	}
+
+	return internal.Journal(ctx, "revert", nil, revert)
+}
+
+func (self *External) revisions(
+	ctx     context.Context,
+	current *model.External,
+	clause  string,
+	args    ...interface{},
+) ([]*Revision, error) {
+	revisions := []*Revision{}
+	rows, err := self.Store.QueryContext(ctx, `
+		SELECT
+			id, recorded, updated, fields, flag, type, name, cargo_text(body),
+			data
+		FROM external_revision
+		WHERE external_id = ? ` + clause + `;
+	`, append([]interface{}{current.ID}, args...)...)
+
+	if err != nil {
+		return revisions, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			revision Revision
+			changed  string
+			flag     uint8
+			etype    string
+			name     string
+			body     string
+			link     sql.NullInt64
+		)
+
+		err = rows.Scan(
+			&revision.ID,
+			&revision.Recorded,
+			&revision.Updated,
+			&changed,
+			&flag,
+			&etype,
+			&name,
+			&body,
+			&link,
+		)
+
+		if err != nil {
+			return revisions, err
+		}
+
+		revision.Crate = current.ID
+		revision.Fields = fields(changed)
+		revision.Entity, err = self.Import(
+			current.ID,
+			current.UUID,
+			current.Added,
+			revision.Updated,
+			flag,
+			etype,
+			name,
+			body,
+			link,
+		)
+
+		if err != nil {
+			return revisions, err
+		}
+
+		revisions = append(revisions, &revision)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return revisions, err
+	}
+
+	entities := []model.Entity{}
+	for _, revision := range revisions {
+		entities = append(entities, revision.Entity)
+	}
+
+	return revisions, self.links(ctx, entities)
+}
+
+func (self *External) current(
+	ctx    context.Context,
+	entity model.Entity,
+) (*model.External, error) {
+	id, _ := entity.ExportMetadata()
+	current, err := self.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return current.(*model.External), nil
+}
+
+// Revisions lists the earlier versions of entity, oldest first.
+func (self *External) Revisions(
+	ctx    context.Context,
+	entity model.Entity,
+) ([]*Revision, error) {
+	current, err := self.current(ctx, entity)
+	if err != nil {
+		return nil, err
+	}
+
+	return self.revisions(ctx, current, "ORDER BY id")
+}
+
+// AsOf returns the crate as it stood at the given time, or sql.ErrNoRows if
+// it did not exist yet.
+func (self *External) AsOf(
+	ctx  context.Context,
+	id   int64,
+	when time.Time,
+) (model.Entity, error) {
+	entity, err := self.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	current := entity.(*model.External)
+	if when.Before(current.Added) {
+		return nil, sql.ErrNoRows
+	}
+
+	revisions, err := self.revisions(
+		ctx,
+		current,
+		"AND recorded > ? ORDER BY id LIMIT 1",
+		when,
+	)
+
+	if err != nil || len(revisions) == 0 {
+		return entity, err
+	}
+
+	return revisions[0].Entity, nil
+}
+
+// Diff compares the body of entity at two revisions, where revision 0 stands
+// for the current body.
+func (self *External) Diff(
+	ctx    context.Context,
+	entity model.Entity,
+	from   int64,
+	to     int64,
+) ([]Change, error) {
+	current, err := self.current(ctx, entity)
+	if err != nil {
+		return nil, err
+	}
+
+	bodies := []string{}
+	for _, revision := range []int64{from, to} {
+		if revision == 0 {
+			bodies = append(bodies, current.Body)
+			continue
+		}
+
+		revisions, err := self.revisions(ctx, current, "AND id = ?", revision)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(revisions) == 0 {
+			return nil, fmt.Errorf(
+				"Invalid revision for %d: %d",
+				current.ID,
+				revision,
+			)
+		}
+
+		bodies = append(bodies, revisions[0].Entity.(*model.External).Body)
+	}
+
+	return Diff(bodies[0], bodies[1]), nil
+}
+
+// Revert writes the values of an earlier revision back over entity, which
+// records the values being replaced as a revision of their own.
+func (self *External) Revert(
+	ctx      context.Context,
+	entity   model.Entity,
+	revision int64,
+) error {
+	external, ok := entity.(*model.External)
+	if !ok {
+		return fmt.Errorf("Cannot cast to External: %#v", entity)
+	}
+
+	current, err := self.current(ctx, entity)
+	if err != nil {
+		return err
+	}
+
+	revisions, err := self.revisions(ctx, current, "AND id = ?", revision)
+	if err != nil {
+		return err
+	}
+
+	if len(revisions) == 0 {
+		return fmt.Errorf("Invalid revision for %d: %d", external.ID, revision)
+	}
+
+	previous := revisions[0].Entity.(*model.External)
+	var link sql.NullInt64
+	if previous.Meta != nil {
+		link = model.Nullable(previous.Meta.ID)
+	}
+
+	revert := func(ctx context.Context, store model.Store) error {
+		updated := model.Now()
+		_, err := store.ExecContext(ctx, `
+			UPDATE external
+			SET updated = ?, flag = ?, type = ?, name = ?,
+				body = (SELECT body FROM external_revision WHERE id = ?),
+				data = ?
+			WHERE id = ?;
+		`,
+			updated,
+			previous.Flag,
+			previous.Type,
+			previous.Name,
+			revision,
+			link,
+			external.ID,
+		)
+
+		if err != nil {
+			return err
+		}
+
+		external.Updated = updated
+		external.Flag = previous.Flag
+		external.Type = previous.Type
+		external.Name = previous.Name
+		external.Body = previous.Body
+		external.Meta = previous.Meta
+		external.Data = previous.Data
+		return nil
+	}
+
+	return external.Journal(ctx, "revert", nil, revert)
+}
@@ -0,0 +1,229 @@
+package repo
+
+import (
+	"fmt"
+	"context"
+	"strings"
+	"database/sql"
+
+	"github.com/aewens/nautical/cargo/model"
+)
+
+const BatchSize int = 256
+
+func mappings(
+	entity model.Entity,
+) (map[model.Key]int64, *[]model.Entity, error) {
+	switch crate := entity.(type) {
+	case *model.Internal:
+		return crate.Mapping, &crate.Tags, nil
+	case *model.External:
+		return crate.Mapping, &crate.Tags, nil
+	}
+
+	return nil, nil, fmt.Errorf("Cannot hydrate: %#v", entity)
+}
+
+// hydrate fills in Tags and Mapping for every entity with a single query
+// against the mapping table, replacing whatever they held before.
+func hydrate(
+	ctx      context.Context,
+	store    model.Store,
+	table    string,
+	entities []model.Entity,
+) error {
+	if len(entities) == 0 {
+		return nil
+	}
+
+	owners := make(map[int64]model.Entity)
+	args := []interface{}{}
+	for _, entity := range entities {
+		id, _ := entity.ExportMetadata()
+		mapping, tags, err := mappings(entity)
+		if err != nil {
+			return err
+		}
+
+		for key := range mapping {
+			delete(mapping, key)
+		}
+
+		*tags = []model.Entity{}
+		owners[id] = entity
+		args = append(args, id)
+	}
+
+	marks := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+	statement := fmt.Sprintf(`
+		SELECT
+			mapping.id, mapping.%s_id, mapping.internal_id,
+			mapping.external_id, mapping.tag_id,
+			tag.uuid, tag.added, tag.updated, tag.flag, tag.label,
+			tag.parent, tag.namespace, tag.value
+		FROM mapping
+		LEFT JOIN tag ON tag.id = mapping.tag_id
+		WHERE mapping.%s_id IN (%s)
+		AND NOT %s AND NOT %s AND NOT %s
+		ORDER BY mapping.id;
+	`, table, table, marks, trashed("internal"), trashed("external"),
+		trashed("tag"))
+
+	rows, err := store.QueryContext(ctx, statement, args...)
+	if err != nil {
+		return err
+	}
+
+	tags := NewTag(store)
+
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id       int64
+			owner    int64
+			internal sql.NullInt64
+			external sql.NullInt64
+			tag      sql.NullInt64
+			uuid     []byte
+			added    sql.NullTime
+			updated  sql.NullTime
+			flag     sql.NullInt64
+			label    sql.NullString
+			parent   sql.NullInt64
+			space    sql.NullString
+			value    sql.NullString
+		)
+
+		err = rows.Scan(
+			&id,
+			&owner,
+			&internal,
+			&external,
+			&tag,
+			&uuid,
+			&added,
+			&updated,
+			&flag,
+			&label,
+			&parent,
+			&space,
+			&value,
+		)
+
+		if err != nil {
+			return err
+		}
+
+		entity, ok := owners[owner]
+		if !ok {
+			continue
+		}
+
+		mapping, crateTags, err := mappings(entity)
+		if err != nil {
+			return err
+		}
+
+		key := model.Key{Mapper: "tag", ID: tag.Int64}
+		switch {
+		case table != "internal" && internal.Valid:
+			key = model.Key{Mapper: "internal", ID: internal.Int64}
+		case table != "external" && external.Valid:
+			key = model.Key{Mapper: "external", ID: external.Int64}
+		}
+
+		mapping[key] = id
+		if !tag.Valid {
+			continue
+		}
+
+		imported, err := tags.Import(
+			tag.Int64,
+			uuid,
+			added.Time,
+			updated.Time,
+			uint8(flag.Int64),
+			label.String,
+			parent,
+			space,
+			value,
+		)
+
+		if err != nil {
+			return err
+		}
+
+		*crateTags = append(*crateTags, imported)
+	}
+
+	return rows.Err()
+}
+
+// trashed matches mapping rows whose side in table is in the trash.
+func trashed(table string) string {
+	return fmt.Sprintf(
+		"EXISTS (SELECT 1 FROM trash WHERE trash.%s_id = mapping.%s_id)",
+		table,
+		table,
+	)
+}
+
+// relay forwards source to stream in batches, running fn over each batch of
+// entities before any of them are sent.
+func relay(
+	source *Stream,
+	stream *Stream,
+	size   int,
+	fn     func([]model.Entity) error,
+) {
+	batch := []Item{}
+	flush := func() bool {
+		entities := []model.Entity{}
+		for _, item := range batch {
+			entities = append(entities, item.Entity)
+		}
+
+		err := fn(entities)
+		if err != nil {
+			for _, entity := range entities {
+				id, mapper := entity.ExportMetadata()
+				failure := fmt.Errorf("Cannot hydrate %s %d: %s", mapper, id, err)
+				if !stream.Fail(failure) {
+					return false
+				}
+			}
+		} else {
+			for _, item := range batch {
+				if !stream.send(item) {
+					return false
+				}
+			}
+		}
+
+		batch = []Item{}
+		return true
+	}
+
+	open := true
+	for item := range source.Items {
+		if !open {
+			continue
+		}
+
+		if item.Err != nil {
+			open = stream.Fail(item.Err)
+			continue
+		}
+
+		batch = append(batch, item)
+		if len(batch) >= size {
+			open = flush()
+		}
+	}
+
+	if open && len(batch) > 0 {
+		flush()
+	}
+
+	stream.Close(source.Err())
+}
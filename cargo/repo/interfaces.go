@@ -1,26 +1,53 @@
 package repo
 
 import (
+	"context"
 	"time"
 
 	"github.com/aewens/nautical/cargo/model"
 )
 
-type Stream chan model.Entity
-
 type Reader interface {
-	All() Stream
-	Get(int64) (model.Entity, error)
-	Lookup(...int64) Stream
-	Contains(string, string) Stream
-	Equals(string, string) Stream
-	Before(string, time.Time) Stream
-	After(string, time.Time) Stream
-	Between(string, time.Time, time.Time) Stream
+	All(context.Context) *Stream
+	Get(context.Context, int64) (model.Entity, error)
+	Lookup(context.Context, ...int64) *Stream
+	GetByUUID(context.Context, []byte) (model.Entity, error)
+	LookupUUIDs(context.Context, ...[]byte) *Stream
+	Contains(context.Context, string, string) *Stream
+	Equals(context.Context, string, string) *Stream
+	Before(context.Context, string, time.Time) *Stream
+	After(context.Context, string, time.Time) *Stream
+	Between(context.Context, string, time.Time, time.Time) *Stream
+	Find(context.Context, *Query) *Stream
+	Paginate(context.Context, *Query, string, int) (*Page, error)
+	Related(context.Context, model.Entity) *Stream
+	Trash(context.Context) *Stream
+}
+
+// Batcher writes many entities in one transaction, reporting the ones that
+// failed in BatchErrors.
+type Batcher interface {
+	SaveAll(context.Context, ...model.Entity) error
+	UpdateAll(context.Context, ...model.Entity) error
+	UpsertAll(context.Context, ...model.Entity) error
+	DeleteAll(context.Context, ...model.Entity) error
+	MapAll(context.Context, model.Entity, ...model.Entity) error
 }
 
 type Entity interface {
 	Reader
+	Batcher
+	Schema() *Schema
 	Create() (model.Entity, error)
-	Load(Stream)
+	Load(*Stream) error
+}
+
+// Filler is implemented by repos whose schema has payload columns, loading
+// them into crates read with a Metadata query.
+type Filler interface {
+	Fill(context.Context, ...model.Entity) error
+}
+
+type Tagger interface {
+	Tagged(context.Context, string) *Stream
 }
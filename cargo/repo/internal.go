@@ -1,6 +1,7 @@
 package repo
 
 import (
+	"context"
 	"fmt"
 	"time"
 	"database/sql"
@@ -9,11 +10,11 @@ import (
 )
 
 type Internal struct {
-	Store  *sql.DB
+	Store  model.Store
 	Crates map[int64]*model.Internal
 }
 
-func NewInternal(store *sql.DB) *Internal {
+func NewInternal(store model.Store) *Internal {
 	return &Internal{
 		Store:  store,
 		Crates: make(map[int64]*model.Internal),
@@ -24,15 +25,25 @@ func (self *Internal) Create() (model.Entity, error) {
 	return model.NewInternal(self.Store)
 }
 
-func (self *Internal) Load(stream Stream) {
-	for entity := range stream {
-		internal, ok := entity.(*model.Internal)
+func (self *Internal) Schema() *Schema {
+	return InternalSchema
+}
+
+func (self *Internal) Load(stream *Stream) error {
+	for item := range stream.Items {
+		if item.Err != nil {
+			continue
+		}
+
+		internal, ok := item.Entity.(*model.Internal)
 		if !ok {
 			continue
 		}
 
 		self.Crates[internal.ID] = internal
 	}
+
+	return stream.Err()
 }
 
 func (self *Internal) Import(
@@ -67,11 +78,28 @@ func (self *Internal) Import(
 	return entity, nil
 }
 
-func (self *Internal) Get(id int64) (model.Entity, error) {
-	statement, err := self.Store.Prepare(`
-		SELECT uuid, added, updated, flag, type, origin, data
-		FROM internal WHERE id = ?;
-	`)
+func (self *Internal) Get(ctx context.Context, id int64) (model.Entity, error) {
+	return self.get(ctx, id, InternalSchema.Expression("data"))
+}
+
+// Metadata is Get without the data, which stays in storage until read with
+// the crate's Open or CopyTo.
+func (self *Internal) Metadata(
+	ctx context.Context,
+	id  int64,
+) (model.Entity, error) {
+	return self.get(ctx, id, "NULL")
+}
+
+func (self *Internal) get(
+	ctx  context.Context,
+	id   int64,
+	data string,
+) (model.Entity, error) {
+	statement, err := self.Store.PrepareContext(ctx, fmt.Sprintf(`
+		SELECT uuid, added, updated, flag, type, origin, %s
+		FROM internal WHERE id = ? AND NOT %s;
+	`, data, trash("internal")))
 
 	if err != nil {
 		return nil, err
@@ -84,18 +112,18 @@ func (self *Internal) Get(id int64) (model.Entity, error) {
 		flag    uint8
 		itype   string
 		origin  string
-		data    []byte
+		payload []byte
 	)
 
 	defer statement.Close()
-	err = statement.QueryRow(id).Scan(
+	err = statement.QueryRowContext(ctx, id).Scan(
 		&uuid,
 		&added,
 		&updated,
 		&flag,
 		&itype,
 		&origin,
-		&data,
+		&payload,
 	)
 
 	if err != nil {
@@ -110,25 +138,50 @@ func (self *Internal) Get(id int64) (model.Entity, error) {
 		flag,
 		itype,
 		origin,
-		data,
+		payload,
 	)
 }
 
-func (self *Internal) Process(stream Stream, rows *sql.Rows) {
+func (self *Internal) GetByUUID(
+	ctx  context.Context,
+	uuid []byte,
+) (model.Entity, error) {
+	return first(self.Find(ctx, NewQuery().Where(Eq("uuid", uuid))))
+}
+
+// LookupHash streams the crates whose data has the given hash, as Hash
+// computes it.
+func (self *Internal) LookupHash(ctx context.Context, hash []byte) *Stream {
+	return self.Find(ctx, NewQuery().Where(Eq("hash", hash)))
+}
+
+func (self *Internal) LookupUUIDs(ctx context.Context, uuids ...[]byte) *Stream {
+	values := []interface{}{}
+	for _, uuid := range uuids {
+		values = append(values, uuid)
+	}
+
+	return self.Find(ctx, NewQuery().Where(In("uuid", values...)))
+}
+
+func (self *Internal) Process(stream *Stream, rows *sql.Rows) {
 	defer rows.Close()
 	for rows.Next() {
 		var (
-			id      int64
-			uuid    []byte
-			added   time.Time
-			updated time.Time
-			flag    uint8
-			itype   string
-			origin  string
-			data    []byte
+			id       int64
+			uuid     []byte
+			added    time.Time
+			updated  time.Time
+			flag     uint8
+			itype    string
+			origin   string
+			data     []byte
+			position string
 		)
 
-		err := rows.Scan(
+		err := rows.Scan(positioned(
+			rows,
+			&position,
 			&id,
 			&uuid,
 			&added,
@@ -137,9 +190,13 @@ func (self *Internal) Process(stream Stream, rows *sql.Rows) {
 			&itype,
 			&origin,
 			&data,
-		)
+		)...)
 
 		if err != nil {
+			if !stream.Fail(err) {
+				break
+			}
+
 			continue
 		}
 
@@ -155,181 +212,162 @@ func (self *Internal) Process(stream Stream, rows *sql.Rows) {
 		)
 
 		if err != nil {
+			if !stream.Fail(err) {
+				break
+			}
+
 			continue
 		}
 
-		stream <- entity
+		if !stream.mark(entity, position) {
+			break
+		}
 	}
 
-	close(stream)
+	stream.Close(rows.Err())
 }
 
-func (self *Internal) All() Stream {
-	stream := make(Stream)
-
-	go func() {
-		rows, err := self.Store.Query(`
-			SELECT id, uuid, added, updated, flag, type, origin, data
-			FROM internal;
-		`)
-
-		if err != nil {
-			return
-		}
-
-		self.Process(stream, rows)
-	}()
+func (self *Internal) All(ctx context.Context) *Stream {
+	return self.Find(ctx, NewQuery())
+}
 
-	return stream
+// Trash streams the crates that were soft deleted and not yet purged.
+func (self *Internal) Trash(ctx context.Context) *Stream {
+	return self.Find(ctx, NewQuery().InTrash())
 }
 
-func (self *Internal) Lookup(ids ...int64) Stream {
-	stream := make(Stream)
+func (self *Internal) Lookup(ctx context.Context, ids ...int64) *Stream {
+	stream := NewStream(ctx)
+	ctx = stream.Context()
 
 	go func() {
 		for _, id := range ids {
-			entity, err := self.Get(id)
-			if err == nil {
-				stream <- entity
+			entity, err := self.Get(ctx, id)
+			if err != nil {
+				if !stream.Fail(err) {
+					break
+				}
+
+				continue
+			}
+
+			if !stream.Send(entity) {
+				break
 			}
 		}
 
-		close(stream)
+		stream.Close(nil)
 	}()
 
 	return stream
 }
 
-func (self *Internal) Contains(field string, search string) Stream {
-	stream := make(Stream)
-
-	go func() {
-		statement, err := self.Store.Prepare(fmt.Sprintf(`
-			SELECT id, uuid, added, updated, flag, type, origin, data
-			FROM internal WHERE %s LIKE ?;
-		`, field))
-
-		if err != nil {
-			return
-		}
-
-		defer statement.Close()
-		rows, err := statement.Query("%" + search + "%")
-
-		if err != nil {
-			return
-		}
-
-		self.Process(stream, rows)
-	}()
-
-	return stream
+func (self *Internal) Contains(
+	ctx    context.Context,
+	field  string,
+	search string,
+) *Stream {
+	return self.Find(ctx, NewQuery().Where(Like(field, search)))
 }
 
-func (self *Internal) Equals(field string, search string) Stream {
-	stream := make(Stream)
+func (self *Internal) Equals(
+	ctx    context.Context,
+	field  string,
+	search string,
+) *Stream {
+	return self.Find(ctx, NewQuery().Where(Eq(field, search)))
+}
 
-	go func() {
-		statement, err := self.Store.Prepare(fmt.Sprintf(`
-			SELECT id, uuid, added, updated, flag, type, origin, data
-			FROM internal WHERE %s = ?;
-		`, field))
+func (self *Internal) Before(
+	ctx    context.Context,
+	field  string,
+	search time.Time,
+) *Stream {
+	return self.Find(ctx, NewQuery().Where(Lt(field, search)))
+}
 
-		if err != nil {
-			return
-		}
+func (self *Internal) After(
+	ctx    context.Context,
+	field  string,
+	search time.Time,
+) *Stream {
+	return self.Find(ctx, NewQuery().Where(Gt(field, search)))
+}
 
-		defer statement.Close()
-		rows, err := statement.Query(search)
+func (self *Internal) Between(
+	ctx    context.Context,
+	field  string,
+	before time.Time,
+	after  time.Time,
+) *Stream {
+	return self.Find(ctx, NewQuery().Where(And(
+		Gt(field, before),
+		Lt(field, after),
+	)))
+}
 
-		if err != nil {
-			return
-		}
+func (self *Internal) Tagged(ctx context.Context, expr string) *Stream {
+	predicate, err := ParseTags(expr)
+	if err != nil {
+		return Failed(ctx, err)
+	}
 
-		self.Process(stream, rows)
-	}()
+	return self.Find(ctx, NewQuery().Where(predicate))
+}
 
-	return stream
+// Related streams the crates that share a mapping row with entity.
+func (self *Internal) Related(
+	ctx    context.Context,
+	entity model.Entity,
+) *Stream {
+	return self.Find(ctx, NewQuery().Where(MappedTo(entity)))
 }
 
-func (self *Internal) Before(field string, search time.Time) Stream {
-	stream := make(Stream)
+func (self *Internal) Find(ctx context.Context, query *Query) *Stream {
+	stream := NewStream(ctx)
+	ctx = stream.Context()
 
 	go func() {
-		statement, err := self.Store.Prepare(fmt.Sprintf(`
-			SELECT id, uuid, added, updated, flag, type, origin, data
-			FROM internal WHERE %s < ?;
-		`, field))
+		statement, args, err := query.Build(self.Schema())
 
 		if err != nil {
+			stream.Close(err)
 			return
 		}
 
-		defer statement.Close()
-		rows, err := statement.Query(search)
-
-		if err != nil {
-			return
-		}
-
-		self.Process(stream, rows)
-	}()
-
-	return stream
-}
-
-func (self *Internal) After(field string, search time.Time) Stream {
-	stream := make(Stream)
-
-	go func() {
-		statement, err := self.Store.Prepare(fmt.Sprintf(`
-			SELECT id, uuid, added, updated, flag, type, origin, data
-			FROM internal WHERE %s > ?;
-		`, field))
-
+		rows, err := self.Store.QueryContext(ctx, statement, args...)
 		if err != nil {
+			stream.Close(err)
 			return
 		}
 
-		defer statement.Close()
-		rows, err := statement.Query(search)
-
-		if err != nil {
+		if !query.Hydrate {
+			self.Process(stream, rows)
 			return
 		}
 
-		self.Process(stream, rows)
+		source := NewStream(ctx)
+		go self.Process(source, rows)
+		relay(source, stream, BatchSize, func(entities []model.Entity) error {
+			return self.Hydrate(ctx, entities...)
+		})
 	}()
 
 	return stream
 }
 
-func (self *Internal) Between(
-	field string,
-	before time.Time,
-	after time.Time,
-) Stream {
-	stream := make(Stream)
-
-	go func() {
-		statement, err := self.Store.Prepare(fmt.Sprintf(`
-			SELECT id, uuid, added, updated, flag, type, origin, data
-			FROM internal WHERE %s > ? AND %s < ?;
-		`, field, field))
-
-		if err != nil {
-			return
-		}
-
-		defer statement.Close()
-		rows, err := statement.Query(before, after)
-
-		if err != nil {
-			return
-		}
-
-		self.Process(stream, rows)
-	}()
+func (self *Internal) Hydrate(
+	ctx      context.Context,
+	entities ...model.Entity,
+) error {
+	return hydrate(ctx, self.Store, "internal", entities)
+}
 
-	return stream
+func (self *Internal) Paginate(
+	ctx   context.Context,
+	query *Query,
+	token string,
+	size  int,
+) (*Page, error) {
+	return paginate(ctx, self, query, token, size)
 }
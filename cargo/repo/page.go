@@ -0,0 +1,180 @@
+package repo
+
+import (
+	"fmt"
+	"context"
+	"encoding/json"
+	"encoding/base64"
+
+	"github.com/aewens/nautical/cargo/model"
+)
+
+type Page struct {
+	Entities []model.Entity `json:"-"`
+	Next     string         `json:"next"`
+}
+
+type Cursor struct {
+	Added     string    `json:"a"`
+	ID        int64     `json:"i"`
+	Direction Direction `json:"d"`
+}
+
+type Keyset struct {
+	Cursor *Cursor
+}
+
+func (self *Cursor) Encode() (string, error) {
+	data, err := json.Marshal(self)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func DecodeCursor(token string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cursor: %s", token)
+	}
+
+	var cursor Cursor
+	err = json.Unmarshal(data, &cursor)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cursor: %s", token)
+	}
+
+	return &cursor, nil
+}
+
+// Rows are compared against the raw text of added so the cursor matches the
+// stored value exactly rather than a reformatted time.Time.
+func (self *Keyset) render(schema *Schema) (string, []interface{}, error) {
+	operator := ">"
+	if self.Cursor.Direction == Descending {
+		operator = "<"
+	}
+
+	clause := fmt.Sprintf(
+		"(%s.added, %s.id) %s (?, ?)",
+		schema.Table,
+		schema.Table,
+		operator,
+	)
+
+	return clause, []interface{}{self.Cursor.Added, self.Cursor.ID}, nil
+}
+
+type pager interface {
+	Schema() *Schema
+	Find(context.Context, *Query) *Stream
+}
+
+func direction(query *Query) (Direction, error) {
+	if len(query.Orders) == 0 {
+		return Ascending, nil
+	}
+
+	order := query.Orders[0]
+	if len(query.Orders) > 1 || order.Field != "added" {
+		return "", fmt.Errorf("Pages can only be ordered by added")
+	}
+
+	if order.Direction == Descending {
+		return Descending, nil
+	}
+
+	return Ascending, nil
+}
+
+// Pages are ordered by added and then id, which stays stable when rows are
+// inserted between requests. The query's own limit and offset are ignored.
+// The cursor comes from the raw added of the last row the page query read, so
+// it holds even if that row is deleted before the next request.
+func paginate(
+	ctx    context.Context,
+	source pager,
+	query  *Query,
+	token  string,
+	size   int,
+) (*Page, error) {
+	page := &Page{
+		Entities: []model.Entity{},
+	}
+
+	if size <= 0 {
+		return page, fmt.Errorf("Invalid page size: %d", size)
+	}
+
+	if query == nil {
+		query = NewQuery()
+	}
+
+	order, err := direction(query)
+	if err != nil {
+		return page, err
+	}
+
+	keyed := &Query{
+		Predicate: query.Predicate,
+		Orders:    []Order{{"added", order}, {"id", order}},
+		Count:     size + 1,
+		Hydrate:   query.Hydrate,
+		Lazy:      query.Lazy,
+		Scope:     query.Scope,
+		keyed:     true,
+	}
+
+	if len(token) > 0 {
+		cursor, err := DecodeCursor(token)
+		if err != nil {
+			return page, err
+		}
+
+		if cursor.Direction != order {
+			return page, fmt.Errorf("Cursor does not match order: %s", order)
+		}
+
+		keyed.Where(&Keyset{cursor})
+	}
+
+	stream := source.Find(ctx, keyed)
+	positions := []string{}
+	errs := []error{}
+
+	for item := range stream.Items {
+		if item.Err != nil {
+			errs = append(errs, item.Err)
+			continue
+		}
+
+		page.Entities = append(page.Entities, item.Entity)
+		positions = append(positions, item.position)
+	}
+
+	err = stream.Err()
+	if err == nil && len(errs) > 0 {
+		err = &RowErrors{Errors: errs}
+	}
+
+	if len(page.Entities) > size {
+		page.Entities = page.Entities[:size]
+
+		id, _ := page.Entities[size-1].ExportMetadata()
+		cursor := &Cursor{
+			Added:     positions[size-1],
+			ID:        id,
+			Direction: order,
+		}
+
+		next, failure := cursor.Encode()
+		if failure != nil {
+			return page, failure
+		}
+
+		page.Next = next
+	}
+
+	return page, err
+}
@@ -0,0 +1,462 @@
+package repo
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aewens/nautical/cargo/model"
+)
+
+type Direction string
+
+const (
+	Ascending  Direction = "ASC"
+	Descending Direction = "DESC"
+)
+
+// Scope picks which side of the trash a query reads from.
+type Scope int
+
+const (
+	Live Scope = iota
+	Trashed
+	Everything
+)
+
+type Predicate interface {
+	render(schema *Schema) (string, []interface{}, error)
+}
+
+type Condition struct {
+	Field    string
+	Operator string
+	Values   []interface{}
+}
+
+type Group struct {
+	Operator   string
+	Predicates []Predicate
+}
+
+type Negation struct {
+	Predicate Predicate
+}
+
+type Membership struct {
+	Label string
+}
+
+type Lineage struct {
+	Path string
+}
+
+type Qualifier struct {
+	Predicate Predicate
+}
+
+type Relation struct {
+	Mapper string
+	ID     int64
+}
+
+type Order struct {
+	Field     string
+	Direction Direction
+}
+
+type Query struct {
+	Predicate Predicate
+	Orders    []Order
+	Count     int
+	Skip      int
+	Hydrate   bool
+	Lazy      bool
+	Scope     Scope
+	// keyed queries also select the raw text of added for page cursors.
+	keyed     bool
+}
+
+func Eq(field string, value interface{}) Predicate {
+	return &Condition{field, "=", []interface{}{value}}
+}
+
+func Ne(field string, value interface{}) Predicate {
+	return &Condition{field, "!=", []interface{}{value}}
+}
+
+func Lt(field string, value interface{}) Predicate {
+	return &Condition{field, "<", []interface{}{value}}
+}
+
+func Lte(field string, value interface{}) Predicate {
+	return &Condition{field, "<=", []interface{}{value}}
+}
+
+func Gt(field string, value interface{}) Predicate {
+	return &Condition{field, ">", []interface{}{value}}
+}
+
+func Gte(field string, value interface{}) Predicate {
+	return &Condition{field, ">=", []interface{}{value}}
+}
+
+func Like(field string, search string) Predicate {
+	return &Condition{field, "LIKE", []interface{}{"%" + search + "%"}}
+}
+
+func In(field string, values ...interface{}) Predicate {
+	return &Condition{field, "IN", values}
+}
+
+func And(predicates ...Predicate) Predicate {
+	return &Group{"AND", predicates}
+}
+
+func Or(predicates ...Predicate) Predicate {
+	return &Group{"OR", predicates}
+}
+
+func Not(predicate Predicate) Predicate {
+	return &Negation{predicate}
+}
+
+func HasTag(label string) Predicate {
+	return &Membership{label}
+}
+
+// Under matches the tag at path and all of its descendants; on crate repos it
+// matches crates carrying any of those tags.
+func Under(path string) Predicate {
+	return &Lineage{strings.TrimSuffix(path, "/")}
+}
+
+// WithTag matches tags satisfying predicate; on crate repos it matches crates
+// carrying at least one such tag.
+func WithTag(predicate Predicate) Predicate {
+	return &Qualifier{predicate}
+}
+
+func InNamespace(namespace string) Predicate {
+	return WithTag(Eq("namespace", namespace))
+}
+
+func HasValue(namespace string, value string) Predicate {
+	return WithTag(And(Eq("namespace", namespace), Eq("value", value)))
+}
+
+// Within matches namespaced tags whose numeric value lies between min and max
+// inclusive; non-numeric values never match.
+func Within(namespace string, min float64, max float64) Predicate {
+	return WithTag(And(
+		Eq("namespace", namespace),
+		Gte("number", min),
+		Lte("number", max),
+	))
+}
+
+func MappedTo(entity model.Entity) Predicate {
+	id, mapper := entity.ExportMetadata()
+	return &Relation{mapper, id}
+}
+
+// operators are the only ones rendered into SQL, as Operator is written into
+// the statement as it is.
+var operators map[string]bool = map[string]bool{
+	"=":    true,
+	"!=":   true,
+	"<":    true,
+	"<=":   true,
+	">":    true,
+	">=":   true,
+	"LIKE": true,
+	"IN":   true,
+}
+
+func (self *Condition) render(schema *Schema) (string, []interface{}, error) {
+	if !operators[self.Operator] {
+		return "", nil, &OperatorError{self.Operator}
+	}
+
+	var err error
+	switch {
+	case self.Operator == "LIKE":
+		err = schema.Check(self.Field, Text, Blob)
+	case isTime(self.Values):
+		err = schema.Check(self.Field, Time)
+	default:
+		err = schema.Check(self.Field)
+	}
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	field := schema.Expression(self.Field)
+	if self.Operator != "IN" {
+		clause := fmt.Sprintf("%s %s ?", field, self.Operator)
+		return clause, self.Values, nil
+	}
+
+	if len(self.Values) == 0 {
+		return "0", nil, nil
+	}
+
+	marks := strings.TrimSuffix(strings.Repeat("?, ", len(self.Values)), ", ")
+	clause := fmt.Sprintf("%s IN (%s)", field, marks)
+	return clause, self.Values, nil
+}
+
+func (self *Group) render(schema *Schema) (string, []interface{}, error) {
+	if self.Operator != "AND" && self.Operator != "OR" {
+		return "", nil, &OperatorError{self.Operator}
+	}
+
+	if len(self.Predicates) == 0 {
+		if self.Operator == "OR" {
+			return "0", nil, nil
+		}
+
+		return "1", nil, nil
+	}
+
+	clauses := []string{}
+	args := []interface{}{}
+	for _, predicate := range self.Predicates {
+		clause, values, err := predicate.render(schema)
+		if err != nil {
+			return "", nil, err
+		}
+
+		clauses = append(clauses, clause)
+		args = append(args, values...)
+	}
+
+	separator := fmt.Sprintf(" %s ", self.Operator)
+	return "(" + strings.Join(clauses, separator) + ")", args, nil
+}
+
+func (self *Negation) render(schema *Schema) (string, []interface{}, error) {
+	clause, args, err := self.Predicate.render(schema)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return "NOT (" + clause + ")", args, nil
+}
+
+func (self *Membership) render(schema *Schema) (string, []interface{}, error) {
+	table := schema.Table
+	if table == "tag" {
+		return "", nil, fmt.Errorf("Cannot filter %s by tag", table)
+	}
+
+	clause := fmt.Sprintf(`%s.id IN (
+		SELECT mapping.%s_id FROM mapping
+		JOIN tag ON tag.id = mapping.tag_id
+		WHERE (tag.label = ? OR tag.id IN (
+			SELECT tag_alias.tag_id FROM tag_alias WHERE tag_alias.alias = ?
+		))
+		AND NOT %s
+	)`, table, table, trash("tag"))
+
+	return clause, []interface{}{self.Label, self.Label}, nil
+}
+
+func (self *Lineage) render(schema *Schema) (string, []interface{}, error) {
+	prefix := self.Path + "/"
+	args := []interface{}{self.Path, utf8.RuneCountInString(prefix), prefix}
+
+	if schema.Table == "tag" {
+		clause := "(tag.label = ? OR substr(tag.label, 1, ?) = ?)"
+		return clause, args, nil
+	}
+
+	clause := fmt.Sprintf(`%s.id IN (
+		SELECT mapping.%s_id FROM mapping
+		JOIN tag ON tag.id = mapping.tag_id
+		WHERE (tag.label = ? OR substr(tag.label, 1, ?) = ?)
+		AND NOT %s
+	)`, schema.Table, schema.Table, trash("tag"))
+
+	return clause, args, nil
+}
+
+func (self *Qualifier) render(schema *Schema) (string, []interface{}, error) {
+	clause, args, err := self.Predicate.render(TagSchema)
+	if err != nil || schema.Table == "tag" {
+		return clause, args, err
+	}
+
+	clause = fmt.Sprintf(`%s.id IN (
+		SELECT mapping.%s_id FROM mapping
+		JOIN tag ON tag.id = mapping.tag_id
+		WHERE %s AND NOT %s
+	)`, schema.Table, schema.Table, clause, trash("tag"))
+
+	return clause, args, nil
+}
+
+func (self *Relation) render(schema *Schema) (string, []interface{}, error) {
+	table := schema.Table
+	switch self.Mapper {
+	case "internal", "external", "tag":
+	default:
+		return "", nil, fmt.Errorf("Invalid mapper: %s", self.Mapper)
+	}
+
+	if self.Mapper == table {
+		return "", nil, fmt.Errorf("Cannot relate %s to %s", table, self.Mapper)
+	}
+
+	clause := fmt.Sprintf(`%s.id IN (
+		SELECT mapping.%s_id FROM mapping
+		WHERE mapping.%s_id = ? AND mapping.%s_id IS NOT NULL
+	)`, table, table, self.Mapper, table)
+
+	return clause, []interface{}{self.ID}, nil
+}
+
+// trash is a clause matching the rows of table that are in the trash.
+func trash(table string) string {
+	return fmt.Sprintf(
+		"%s.id IN (SELECT trash.%s_id FROM trash WHERE trash.%s_id IS NOT NULL)",
+		table,
+		table,
+		table,
+	)
+}
+
+func NewQuery() *Query {
+	return &Query{}
+}
+
+func (self *Query) Where(predicate Predicate) *Query {
+	if self.Predicate != nil {
+		predicate = And(self.Predicate, predicate)
+	}
+
+	self.Predicate = predicate
+	return self
+}
+
+func (self *Query) OrderBy(field string, direction Direction) *Query {
+	self.Orders = append(self.Orders, Order{field, direction})
+	return self
+}
+
+func (self *Query) Limit(count int) *Query {
+	self.Count = count
+	return self
+}
+
+func (self *Query) Offset(skip int) *Query {
+	self.Skip = skip
+	return self
+}
+
+// Eager asks for the Tags and Mapping of each crate to be loaded from the
+// mapping table, one batch of rows at a time.
+func (self *Query) Eager() *Query {
+	self.Hydrate = true
+	return self
+}
+
+// Metadata leaves the payload columns of the schema, such as internal data and
+// external bodies, out of the results. Fill loads them later when needed.
+func (self *Query) Metadata() *Query {
+	self.Lazy = true
+	return self
+}
+
+func (self *Query) InTrash() *Query {
+	self.Scope = Trashed
+	return self
+}
+
+func (self *Query) WithTrash() *Query {
+	self.Scope = Everything
+	return self
+}
+
+func (self *Query) Build(schema *Schema) (string, []interface{}, error) {
+	args := []interface{}{}
+	table := schema.Table
+
+	selected := []string{}
+	for _, column := range schema.Columns {
+		if self.Lazy && schema.Deferred(column.Name) {
+			selected = append(selected, column.Kind.Zero())
+			continue
+		}
+
+		selected = append(selected, schema.Expression(column.Name))
+	}
+
+	if self.keyed {
+		selected = append(selected, fmt.Sprintf("CAST(%s.added AS TEXT)", table))
+	}
+
+	statement := fmt.Sprintf(
+		"SELECT %s FROM %s",
+		strings.Join(selected, ", "),
+		table,
+	)
+
+	clauses := []string{}
+	switch self.Scope {
+	case Live:
+		clauses = append(clauses, "NOT " + trash(table))
+	case Trashed:
+		clauses = append(clauses, trash(table))
+	}
+
+	if self.Predicate != nil {
+		clause, values, err := self.Predicate.render(schema)
+		if err != nil {
+			return "", nil, err
+		}
+
+		clauses = append(clauses, clause)
+		args = append(args, values...)
+	}
+
+	if len(clauses) > 0 {
+		statement = statement + " WHERE " + strings.Join(clauses, " AND ")
+	}
+
+	if len(self.Orders) > 0 {
+		orders := []string{}
+		for _, order := range self.Orders {
+			err := schema.Check(order.Field)
+			if err != nil {
+				return "", nil, err
+			}
+
+			direction := order.Direction
+			if direction != Descending {
+				direction = Ascending
+			}
+
+			orders = append(orders, fmt.Sprintf(
+				"%s %s",
+				schema.Expression(order.Field),
+				direction,
+			))
+		}
+
+		statement = statement + " ORDER BY " + strings.Join(orders, ", ")
+	}
+
+	if self.Count > 0 || self.Skip > 0 {
+		count := self.Count
+		if count <= 0 {
+			count = -1
+		}
+
+		statement = statement + " LIMIT ? OFFSET ?"
+		args = append(args, count, self.Skip)
+	}
+
+	return statement + ";", args, nil
+}
@@ -0,0 +1,187 @@
+package repo
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aewens/nautical/cargo/model"
+)
+
+type Kind string
+
+const (
+	Integer Kind = "integer"
+	Text    Kind = "text"
+	Blob    Kind = "blob"
+	Time    Kind = "time"
+	Real    Kind = "real"
+)
+
+// Zero is the SQL selected in place of a column of this kind that is left out,
+// which scans into the zero value of its Go type.
+func (self Kind) Zero() string {
+	switch self {
+	case Text:
+		return "''"
+	case Integer, Real:
+		return "0"
+	}
+
+	return "NULL"
+}
+
+type Column struct {
+	Name string `json:"name"`
+	Kind Kind   `json:"kind"`
+}
+
+// Hidden columns can be filtered and ordered on but are not loaded, Payload
+// columns are the ones Metadata queries leave out, and Expressions stand in
+// for columns whose value is not stored in the table itself.
+type Schema struct {
+	Table       string            `json:"table"`
+	Columns     []Column          `json:"columns"`
+	Hidden      []Column          `json:"hidden,omitempty"`
+	Payload     []string          `json:"payload,omitempty"`
+	Expressions map[string]string `json:"-"`
+}
+
+var InternalSchema *Schema = &Schema{
+	Table: "internal",
+	Columns: []Column{
+		{"id", Integer},
+		{"uuid", Blob},
+		{"added", Time},
+		{"updated", Time},
+		{"flag", Integer},
+		{"type", Text},
+		{"origin", Text},
+		{"data", Blob},
+	},
+	Hidden: []Column{
+		{"hash", Blob},
+	},
+	Payload: []string{"data"},
+	Expressions: map[string]string{
+		"data": payload("internal"),
+		"hash": model.Hashed,
+	},
+}
+
+var ExternalSchema *Schema = &Schema{
+	Table: "external",
+	Columns: []Column{
+		{"id", Integer},
+		{"uuid", Blob},
+		{"added", Time},
+		{"updated", Time},
+		{"flag", Integer},
+		{"type", Text},
+		{"name", Text},
+		{"body", Text},
+		{"data", Integer},
+	},
+	Payload: []string{"body"},
+	Expressions: map[string]string{
+		"body": `cargo_text(external.body)`,
+	},
+}
+
+var TagSchema *Schema = &Schema{
+	Table: "tag",
+	Columns: []Column{
+		{"id", Integer},
+		{"uuid", Blob},
+		{"added", Time},
+		{"updated", Time},
+		{"flag", Integer},
+		{"label", Text},
+		{"parent", Integer},
+		{"namespace", Text},
+		{"value", Text},
+		{"number", Real},
+	},
+}
+
+// payload reads the data of a row in table, internal or internal_revision, from
+// wherever it is kept: in chunks, a whole blob or inline.
+func payload(table string) string {
+	return fmt.Sprintf(`COALESCE(
+		(SELECT cargo_join(
+			blob_chunk.blob_id, blob_chunk.seq, blob_chunk.codec, blob_chunk.data
+		)
+		FROM blob_chunk WHERE blob_chunk.blob_id = %[1]s.blob_id),
+		(SELECT cargo_blob(blob.hash, blob.codec, blob.data) FROM blob
+		WHERE blob.id = %[1]s.blob_id),
+		%[1]s.data
+	)`, table)
+}
+
+func (self *Schema) Deferred(field string) bool {
+	for _, name := range self.Payload {
+		if name == field {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (self *Schema) Names() []string {
+	names := []string{}
+	for _, column := range self.Columns {
+		names = append(names, column.Name)
+	}
+
+	return names
+}
+
+// Expression is the SQL that reads field, qualified by the table.
+func (self *Schema) Expression(field string) string {
+	expression, ok := self.Expressions[field]
+	if ok {
+		return expression
+	}
+
+	return self.Table + "." + field
+}
+
+func (self *Schema) Column(field string) (Column, error) {
+	for _, column := range append(self.Columns, self.Hidden...) {
+		if column.Name == field {
+			return column, nil
+		}
+	}
+
+	return Column{}, &UnknownFieldError{self.Table, field}
+}
+
+func (self *Schema) Check(field string, kinds ...Kind) error {
+	column, err := self.Column(field)
+	if err != nil {
+		return err
+	}
+
+	if len(kinds) == 0 {
+		return nil
+	}
+
+	for _, kind := range kinds {
+		if column.Kind == kind {
+			return nil
+		}
+	}
+
+	return &FieldKindError{self.Table, field, column.Kind, kinds}
+}
+
+func isTime(values []interface{}) bool {
+	for _, value := range values {
+		switch value.(type) {
+		case time.Time, *time.Time:
+			return true
+		}
+	}
+
+	return false
+}
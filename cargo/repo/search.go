@@ -0,0 +1,181 @@
+package repo
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"database/sql"
+
+	"github.com/aewens/nautical/cargo/model"
+)
+
+type Highlight struct {
+	Open     string
+	Close    string
+	Ellipsis string
+	Tokens   int
+}
+
+type Match struct {
+	Entity  model.Entity
+	Rank    float64
+	Name    string
+	Snippet string
+}
+
+func DefaultHighlight() Highlight {
+	return Highlight{
+		Open:     "[",
+		Close:    "]",
+		Ellipsis: "...",
+		Tokens:   16,
+	}
+}
+
+// Search accepts the FTS5 query syntax, so phrases ("a b"), prefixes (ab*)
+// and boolean operators (a AND NOT b) are passed through as written. Results
+// are ordered by bm25 with matches in the name weighted above the body.
+// Sealed bodies are not indexed, so those crates only match by name. The
+// external_search table only exists when go-sqlite3 is built with the
+// sqlite_fts5 tag.
+func (self *External) Search(ctx context.Context, query string) *Stream {
+	stream := NewStream(ctx)
+	ctx = stream.Context()
+
+	go func() {
+		statement, err := self.Store.PrepareContext(ctx, fmt.Sprintf(`
+			SELECT
+				external.id, external.uuid, external.added, external.updated,
+				external.flag, external.type, external.name, %s,
+				external.data
+			FROM external_search
+			JOIN external ON external.id = external_search.rowid
+			WHERE external_search MATCH ? AND NOT %s
+			ORDER BY bm25(external_search, 2.0, 1.0);
+		`, ExternalSchema.Expression("body"), trash("external")))
+
+		if err != nil {
+			stream.Close(err)
+			return
+		}
+
+		defer statement.Close()
+		rows, err := statement.QueryContext(ctx, query)
+
+		if err != nil {
+			stream.Close(err)
+			return
+		}
+
+		self.Process(stream, rows)
+	}()
+
+	return stream
+}
+
+func (self *External) Snippets(
+	ctx       context.Context,
+	query     string,
+	highlight Highlight,
+) ([]*Match, error) {
+	matches := []*Match{}
+
+	statement, err := self.Store.PrepareContext(ctx, fmt.Sprintf(`
+		SELECT
+			external.id, external.uuid, external.added, external.updated,
+			external.flag, external.type, external.name, %s,
+			external.data,
+			bm25(external_search, 2.0, 1.0) AS rank,
+			highlight(external_search, 0, ?, ?),
+			snippet(external_search, 1, ?, ?, ?, ?)
+		FROM external_search
+		JOIN external ON external.id = external_search.rowid
+		WHERE external_search MATCH ? AND NOT %s
+		ORDER BY rank;
+	`, ExternalSchema.Expression("body"), trash("external")))
+
+	if err != nil {
+		return matches, err
+	}
+
+	defer statement.Close()
+	rows, err := statement.QueryContext(
+		ctx,
+		highlight.Open,
+		highlight.Close,
+		highlight.Open,
+		highlight.Close,
+		highlight.Ellipsis,
+		highlight.Tokens,
+		query,
+	)
+
+	if err != nil {
+		return matches, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id      int64
+			uuid    []byte
+			added   time.Time
+			updated time.Time
+			flag    uint8
+			etype   string
+			name    string
+			body    string
+			link    sql.NullInt64
+			match   Match
+		)
+
+		err := rows.Scan(
+			&id,
+			&uuid,
+			&added,
+			&updated,
+			&flag,
+			&etype,
+			&name,
+			&body,
+			&link,
+			&match.Rank,
+			&match.Name,
+			&match.Snippet,
+		)
+
+		if err != nil {
+			return matches, err
+		}
+
+		match.Entity, err = self.Import(
+			id,
+			uuid,
+			added,
+			updated,
+			flag,
+			etype,
+			name,
+			body,
+			link,
+		)
+
+		if err != nil {
+			return matches, err
+		}
+
+		matches = append(matches, &match)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return matches, err
+	}
+
+	entities := []model.Entity{}
+	for _, match := range matches {
+		entities = append(entities, match.Entity)
+	}
+
+	return matches, self.links(ctx, entities)
+}
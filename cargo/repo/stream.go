@@ -0,0 +1,143 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/aewens/nautical/cargo/model"
+)
+
+type Item struct {
+	Entity model.Entity
+	Err    error
+	// position is the raw text of added for rows of a keyed query, which
+	// pages build their cursor from.
+	position string
+}
+
+// Stream delivers the rows of a query on Items, which is always closed once
+// the query finishes. Rows that fail to scan or import arrive as an Item with
+// Err set, while a failure of the query itself is reported by Err. Consumers
+// that stop reading early must call Cancel (or cancel the parent context) so
+// the producer can release its rows and connection.
+type Stream struct {
+	Items  chan Item
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+func NewStream(ctx context.Context) *Stream {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Stream{
+		Items:  make(chan Item),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+}
+
+// Failed returns a stream that is already closed with err, for readers that
+// reject their arguments before running a query.
+func Failed(ctx context.Context, err error) *Stream {
+	stream := NewStream(ctx)
+	stream.Close(err)
+	return stream
+}
+
+func (self *Stream) Context() context.Context {
+	return self.ctx
+}
+
+func (self *Stream) send(item Item) bool {
+	select {
+	case self.Items <- item:
+		return true
+	case <-self.ctx.Done():
+		return false
+	}
+}
+
+func (self *Stream) Send(entity model.Entity) bool {
+	return self.send(Item{Entity: entity})
+}
+
+func (self *Stream) mark(entity model.Entity, position string) bool {
+	return self.send(Item{Entity: entity, position: position})
+}
+
+func (self *Stream) Fail(err error) bool {
+	return self.send(Item{Err: err})
+}
+
+func (self *Stream) Close(err error) {
+	if err == nil {
+		err = self.ctx.Err()
+	}
+
+	self.err = err
+	self.cancel()
+	close(self.Items)
+	close(self.done)
+}
+
+func (self *Stream) Cancel() {
+	self.cancel()
+}
+
+func (self *Stream) Err() error {
+	<-self.done
+	return self.err
+}
+
+func (self *Stream) Entities() ([]model.Entity, error) {
+	entities := []model.Entity{}
+	errs := []error{}
+
+	for item := range self.Items {
+		if item.Err != nil {
+			errs = append(errs, item.Err)
+			continue
+		}
+
+		entities = append(entities, item.Entity)
+	}
+
+	err := self.Err()
+	if err == nil && len(errs) > 0 {
+		err = &RowErrors{Errors: errs}
+	}
+
+	return entities, err
+}
+
+// positioned adds position to dest when rows come from a keyed query, which
+// selects the raw text of added after the columns of the schema.
+func positioned(
+	rows     *sql.Rows,
+	position *string,
+	dest     ...interface{},
+) []interface{} {
+	columns, _ := rows.Columns()
+	if len(columns) > len(dest) {
+		return append(dest, position)
+	}
+
+	return dest
+}
+
+// first drains the stream and returns its first entity, or sql.ErrNoRows when
+// the stream was empty, matching the behaviour of Get.
+func first(stream *Stream) (model.Entity, error) {
+	entities, err := stream.Entities()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(entities) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return entities[0], nil
+}
@@ -1,6 +1,8 @@
 package repo
 
 import (
+	"strings"
+	"context"
 	"fmt"
 	"time"
 	"database/sql"
@@ -9,11 +11,11 @@ import (
 )
 
 type Tag struct {
-	Store  *sql.DB
+	Store  model.Store
 	Crates map[int64]*model.Tag
 }
 
-func NewTag(store *sql.DB) *Tag {
+func NewTag(store model.Store) *Tag {
 	return &Tag{
 		Store:  store,
 		Crates: make(map[int64]*model.Tag),
@@ -24,24 +26,37 @@ func (self *Tag) Create() (model.Entity, error) {
 	return model.NewTag(self.Store)
 }
 
-func (self *Tag) Load(stream Stream) {
-	for entity := range stream {
-		tag, ok := entity.(*model.Tag)
+func (self *Tag) Schema() *Schema {
+	return TagSchema
+}
+
+func (self *Tag) Load(stream *Stream) error {
+	for item := range stream.Items {
+		if item.Err != nil {
+			continue
+		}
+
+		tag, ok := item.Entity.(*model.Tag)
 		if !ok {
 			continue
 		}
 
 		self.Crates[tag.ID] = tag
 	}
+
+	return stream.Err()
 }
 
 func (self *Tag) Import(
-	id      int64,
-	uuid    []byte,
-	added   time.Time,
-	updated time.Time,
-	flag    uint8,
-	label   string,
+	id        int64,
+	uuid      []byte,
+	added     time.Time,
+	updated   time.Time,
+	flag      uint8,
+	label     string,
+	parent    sql.NullInt64,
+	namespace sql.NullString,
+	value     sql.NullString,
 ) (model.Entity, error) {
 	entity, err := self.Create()
 	if err != nil {
@@ -59,35 +74,44 @@ func (self *Tag) Import(
 	tag.Updated = updated
 	tag.Flag = flag
 	tag.Label = label
+	tag.Parent = parent.Int64
+	tag.Namespace = namespace.String
+	tag.Value = value.String
 
 	return entity, nil
 }
 
-func (self *Tag) Get(id int64) (model.Entity, error) {
-	statement, err := self.Store.Prepare(`
-		SELECT uuid, added, updated, flag, label
-		FROM tag WHERE id = ?;
-	`)
+func (self *Tag) Get(ctx context.Context, id int64) (model.Entity, error) {
+	statement, err := self.Store.PrepareContext(ctx, fmt.Sprintf(`
+		SELECT uuid, added, updated, flag, label, parent, namespace, value
+		FROM tag WHERE id = ? AND NOT %s;
+	`, trash("tag")))
 
 	if err != nil {
 		return nil, err
 	}
 
 	var (
-		uuid    []byte
-		added   time.Time
-		updated time.Time
-		flag    uint8
-		label   string
+		uuid      []byte
+		added     time.Time
+		updated   time.Time
+		flag      uint8
+		label     string
+		parent    sql.NullInt64
+		namespace sql.NullString
+		value     sql.NullString
 	)
 
 	defer statement.Close()
-	err = statement.QueryRow(id).Scan(
+	err = statement.QueryRowContext(ctx, id).Scan(
 		&uuid,
 		&added,
 		&updated,
 		&flag,
 		&label,
+		&parent,
+		&namespace,
+		&value,
 	)
 
 	if err != nil {
@@ -101,31 +125,65 @@ func (self *Tag) Get(id int64) (model.Entity, error) {
 		updated,
 		flag,
 		label,
+		parent,
+		namespace,
+		value,
 	)
 }
 
-func (self *Tag) Process(stream Stream, rows *sql.Rows) {
+func (self *Tag) GetByUUID(
+	ctx  context.Context,
+	uuid []byte,
+) (model.Entity, error) {
+	return first(self.Find(ctx, NewQuery().Where(Eq("uuid", uuid))))
+}
+
+func (self *Tag) LookupUUIDs(ctx context.Context, uuids ...[]byte) *Stream {
+	values := []interface{}{}
+	for _, uuid := range uuids {
+		values = append(values, uuid)
+	}
+
+	return self.Find(ctx, NewQuery().Where(In("uuid", values...)))
+}
+
+func (self *Tag) Process(stream *Stream, rows *sql.Rows) {
 	defer rows.Close()
 	for rows.Next() {
 		var (
-			id      int64
-			uuid    []byte
-			added   time.Time
-			updated time.Time
-			flag    uint8
-			label   string
+			id        int64
+			uuid      []byte
+			added     time.Time
+			updated   time.Time
+			flag      uint8
+			label     string
+			parent    sql.NullInt64
+			namespace sql.NullString
+			value     sql.NullString
+			number    sql.NullFloat64 // derived from value by the model
+			position  string
 		)
 
-		err := rows.Scan(
+		err := rows.Scan(positioned(
+			rows,
+			&position,
 			&id,
 			&uuid,
 			&added,
 			&updated,
 			&flag,
 			&label,
-		)
+			&parent,
+			&namespace,
+			&value,
+			&number,
+		)...)
 
 		if err != nil {
+			if !stream.Fail(err) {
+				break
+			}
+
 			continue
 		}
 
@@ -136,179 +194,244 @@ func (self *Tag) Process(stream Stream, rows *sql.Rows) {
 			updated,
 			flag,
 			label,
+			parent,
+			namespace,
+			value,
 		)
 
 		if err != nil {
+			if !stream.Fail(err) {
+				break
+			}
+
 			continue
 		}
 
-		stream <- entity
+		if !stream.mark(entity, position) {
+			break
+		}
 	}
 
-	close(stream)
+	stream.Close(rows.Err())
 }
 
-func (self *Tag) All() Stream {
-	stream := make(Stream)
-
-	go func() {
-		rows, err := self.Store.Query(`
-			SELECT id, uuid, added, updated, flag, label
-			FROM tag;
-		`)
-
-		if err != nil {
-			return
-		}
-
-		self.Process(stream, rows)
-	}()
+func (self *Tag) All(ctx context.Context) *Stream {
+	return self.Find(ctx, NewQuery())
+}
 
-	return stream
+// Trash streams the crates that were soft deleted and not yet purged.
+func (self *Tag) Trash(ctx context.Context) *Stream {
+	return self.Find(ctx, NewQuery().InTrash())
 }
 
-func (self *Tag) Lookup(ids ...int64) Stream {
-	stream := make(Stream)
+func (self *Tag) Lookup(ctx context.Context, ids ...int64) *Stream {
+	stream := NewStream(ctx)
+	ctx = stream.Context()
 
 	go func() {
 		for _, id := range ids {
-			entity, err := self.Get(id)
-			if err == nil {
-				stream <- entity
+			entity, err := self.Get(ctx, id)
+			if err != nil {
+				if !stream.Fail(err) {
+					break
+				}
+
+				continue
+			}
+
+			if !stream.Send(entity) {
+				break
 			}
 		}
 
-		close(stream)
+		stream.Close(nil)
 	}()
 
 	return stream
 }
 
-func (self *Tag) Contains(field string, search string) Stream {
-	stream := make(Stream)
-
-	go func() {
-		statement, err := self.Store.Prepare(fmt.Sprintf(`
-			SELECT id, uuid, added, updated, flag, label
-			FROM tag WHERE %s LIKE ?;
-		`, field))
+func (self *Tag) Contains(
+	ctx    context.Context,
+	field  string,
+	search string,
+) *Stream {
+	return self.Find(ctx, NewQuery().Where(Like(field, search)))
+}
 
-		if err != nil {
-			return
-		}
+func (self *Tag) Equals(
+	ctx    context.Context,
+	field  string,
+	search string,
+) *Stream {
+	return self.Find(ctx, NewQuery().Where(Eq(field, search)))
+}
 
-		defer statement.Close()
-		rows, err := statement.Query("%" + search + "%")
+func (self *Tag) Before(
+	ctx    context.Context,
+	field  string,
+	search time.Time,
+) *Stream {
+	return self.Find(ctx, NewQuery().Where(Lt(field, search)))
+}
 
-		if err != nil {
-			return
-		}
+func (self *Tag) After(
+	ctx    context.Context,
+	field  string,
+	search time.Time,
+) *Stream {
+	return self.Find(ctx, NewQuery().Where(Gt(field, search)))
+}
 
-		self.Process(stream, rows)
-	}()
+func (self *Tag) Between(
+	ctx    context.Context,
+	field  string,
+	before time.Time,
+	after  time.Time,
+) *Stream {
+	return self.Find(ctx, NewQuery().Where(And(
+		Gt(field, before),
+		Lt(field, after),
+	)))
+}
 
-	return stream
+// Related streams the crates that share a mapping row with entity.
+func (self *Tag) Related(ctx context.Context, entity model.Entity) *Stream {
+	return self.Find(ctx, NewQuery().Where(MappedTo(entity)))
 }
 
-func (self *Tag) Equals(field string, search string) Stream {
-	stream := make(Stream)
+// Path looks a tag up by its full label, following aliases to their
+// canonical tag.
+func (self *Tag) Path(ctx context.Context, path string) (model.Entity, error) {
+	label, err := model.Canonical(ctx, self.Store, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return first(self.Find(ctx, NewQuery().Where(Eq("label", label))))
+}
 
-	go func() {
-		statement, err := self.Store.Prepare(fmt.Sprintf(`
-			SELECT id, uuid, added, updated, flag, label
-			FROM tag WHERE %s = ?;
-		`, field))
+func (self *Tag) Aliases(
+	ctx    context.Context,
+	entity model.Entity,
+) ([]string, error) {
+	aliases := []string{}
+	id, _ := entity.ExportMetadata()
 
-		if err != nil {
-			return
-		}
+	rows, err := self.Store.QueryContext(ctx, `
+		SELECT alias FROM tag_alias WHERE tag_id = ? ORDER BY alias;
+	`, id)
 
-		defer statement.Close()
-		rows, err := statement.Query(search)
+	if err != nil {
+		return aliases, err
+	}
 
+	defer rows.Close()
+	for rows.Next() {
+		var alias string
+		err = rows.Scan(&alias)
 		if err != nil {
-			return
+			return aliases, err
 		}
 
-		self.Process(stream, rows)
-	}()
+		aliases = append(aliases, alias)
+	}
 
-	return stream
+	return aliases, rows.Err()
 }
 
-func (self *Tag) Before(field string, search time.Time) Stream {
-	stream := make(Stream)
-
-	go func() {
-		statement, err := self.Store.Prepare(fmt.Sprintf(`
-			SELECT id, uuid, added, updated, flag, label
-			FROM tag WHERE %s < ?;
-		`, field))
+func (self *Tag) Children(ctx context.Context, entity model.Entity) *Stream {
+	id, _ := entity.ExportMetadata()
+	return self.Find(ctx, NewQuery().Where(Eq("parent", id)))
+}
 
-		if err != nil {
-			return
-		}
+func (self *Tag) Subtree(ctx context.Context, path string) *Stream {
+	return self.Find(ctx, NewQuery().Where(Under(path)).OrderBy(
+		"label",
+		Ascending,
+	))
+}
 
-		defer statement.Close()
-		rows, err := statement.Query(search)
+func (self *Tag) Namespace(ctx context.Context, namespace string) *Stream {
+	return self.Find(ctx, NewQuery().Where(InNamespace(namespace)).OrderBy(
+		"label",
+		Ascending,
+	))
+}
 
-		if err != nil {
-			return
-		}
+// Range streams the tags in namespace whose numeric values lie within the
+// inclusive bounds, lowest first.
+func (self *Tag) Range(
+	ctx       context.Context,
+	namespace string,
+	min       float64,
+	max       float64,
+) *Stream {
+	return self.Find(ctx, NewQuery().Where(Within(namespace, min, max)).OrderBy(
+		"number",
+		Ascending,
+	))
+}
 
-		self.Process(stream, rows)
-	}()
+// Ensure returns the tag at path, creating it and any missing ancestors.
+func (self *Tag) Ensure(ctx context.Context, path string) (*model.Tag, error) {
+	var parent *model.Tag = nil
 
-	return stream
-}
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, segment := range segments {
+		if len(segment) == 0 {
+			return nil, fmt.Errorf("Invalid tag path: %s", path)
+		}
 
-func (self *Tag) After(field string, search time.Time) Stream {
-	stream := make(Stream)
+		label := strings.Join(segments[:i+1], "/")
+		entity, err := self.Path(ctx, label)
+		if err == nil {
+			parent = entity.(*model.Tag)
+			continue
+		}
 
-	go func() {
-		statement, err := self.Store.Prepare(fmt.Sprintf(`
-			SELECT id, uuid, added, updated, flag, label
-			FROM tag WHERE %s > ?;
-		`, field))
+		if err != sql.ErrNoRows {
+			return nil, err
+		}
 
+		tag, err := model.NewTag(self.Store)
 		if err != nil {
-			return
+			return nil, err
 		}
 
-		defer statement.Close()
-		rows, err := statement.Query(search)
+		err = tag.Set("label", []byte(segment))
+		if err == nil {
+			err = tag.SetParent(parent)
+		}
+
+		if err == nil {
+			err = tag.Save(ctx)
+		}
 
 		if err != nil {
-			return
+			return nil, err
 		}
 
-		self.Process(stream, rows)
-	}()
+		parent = tag
+	}
 
-	return stream
+	return parent, nil
 }
 
-func (self *Tag) Between(
-	field string,
-	before time.Time,
-	after time.Time,
-) Stream {
-	stream := make(Stream)
+func (self *Tag) Find(ctx context.Context, query *Query) *Stream {
+	stream := NewStream(ctx)
+	ctx = stream.Context()
 
 	go func() {
-		statement, err := self.Store.Prepare(fmt.Sprintf(`
-			SELECT id, uuid, added, updated, flag, label
-			FROM tag WHERE %s > ? AND %s < ?;
-		`, field, field))
+		statement, args, err := query.Build(self.Schema())
 
 		if err != nil {
+			stream.Close(err)
 			return
 		}
 
-		defer statement.Close()
-		rows, err := statement.Query(before, after)
-
+		rows, err := self.Store.QueryContext(ctx, statement, args...)
 		if err != nil {
+			stream.Close(err)
 			return
 		}
 
@@ -317,3 +440,12 @@ func (self *Tag) Between(
 
 	return stream
 }
+
+func (self *Tag) Paginate(
+	ctx   context.Context,
+	query *Query,
+	token string,
+	size  int,
+) (*Page, error) {
+	return paginate(ctx, self, query, token, size)
+}
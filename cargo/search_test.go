@@ -0,0 +1,98 @@
+package cargo
+
+import (
+	"context"
+	"testing"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/aewens/nautical/cargo/model"
+	"github.com/aewens/nautical/cargo/repo"
+)
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:")
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	present, err := exists(hold.Store, "external_search")
+	catch(t, err)
+
+	if !present {
+		t.Skip("SQLite was built without FTS5 (use -tags sqlite_fts5)")
+	}
+
+	documents := map[string]string{
+		"armada": "the quick brown fox jumps over the lazy dog",
+		"fleet":  "a quick brown dog naps",
+		"harbor": "armada notes about the harbor",
+	}
+
+	crates := map[string]model.Entity{}
+	for name, body := range documents {
+		crate, err := hold.NewCrate("external")
+		catch(t, err)
+		catch(t, crate.Set("type", []byte("note")))
+		catch(t, crate.Set("name", []byte(name)))
+		catch(t, crate.Set("body", []byte(body)))
+		catch(t, crate.Save(ctx))
+		crates[name] = crate
+	}
+
+	entity, err := hold.NewRepo("external")
+	catch(t, err)
+
+	erepo := entity.(*repo.External)
+
+	count := StreamSize(erepo.Search(ctx, `"brown fox"`))
+	if count != 1 {
+		t.Fatalf("Could not search phrase: %d", count)
+	}
+
+	count = StreamSize(erepo.Search(ctx, `qui*`))
+	if count != 2 {
+		t.Fatalf("Could not search prefix: %d", count)
+	}
+
+	count = StreamSize(erepo.Search(ctx, `quick NOT fox`))
+	if count != 1 {
+		t.Fatalf("Could not search boolean: %d", count)
+	}
+
+	names := []string{}
+	results, err := erepo.Search(ctx, `armada`).Entities()
+	catch(t, err)
+
+	for _, result := range results {
+		names = append(names, result.(*model.External).Name)
+	}
+
+	if len(names) != 2 || names[0] != "armada" {
+		t.Fatalf("Did not rank name matches first: %v", names)
+	}
+
+	matches, err := erepo.Snippets(ctx, `lazy`, repo.DefaultHighlight())
+	catch(t, err)
+
+	if len(matches) != 1 || !strings.Contains(matches[0].Snippet, "[lazy]") {
+		t.Fatalf("Did not highlight snippet: %#v", matches)
+	}
+
+	crate := crates["fleet"]
+	catch(t, crate.Set("body", []byte("renamed entirely")))
+	catch(t, crate.Update(ctx))
+
+	count = StreamSize(erepo.Search(ctx, `naps`))
+	if count != 0 {
+		t.Fatal("Did not reindex updated body")
+	}
+
+	catch(t, crates["armada"].Delete(ctx))
+
+	count = StreamSize(erepo.Search(ctx, `fox`))
+	if count != 0 {
+		t.Fatal("Did not remove deleted body")
+	}
+}
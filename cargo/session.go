@@ -0,0 +1,98 @@
+package cargo
+
+import (
+	"context"
+	"fmt"
+	"database/sql"
+
+	"github.com/aewens/nautical/cargo/model"
+	"github.com/aewens/nautical/cargo/repo"
+)
+
+type Session struct {
+	Store  *sql.Tx
+	Config *model.Config
+}
+
+func (self *Hold) Begin(ctx context.Context) (*Session, error) {
+	tx, err := self.Store.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{
+		Store:  tx,
+		Config: self.Config,
+	}, nil
+}
+
+// Tx runs fn inside a single transaction, committing when fn returns nil and
+// rolling back when it returns an error or panics.
+func (self *Hold) Tx(
+	ctx context.Context,
+	fn  func(*Session) error,
+) (err error) {
+	session, err := self.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			session.Rollback()
+			panic(recovered)
+		}
+	}()
+
+	err = fn(session)
+	if err != nil {
+		rollback := session.Rollback()
+		if rollback != nil {
+			return fmt.Errorf("%s (rollback failed: %s)", err, rollback)
+		}
+
+		return err
+	}
+
+	return session.Commit()
+}
+
+func (self *Session) Commit() error {
+	return self.Store.Commit()
+}
+
+func (self *Session) Rollback() error {
+	return self.Store.Rollback()
+}
+
+func (self *Session) Vault() model.Store {
+	return &model.Vault{
+		Store:  self.Store,
+		Config: self.Config,
+	}
+}
+
+func (self *Session) NewCrate(crateType string) (model.Entity, error) {
+	return NewCrate(self.Vault(), crateType)
+}
+
+func (self *Session) NewTag() (*model.Tag, error) {
+	return model.NewTag(self.Vault())
+}
+
+func (self *Session) NewRepo(repoType string) (repo.Entity, error) {
+	return NewRepo(self.Vault(), repoType)
+}
+
+func (self *Session) Bind(entities ...model.Entity) {
+	for _, entity := range entities {
+		entity.Bind(self.Vault())
+	}
+}
+
+func (self *Session) Resolve(
+	ctx  context.Context,
+	uuid []byte,
+) (model.Entity, error) {
+	return ResolveUUID(ctx, self.Vault(), uuid)
+}
@@ -1,11 +1,18 @@
 package cargo
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"fmt"
+	"sync/atomic"
+
+	"github.com/aewens/nautical/cargo/model"
+	"github.com/mattn/go-sqlite3"
 )
 
 func Resolve(conn string) (string, error) {
@@ -23,7 +30,20 @@ func Resolve(conn string) (string, error) {
 	return conn, err
 }
 
+var memories int64
+
+// Each in-memory store gets its own named, shared-cache database so that every
+// connection in the pool sees the same tables, which lets a stream keep its
+// rows open while nested lookups run on another connection.
 func Wrap(conn string) string {
+	if conn == ":memory:" {
+		id := atomic.AddInt64(&memories, 1)
+		return fmt.Sprintf(
+			"file:cargo-%d?_foreign_keys=1&mode=memory&cache=shared",
+			id,
+		)
+	}
+
 	params := []string{
 		"_foreign_keys=1",
 		"cached=shared",
@@ -31,30 +51,123 @@ func Wrap(conn string) string {
 	return fmt.Sprintf("file:%s?%s", conn, strings.Join(params, "&"))
 }
 
-func Open(conn string, tables string) (*sql.DB, error) {
-	bootstrap := false
+func Open(conn string) (*sql.DB, error) {
+	return Connect(conn, &model.Config{})
+}
 
-	if conn == ":memory:" {
-		bootstrap = true
-	} else {
-		conn, err := Resolve(conn)
+// Connect opens conn with the functions that read encoded values bound to
+// config, so they open sealed values with whatever keys it holds at the time.
+func Connect(conn string, config *model.Config) (*sql.DB, error) {
+	if conn != ":memory:" {
+		_, err := Resolve(conn)
 		if err != nil {
 			return nil, err
 		}
+	}
+
+	uri := Wrap(conn)
+	return sql.OpenDB(&connector{
+		uri:    uri,
+		driver: &sqlite3.SQLiteDriver{ConnectHook: functions(config)},
+	}), nil
+}
+
+// connector opens every connection with the functions used to read encoded
+// values registered, so queries, views and triggers can all rely on them.
+type connector struct {
+	uri    string
+	driver *sqlite3.SQLiteDriver
+}
+
+func (self *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	return self.driver.Open(self.uri)
+}
+
+func (self *connector) Driver() driver.Driver {
+	return self.driver
+}
+
+func functions(config *model.Config) func(*sqlite3.SQLiteConn) error {
+	text := func(value interface{}) (string, error) {
+		return config.Keyring.Text(value)
+	}
+
+	decode := func(hash []byte, codec string, data []byte) ([]byte, error) {
+		return config.Keyring.Decode(model.BlobScope(hash), codec, data)
+	}
+
+	digest := func(data []byte) []byte {
+		return config.Keyring.Digest(data)
+	}
+
+	return func(conn *sqlite3.SQLiteConn) error {
+		err := conn.RegisterFunc("cargo_text", text, true)
+		if err != nil {
+			return err
+		}
+
+		err = conn.RegisterFunc("cargo_index", model.Index, true)
+		if err != nil {
+			return err
+		}
 
-		_, err = os.Stat(conn)
-		if os.IsNotExist(err) {
-			bootstrap = true
+		err = conn.RegisterFunc("cargo_blob", decode, true)
+		if err != nil {
+			return err
 		}
+
+		err = conn.RegisterFunc("cargo_digest", digest, true)
+		if err != nil {
+			return err
+		}
+
+		return conn.RegisterAggregator("cargo_join", func() *joiner {
+			return &joiner{
+				keyring: config.Keyring,
+				chunks:  map[int64][]byte{},
+			}
+		}, true)
 	}
+}
 
-	uri := Wrap(conn)
-	db, err := sql.Open("sqlite3", uri)
-	if bootstrap && err == nil {
-		_, err = db.Exec(tables)
+// joiner puts the chunks of a blob back together in order, decoding each one
+// as it comes. It yields NULL for a blob that has no chunks.
+type joiner struct {
+	keyring *model.Keyring
+	chunks  map[int64][]byte
+}
+
+func (self *joiner) Step(
+	blob  int64,
+	seq   int64,
+	codec string,
+	data  []byte,
+) error {
+	decoded, err := self.keyring.Decode(model.ChunkScope(blob, seq), codec, data)
+	if err != nil {
+		return err
+	}
+
+	self.chunks[seq] = decoded
+	return nil
+}
+
+func (self *joiner) Done() []byte {
+	seqs := []int64{}
+	for seq := range self.chunks {
+		seqs = append(seqs, seq)
+	}
+
+	sort.Slice(seqs, func(i, j int) bool {
+		return seqs[i] < seqs[j]
+	})
+
+	joined := []byte{}
+	for _, seq := range seqs {
+		joined = append(joined, self.chunks[seq]...)
 	}
 
-	return db, err
+	return joined
 }
 
 var Tables string = `
@@ -121,3 +234,455 @@ var Tables string = `
 		) -- force one pair to be used only
 	);
 `
+
+var SearchTables string = `
+	CREATE VIRTUAL TABLE external_search USING fts5(
+		name,
+		body,
+		content='external',
+		content_rowid='id'
+	);
+	INSERT INTO external_search (external_search) VALUES ('rebuild');
+	CREATE TRIGGER external_search_insert AFTER INSERT ON external BEGIN
+		INSERT INTO external_search (rowid, name, body)
+		VALUES (new.id, new.name, new.body);
+	END;
+	CREATE TRIGGER external_search_delete AFTER DELETE ON external BEGIN
+		INSERT INTO external_search (external_search, rowid, name, body)
+		VALUES ('delete', old.id, old.name, old.body);
+	END;
+	CREATE TRIGGER external_search_update AFTER UPDATE OF name, body
+	ON external BEGIN
+		INSERT INTO external_search (external_search, rowid, name, body)
+		VALUES ('delete', old.id, old.name, old.body);
+		INSERT INTO external_search (rowid, name, body)
+		VALUES (new.id, new.name, new.body);
+	END;
+`
+
+var TagHierarchy string = `
+	ALTER TABLE tag ADD COLUMN parent INTEGER -- allowed to be null
+		REFERENCES tag(id) ON DELETE CASCADE;
+	CREATE INDEX tag_parent ON tag (parent);
+	UPDATE tag SET parent = (
+		SELECT ancestor.id FROM tag AS ancestor
+		WHERE substr(tag.label, 1, length(ancestor.label) + 1)
+			= ancestor.label || '/'
+		AND instr(substr(tag.label, length(ancestor.label) + 2), '/') = 0
+	); -- link existing slash separated labels to their parents
+`
+
+var TagAliases string = `
+	CREATE TABLE tag_alias (
+		id INTEGER PRIMARY KEY,
+		added DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		alias VARCHAR(128) UNIQUE NOT NULL,
+		tag_id INTEGER NOT NULL,
+		FOREIGN KEY (tag_id) REFERENCES tag(id) ON DELETE CASCADE
+	);
+	CREATE INDEX tag_alias_tag ON tag_alias (tag_id);
+`
+
+var TagValues string = `
+	ALTER TABLE tag ADD COLUMN namespace VARCHAR(64); -- allowed to be null
+	ALTER TABLE tag ADD COLUMN value TEXT; -- allowed to be null
+	ALTER TABLE tag ADD COLUMN number REAL; -- numeric values, for ranges
+	CREATE INDEX tag_namespace ON tag (namespace, value);
+	CREATE INDEX tag_number ON tag (namespace, number);
+	UPDATE tag
+	SET namespace = substr(label, 1, instr(label, '=') - 1),
+		value = substr(label, instr(label, '=') + 1)
+	WHERE instr(label, '=') BETWEEN 2 AND 65
+	AND instr(substr(label, 1, instr(label, '=')), '/') = 0; -- ns=value labels
+	UPDATE tag SET number = CAST(value AS REAL)
+	WHERE CAST(CAST(value AS INTEGER) AS TEXT) = value
+	OR CAST(CAST(value AS REAL) AS TEXT) = value;
+`
+
+var TrashTable string = `
+	CREATE TABLE trash (
+		id INTEGER PRIMARY KEY,
+		deleted DATETIME NOT NULL,
+		internal_id INTEGER UNIQUE, -- allowed to be null
+		external_id INTEGER UNIQUE, -- allowed to be null
+		tag_id INTEGER UNIQUE, -- allowed to be null
+		FOREIGN KEY (internal_id) REFERENCES internal(id) ON DELETE CASCADE,
+		FOREIGN KEY (external_id) REFERENCES external(id) ON DELETE CASCADE,
+		FOREIGN KEY (tag_id) REFERENCES tag(id) ON DELETE CASCADE,
+		CHECK (
+			(internal_id IS NOT NULL)
+			+ (external_id IS NOT NULL)
+			+ (tag_id IS NOT NULL) = 1
+		) -- force exactly one crate per row
+	);
+	CREATE INDEX trash_deleted ON trash (deleted);
+`
+
+var RevisionTables string = `
+	CREATE TABLE internal_revision (
+		id INTEGER PRIMARY KEY,
+		internal_id INTEGER NOT NULL,
+		recorded DATETIME NOT NULL, -- when the values below were replaced
+		updated DATETIME NOT NULL, -- when the values below were written
+		fields VARCHAR(64) NOT NULL,
+		flag INTEGER NOT NULL,
+		type VARCHAR(64) NOT NULL,
+		origin VARCHAR(64) NOT NULL,
+		data BLOB NOT NULL,
+		FOREIGN KEY (internal_id) REFERENCES internal(id) ON DELETE CASCADE
+	);
+	CREATE INDEX internal_revision_crate ON internal_revision (internal_id, id);
+	CREATE TABLE external_revision (
+		id INTEGER PRIMARY KEY,
+		external_id INTEGER NOT NULL,
+		recorded DATETIME NOT NULL, -- when the values below were replaced
+		updated DATETIME NOT NULL, -- when the values below were written
+		fields VARCHAR(64) NOT NULL,
+		flag INTEGER NOT NULL,
+		type VARCHAR(64) NOT NULL,
+		name VARCHAR(64) NOT NULL,
+		body TEXT NOT NULL,
+		data INTEGER, -- allowed to be null
+		FOREIGN KEY (external_id) REFERENCES external(id) ON DELETE CASCADE,
+		FOREIGN KEY (data) REFERENCES internal(id) ON DELETE SET NULL
+	);
+	CREATE INDEX external_revision_crate ON external_revision (external_id, id);
+` + InternalRevisionTrigger + ExternalRevisionTrigger
+
+var AuditTable string = `
+	CREATE TABLE audit (
+		id INTEGER PRIMARY KEY,
+		recorded DATETIME NOT NULL,
+		operation VARCHAR(16) NOT NULL,
+		kind VARCHAR(16) NOT NULL,
+		uuid BLOB(32) NOT NULL,
+		actor VARCHAR(64) NOT NULL,
+		before TEXT NOT NULL,
+		after TEXT NOT NULL,
+		related_kind VARCHAR(16), -- allowed to be null
+		related_uuid BLOB(32) -- allowed to be null
+	);
+	CREATE INDEX audit_uuid ON audit (uuid, id);
+	CREATE INDEX audit_related ON audit (related_uuid, id);
+	CREATE INDEX audit_recorded ON audit (recorded);
+	CREATE TRIGGER audit_update BEFORE UPDATE ON audit BEGIN
+		SELECT RAISE(ABORT, 'Audit log is append-only');
+	END;
+	CREATE TRIGGER audit_delete BEFORE DELETE ON audit BEGIN
+		SELECT RAISE(ABORT, 'Audit log is append-only');
+	END;
+`
+
+var ExternalRevisionTrigger string = `
+	CREATE TRIGGER external_revision_update AFTER UPDATE ON external
+	WHEN old.flag IS NOT new.flag
+		OR old.type IS NOT new.type
+		OR old.name IS NOT new.name
+		OR old.body IS NOT new.body
+		OR old.data IS NOT new.data
+	BEGIN
+		INSERT INTO external_revision (
+			external_id, recorded, updated, fields, flag, type, name, body, data
+		)
+		VALUES (
+			old.id, new.updated, old.updated,
+			rtrim(
+				CASE WHEN old.flag IS NOT new.flag THEN 'flag,' ELSE '' END
+				|| CASE WHEN old.type IS NOT new.type THEN 'type,' ELSE '' END
+				|| CASE WHEN old.name IS NOT new.name THEN 'name,' ELSE '' END
+				|| CASE WHEN old.body IS NOT new.body THEN 'body,' ELSE '' END
+				|| CASE WHEN old.data IS NOT new.data THEN 'data,' ELSE '' END,
+				','
+			),
+			old.flag, old.type, old.name, old.body, old.data
+		);
+	END;
+`
+
+var InternalRevisionTrigger string = `
+	CREATE TRIGGER internal_revision_update AFTER UPDATE ON internal
+	WHEN old.flag IS NOT new.flag
+		OR old.type IS NOT new.type
+		OR old.origin IS NOT new.origin
+		OR old.data IS NOT new.data
+	BEGIN
+		INSERT INTO internal_revision (
+			internal_id, recorded, updated, fields, flag, type, origin, data
+		)
+		VALUES (
+			old.id, new.updated, old.updated,
+			rtrim(
+				CASE WHEN old.flag IS NOT new.flag THEN 'flag,' ELSE '' END
+				|| CASE WHEN old.type IS NOT new.type THEN 'type,' ELSE '' END
+				|| CASE WHEN old.origin IS NOT new.origin
+					THEN 'origin,' ELSE '' END
+				|| CASE WHEN old.data IS NOT new.data THEN 'data,' ELSE '' END,
+				','
+			),
+			old.flag, old.type, old.origin, old.data
+		);
+	END;
+`
+
+var BlobTables string = `
+	CREATE TABLE blob (
+		id INTEGER PRIMARY KEY,
+		added DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		hash BLOB(32) UNIQUE NOT NULL, -- sha256 of the data
+		size INTEGER NOT NULL,
+		refs INTEGER DEFAULT 0 NOT NULL,
+		data BLOB NOT NULL
+	);
+	CREATE INDEX blob_refs ON blob (refs);
+	ALTER TABLE internal ADD COLUMN blob_id INTEGER -- null for inline data
+		REFERENCES blob(id);
+	ALTER TABLE internal_revision ADD COLUMN blob_id INTEGER -- same as above
+		REFERENCES blob(id);
+	CREATE INDEX internal_blob ON internal (blob_id);
+	CREATE INDEX internal_revision_blob ON internal_revision (blob_id);
+` + BlobTriggers + `
+	DROP TRIGGER internal_revision_update;
+	CREATE TRIGGER internal_revision_update AFTER UPDATE ON internal
+	WHEN old.updated IS NOT new.updated -- moving data into a blob is not a revision
+	AND (
+		old.flag IS NOT new.flag
+		OR old.type IS NOT new.type
+		OR old.origin IS NOT new.origin
+		OR old.data IS NOT new.data
+		OR old.blob_id IS NOT new.blob_id
+	)
+	BEGIN
+		INSERT INTO internal_revision (
+			internal_id, recorded, updated, fields, flag, type, origin, data,
+			blob_id
+		)
+		VALUES (
+			old.id, new.updated, old.updated,
+			rtrim(
+				CASE WHEN old.flag IS NOT new.flag THEN 'flag,' ELSE '' END
+				|| CASE WHEN old.type IS NOT new.type THEN 'type,' ELSE '' END
+				|| CASE WHEN old.origin IS NOT new.origin
+					THEN 'origin,' ELSE '' END
+				|| CASE WHEN old.data IS NOT new.data
+					OR old.blob_id IS NOT new.blob_id
+					THEN 'data,' ELSE '' END,
+				','
+			),
+			old.flag, old.type, old.origin, old.data, old.blob_id
+		);
+	END;
+`
+
+var BlobTriggers string = `
+	CREATE TRIGGER blob_internal_insert AFTER INSERT ON internal
+	WHEN new.blob_id IS NOT NULL
+	BEGIN
+		UPDATE blob SET refs = refs + 1 WHERE id = new.blob_id;
+	END;
+	CREATE TRIGGER blob_internal_update AFTER UPDATE OF blob_id ON internal
+	WHEN old.blob_id IS NOT new.blob_id
+	BEGIN
+		UPDATE blob SET refs = refs - 1 WHERE id = old.blob_id;
+		UPDATE blob SET refs = refs + 1 WHERE id = new.blob_id;
+	END;
+	CREATE TRIGGER blob_internal_delete AFTER DELETE ON internal
+	WHEN old.blob_id IS NOT NULL
+	BEGIN
+		UPDATE blob SET refs = refs - 1 WHERE id = old.blob_id;
+	END;
+	CREATE TRIGGER blob_revision_insert AFTER INSERT ON internal_revision
+	WHEN new.blob_id IS NOT NULL
+	BEGIN
+		UPDATE blob SET refs = refs + 1 WHERE id = new.blob_id;
+	END;
+	CREATE TRIGGER blob_revision_delete AFTER DELETE ON internal_revision
+	WHEN old.blob_id IS NOT NULL
+	BEGIN
+		UPDATE blob SET refs = refs - 1 WHERE id = old.blob_id;
+	END;
+`
+
+var BlobRollback string = `
+	UPDATE internal SET data = (
+		SELECT blob.data FROM blob WHERE blob.id = internal.blob_id
+	) WHERE blob_id IS NOT NULL;
+	UPDATE internal_revision SET data = (
+		SELECT blob.data FROM blob WHERE blob.id = internal_revision.blob_id
+	) WHERE blob_id IS NOT NULL;
+	DROP TRIGGER internal_revision_update;
+	DROP TRIGGER blob_revision_delete;
+	DROP TRIGGER blob_revision_insert;
+	DROP TRIGGER blob_internal_delete;
+	DROP TRIGGER blob_internal_update;
+	DROP TRIGGER blob_internal_insert;
+	DROP INDEX internal_revision_blob;
+	DROP INDEX internal_blob;
+	CREATE TABLE internal_rebuild (
+		id INTEGER PRIMARY KEY,
+		uuid BLOB(32) UNIQUE NOT NULL,
+		added DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		updated DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		flag INTEGER DEFAULT 0 NOT NULL,
+		type VARCHAR(64) NOT NULL,
+		origin VARCHAR(64) NOT NULL,
+		data BLOB NOT NULL,
+		CHECK (flag >= 0 AND flag <= 255) -- force unsigned int8
+	);
+	INSERT INTO internal_rebuild (
+		id, uuid, added, updated, flag, type, origin, data
+	)
+	SELECT id, uuid, added, updated, flag, type, origin, data FROM internal;
+	DROP TABLE internal;
+	ALTER TABLE internal_rebuild RENAME TO internal;
+	CREATE TABLE internal_revision_rebuild (
+		id INTEGER PRIMARY KEY,
+		internal_id INTEGER NOT NULL,
+		recorded DATETIME NOT NULL, -- when the values below were replaced
+		updated DATETIME NOT NULL, -- when the values below were written
+		fields VARCHAR(64) NOT NULL,
+		flag INTEGER NOT NULL,
+		type VARCHAR(64) NOT NULL,
+		origin VARCHAR(64) NOT NULL,
+		data BLOB NOT NULL,
+		FOREIGN KEY (internal_id) REFERENCES internal(id) ON DELETE CASCADE
+	);
+	INSERT INTO internal_revision_rebuild (
+		id, internal_id, recorded, updated, fields, flag, type, origin, data
+	)
+	SELECT
+		id, internal_id, recorded, updated, fields, flag, type, origin, data
+	FROM internal_revision;
+	DROP TABLE internal_revision;
+	ALTER TABLE internal_revision_rebuild RENAME TO internal_revision;
+	CREATE INDEX internal_revision_crate ON internal_revision (internal_id, id);
+	DROP TABLE blob;
+` + InternalRevisionTrigger
+
+var CompressionTables string = `
+	ALTER TABLE blob ADD COLUMN codec VARCHAR(16) DEFAULT '' NOT NULL; -- plain
+	DROP TRIGGER external_revision_update;
+	CREATE TRIGGER external_revision_update AFTER UPDATE ON external
+	WHEN old.updated IS NOT new.updated -- recompressing is not a revision
+	AND (
+		old.flag IS NOT new.flag
+		OR old.type IS NOT new.type
+		OR old.name IS NOT new.name
+		OR old.body IS NOT new.body
+		OR old.data IS NOT new.data
+	)
+	BEGIN
+		INSERT INTO external_revision (
+			external_id, recorded, updated, fields, flag, type, name, body, data
+		)
+		VALUES (
+			old.id, new.updated, old.updated,
+			rtrim(
+				CASE WHEN old.flag IS NOT new.flag THEN 'flag,' ELSE '' END
+				|| CASE WHEN old.type IS NOT new.type THEN 'type,' ELSE '' END
+				|| CASE WHEN old.name IS NOT new.name THEN 'name,' ELSE '' END
+				|| CASE WHEN old.body IS NOT new.body THEN 'body,' ELSE '' END
+				|| CASE WHEN old.data IS NOT new.data THEN 'data,' ELSE '' END,
+				','
+			),
+			old.flag, old.type, old.name, old.body, old.data
+		);
+	END;
+`
+
+var CompressionRollback string = `
+	UPDATE external SET body = cargo_text(body) WHERE typeof(body) = 'blob';
+	UPDATE external_revision SET body = cargo_text(body)
+	WHERE typeof(body) = 'blob';
+	DROP TRIGGER external_revision_update;
+	DROP TRIGGER blob_revision_delete;
+	DROP TRIGGER blob_revision_insert;
+	DROP TRIGGER blob_internal_delete;
+	DROP TRIGGER blob_internal_update;
+	DROP TRIGGER blob_internal_insert;
+	CREATE TABLE blob_rebuild (
+		id INTEGER PRIMARY KEY,
+		added DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		hash BLOB(32) UNIQUE NOT NULL, -- sha256 of the data
+		size INTEGER NOT NULL,
+		refs INTEGER DEFAULT 0 NOT NULL,
+		data BLOB NOT NULL
+	);
+	INSERT INTO blob_rebuild (id, added, hash, size, refs, data)
+	SELECT id, added, hash, size, refs, COALESCE(cargo_blob(hash, codec, data), X'')
+	FROM blob;
+	DROP TABLE blob;
+	ALTER TABLE blob_rebuild RENAME TO blob;
+	CREATE INDEX blob_refs ON blob (refs);
+` + BlobTriggers + ExternalRevisionTrigger
+
+// The search index reads bodies through a view that decodes them, so
+// compressed bodies are indexed by their text.
+var SearchCodec string = `
+	DROP TRIGGER external_search_update;
+	DROP TRIGGER external_search_delete;
+	DROP TRIGGER external_search_insert;
+	DROP TABLE external_search;
+	CREATE VIEW external_plain AS
+	SELECT id, name, cargo_text(body) AS body FROM external;
+	CREATE VIRTUAL TABLE external_search USING fts5(
+		name,
+		body,
+		content='external_plain',
+		content_rowid='id'
+	);
+	INSERT INTO external_search (external_search) VALUES ('rebuild');
+	CREATE TRIGGER external_search_insert AFTER INSERT ON external BEGIN
+		INSERT INTO external_search (rowid, name, body)
+		VALUES (new.id, new.name, cargo_text(new.body));
+	END;
+	CREATE TRIGGER external_search_delete AFTER DELETE ON external BEGIN
+		INSERT INTO external_search (external_search, rowid, name, body)
+		VALUES ('delete', old.id, old.name, cargo_text(old.body));
+	END;
+	CREATE TRIGGER external_search_update AFTER UPDATE OF name, body
+	ON external BEGIN
+		INSERT INTO external_search (external_search, rowid, name, body)
+		VALUES ('delete', old.id, old.name, cargo_text(old.body));
+		INSERT INTO external_search (rowid, name, body)
+		VALUES (new.id, new.name, cargo_text(new.body));
+	END;
+`
+
+// Sealed bodies are kept out of the search index, so their words are not
+// stored in the clear.
+var SearchSealed string = `
+	DROP TRIGGER external_search_update;
+	DROP TRIGGER external_search_delete;
+	DROP TRIGGER external_search_insert;
+	DROP VIEW external_plain;
+	CREATE VIEW external_plain AS
+	SELECT id, name, cargo_index(body) AS body FROM external;
+	INSERT INTO external_search (external_search) VALUES ('rebuild');
+	CREATE TRIGGER external_search_insert AFTER INSERT ON external BEGIN
+		INSERT INTO external_search (rowid, name, body)
+		VALUES (new.id, new.name, cargo_index(new.body));
+	END;
+	CREATE TRIGGER external_search_delete AFTER DELETE ON external BEGIN
+		INSERT INTO external_search (external_search, rowid, name, body)
+		VALUES ('delete', old.id, old.name, cargo_index(old.body));
+	END;
+	CREATE TRIGGER external_search_update AFTER UPDATE OF name, body
+	ON external BEGIN
+		INSERT INTO external_search (external_search, rowid, name, body)
+		VALUES ('delete', old.id, old.name, cargo_index(old.body));
+		INSERT INTO external_search (rowid, name, body)
+		VALUES (new.id, new.name, cargo_index(new.body));
+	END;
+`
+
+var ChunkTables string = `
+	CREATE TABLE blob_chunk (
+		id INTEGER PRIMARY KEY,
+		blob_id INTEGER NOT NULL,
+		seq INTEGER NOT NULL,
+		codec VARCHAR(64) DEFAULT '' NOT NULL,
+		data BLOB NOT NULL,
+		UNIQUE (blob_id, seq),
+		FOREIGN KEY (blob_id) REFERENCES blob(id) ON DELETE CASCADE
+	);
+`
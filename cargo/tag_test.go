@@ -0,0 +1,414 @@
+package cargo
+
+import (
+	"testing"
+	"bytes"
+	"context"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/aewens/nautical/cargo/model"
+	"github.com/aewens/nautical/cargo/repo"
+)
+
+func TestTagHierarchy(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:")
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	repository, err := hold.NewRepo("tag")
+	catch(t, err)
+
+	trepo := repository.(*repo.Tag)
+	backend, err := trepo.Ensure(ctx, "project/armada/backend")
+	catch(t, err)
+
+	_, err = trepo.Ensure(ctx, "project/fleet")
+	catch(t, err)
+
+	work, err := trepo.Ensure(ctx, "work")
+	catch(t, err)
+
+	entity, err := trepo.Path(ctx, "project/armada")
+	catch(t, err)
+
+	armada := entity.(*model.Tag)
+	if backend.Parent != armada.ID || backend.Name() != "backend" {
+		t.Fatalf("Did not link parent: %d", backend.Parent)
+	}
+
+	count := StreamSize(trepo.Subtree(ctx, "project"))
+	if count != 4 {
+		t.Fatalf("Did not find subtree: %d", count)
+	}
+
+	count = StreamSize(trepo.Children(ctx, armada))
+	if count != 1 {
+		t.Fatalf("Did not find children: %d", count)
+	}
+
+	// a path saved as a label is placed beneath the tag it names
+	frontend, err := hold.NewTag()
+	catch(t, err)
+	catch(t, frontend.Set("label", []byte("project/armada/frontend")))
+	catch(t, frontend.Save(ctx))
+
+	count = StreamSize(trepo.Children(ctx, armada))
+	if frontend.Parent != armada.ID || count != 2 {
+		t.Fatalf("Did not derive parent from label: %d", frontend.Parent)
+	}
+
+	orphan, err := hold.NewTag()
+	catch(t, err)
+	catch(t, orphan.Set("label", []byte("missing/orphan")))
+
+	err = orphan.Save(ctx)
+	if err == nil {
+		t.Fatal("Saved tag beneath missing parent")
+	}
+
+	crate, err := hold.NewCrate("external")
+	catch(t, err)
+	catch(t, crate.Set("type", []byte("test")))
+	catch(t, crate.Set("name", []byte("test")))
+	catch(t, crate.Set("body", []byte("test")))
+	catch(t, crate.Save(ctx))
+	catch(t, crate.Map(ctx, backend))
+
+	erepo, err := hold.NewRepo("external")
+	catch(t, err)
+
+	count = StreamSize(erepo.(repo.Tagger).Tagged(ctx, "project/*"))
+	if count != 1 {
+		t.Fatalf("Did not match descendant tags: %d", count)
+	}
+
+	count = StreamSize(erepo.(repo.Tagger).Tagged(ctx, "project"))
+	if count != 0 {
+		t.Fatalf("Matched descendant without wildcard: %d", count)
+	}
+
+	err = backend.Move(ctx, backend)
+	if err == nil {
+		t.Fatal("Moved tag beneath itself")
+	}
+
+	catch(t, armada.Move(ctx, work))
+
+	if armada.Label != "work/armada" || armada.Parent != work.ID {
+		t.Fatalf("Did not move tag: %s", armada.Label)
+	}
+
+	entity, err = trepo.Get(ctx, backend.ID)
+	catch(t, err)
+
+	if entity.(*model.Tag).Label != "work/armada/backend" {
+		t.Fatalf("Did not move subtree: %s", entity.(*model.Tag).Label)
+	}
+
+	count = StreamSize(erepo.(repo.Tagger).Tagged(ctx, "work/*"))
+	if count != 1 {
+		t.Fatalf("Did not keep mappings when moving: %d", count)
+	}
+
+	// a label set on a saved tag carries its subtree along as well
+	catch(t, armada.Set("label", []byte("work/core")))
+	catch(t, armada.Update(ctx))
+
+	count = StreamSize(trepo.Subtree(ctx, "work/core"))
+	if count != 3 || StreamSize(trepo.Subtree(ctx, "work/armada")) != 0 {
+		t.Fatalf("Did not relabel subtree on update: %d", count)
+	}
+
+	catch(t, armada.Set("label", []byte("work/core/backend/core")))
+	err = armada.Update(ctx)
+	if err == nil {
+		t.Fatal("Relabelled tag beneath itself")
+	}
+
+	catch(t, work.Delete(ctx))
+
+	count = StreamSize(trepo.All(ctx))
+	if count != 2 {
+		t.Fatalf("Did not delete subtree: %d", count)
+	}
+}
+
+func TestTagHierarchyMigration(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:")
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	catch(t, hold.MigrateTo(2))
+
+	for _, label := range []string{"a", "a/b", "a/b/c", "x/y"} {
+		_, err = hold.Store.Exec(`
+			INSERT INTO tag (uuid, label) VALUES (randomblob(32), ?);
+		`, label)
+		catch(t, err)
+	}
+
+	catch(t, hold.Migrate())
+
+	trepo, err := hold.NewRepo("tag")
+	catch(t, err)
+
+	parents := map[string]int64{"a": 0, "a/b": 1, "a/b/c": 2, "x/y": 0}
+	for label, parent := range parents {
+		entity, err := trepo.(*repo.Tag).Path(ctx, label)
+		catch(t, err)
+
+		if entity.(*model.Tag).Parent != parent {
+			t.Fatalf("Did not backfill parent of %s", label)
+		}
+	}
+}
+
+func TestTagMerge(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:")
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	repository, err := hold.NewRepo("tag")
+	catch(t, err)
+
+	trepo := repository.(*repo.Tag)
+	typo, err := trepo.Ensure(ctx, "urgnet")
+	catch(t, err)
+
+	urgent, err := trepo.Ensure(ctx, "urgent")
+	catch(t, err)
+
+	child, err := trepo.Ensure(ctx, "urgnet/today")
+	catch(t, err)
+
+	erepo, err := hold.NewRepo("external")
+	catch(t, err)
+
+	for i := 0; i < 3; i++ {
+		crate, err := erepo.Create()
+		catch(t, err)
+		catch(t, crate.Set("type", []byte("test")))
+		catch(t, crate.Set("name", []byte("test")))
+		catch(t, crate.Set("body", []byte("test")))
+		catch(t, crate.Save(ctx))
+		catch(t, crate.Map(ctx, typo))
+
+		if i == 0 {
+			catch(t, crate.Map(ctx, urgent))
+		}
+	}
+
+	catch(t, typo.Merge(ctx, urgent))
+
+	count := StreamSize(erepo.(repo.Tagger).Tagged(ctx, "urgent"))
+	if count != 3 {
+		t.Fatalf("Did not re-point mappings: %d", count)
+	}
+
+	var mappings int
+	err = hold.Store.QueryRow(`SELECT COUNT(*) FROM mapping;`).Scan(&mappings)
+	catch(t, err)
+
+	if mappings != 3 {
+		t.Fatalf("Did not remove duplicate mappings: %d", mappings)
+	}
+
+	entity, err := trepo.Get(ctx, child.ID)
+	catch(t, err)
+
+	if entity.(*model.Tag).Label != "urgent/today" {
+		t.Fatalf("Did not move children: %s", entity.(*model.Tag).Label)
+	}
+
+	entity, err = trepo.Path(ctx, "urgnet")
+	catch(t, err)
+
+	if entity.(*model.Tag).ID != urgent.ID {
+		t.Fatal("Did not alias merged label")
+	}
+
+	count = StreamSize(erepo.(repo.Tagger).Tagged(ctx, "urgnet"))
+	if count != 3 {
+		t.Fatalf("Did not match alias: %d", count)
+	}
+
+	catch(t, urgent.Alias(ctx, "asap"))
+
+	// a tag saved under an alias becomes the tag the alias stands for
+	tag, err := hold.NewTag()
+	catch(t, err)
+	catch(t, tag.Set("label", []byte("asap")))
+	catch(t, tag.Save(ctx))
+
+	if tag.ID != urgent.ID || !bytes.Equal(tag.UUID, urgent.UUID) {
+		t.Fatalf("Did not resolve alias on save: %s", tag.Label)
+	}
+
+	if tag.Label != "urgent" || StreamSize(trepo.All(ctx)) != 2 {
+		t.Fatal("Saved another tag for alias")
+	}
+
+	err = urgent.Alias(ctx, "urgent/today")
+	if err == nil {
+		t.Fatal("Aliased an existing tag")
+	}
+
+	aliases, err := trepo.Aliases(ctx, urgent)
+	catch(t, err)
+
+	if len(aliases) != 2 {
+		t.Fatalf("Did not list aliases: %v", aliases)
+	}
+
+	catch(t, urgent.Rename(ctx, "critical"))
+
+	entity, err = trepo.Get(ctx, child.ID)
+	catch(t, err)
+
+	if entity.(*model.Tag).Label != "critical/today" {
+		t.Fatalf("Did not rename subtree: %s", entity.(*model.Tag).Label)
+	}
+
+	entity, err = trepo.Path(ctx, "asap")
+	catch(t, err)
+
+	if entity.(*model.Tag).Label != "critical" {
+		t.Fatal("Did not keep alias through rename")
+	}
+
+	other, err := trepo.Ensure(ctx, "other/today")
+	catch(t, err)
+
+	parent, err := trepo.Path(ctx, "other")
+	catch(t, err)
+
+	crate, err := erepo.Create()
+	catch(t, err)
+	catch(t, crate.Set("type", []byte("test")))
+	catch(t, crate.Set("name", []byte("test")))
+	catch(t, crate.Set("body", []byte("test")))
+	catch(t, crate.Save(ctx))
+	catch(t, crate.Map(ctx, other))
+	catch(t, parent.(*model.Tag).Merge(ctx, urgent))
+
+	// other/today folds into critical/today rather than colliding with it
+	_, err = trepo.Get(ctx, other.ID)
+	if err == nil {
+		t.Fatal("Did not fold child with the same name")
+	}
+
+	entity, err = trepo.Path(ctx, "other/today")
+	catch(t, err)
+
+	if entity.(*model.Tag).ID != child.ID {
+		t.Fatalf("Did not alias folded child: %s", entity.(*model.Tag).Label)
+	}
+
+	count = StreamSize(erepo.(repo.Tagger).Tagged(ctx, "critical/today"))
+	if count != 1 {
+		t.Fatalf("Did not re-point mappings of folded child: %d", count)
+	}
+}
+
+func TestTagValues(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:")
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	catch(t, hold.MigrateTo(4))
+
+	for _, label := range []string{"priority=high", "size=12", "a/b=c"} {
+		_, err = hold.Store.Exec(`
+			INSERT INTO tag (uuid, label) VALUES (randomblob(32), ?);
+		`, label)
+		catch(t, err)
+	}
+
+	catch(t, hold.Migrate())
+
+	repository, err := hold.NewRepo("tag")
+	catch(t, err)
+
+	trepo := repository.(*repo.Tag)
+	entity, err := trepo.Path(ctx, "size=12")
+	catch(t, err)
+
+	size := entity.(*model.Tag)
+	number, ok := size.Number()
+	if size.Namespace != "size" || !ok || number != 12 {
+		t.Fatalf("Did not backfill value: %#v", size)
+	}
+
+	entity, err = trepo.Path(ctx, "a/b=c")
+	catch(t, err)
+
+	if entity.(*model.Tag).Namespace != "" {
+		t.Fatal("Split nested label into namespace")
+	}
+
+	large, err := hold.NewTag()
+	catch(t, err)
+	catch(t, large.Set("namespace", []byte("size")))
+	catch(t, large.Set("value", []byte("40.5")))
+	catch(t, large.Save(ctx))
+
+	if large.Label != "size=40.5" {
+		t.Fatalf("Did not build label: %s", large.Label)
+	}
+
+	err = large.Move(ctx, size)
+	if err == nil {
+		t.Fatal("Nested a namespaced tag")
+	}
+
+	count := StreamSize(trepo.Namespace(ctx, "size"))
+	if count != 2 {
+		t.Fatalf("Did not find namespace: %d", count)
+	}
+
+	count = StreamSize(trepo.Range(ctx, "size", 10, 20))
+	if count != 1 {
+		t.Fatalf("Did not find range: %d", count)
+	}
+
+	crate, err := hold.NewCrate("external")
+	catch(t, err)
+	catch(t, crate.Set("type", []byte("test")))
+	catch(t, crate.Set("name", []byte("test")))
+	catch(t, crate.Set("body", []byte("test")))
+	catch(t, crate.Save(ctx))
+	catch(t, crate.Map(ctx, large))
+
+	erepo, err := hold.NewRepo("external")
+	catch(t, err)
+
+	queries := map[repo.Predicate]int{
+		repo.InNamespace("size"):      1,
+		repo.HasValue("size", "40.5"): 1,
+		repo.HasValue("size", "12"):   0,
+		repo.Within("size", 40, 41):   1,
+		repo.Within("size", 0, 40):    0,
+		repo.InNamespace("priority"):  0,
+	}
+
+	for predicate, expected := range queries {
+		count = StreamSize(erepo.Find(ctx, repo.NewQuery().Where(predicate)))
+		if count != expected {
+			t.Fatalf("Expected %d crates, found %d", expected, count)
+		}
+	}
+
+	expr := "size=* AND NOT priority=high"
+	count = StreamSize(erepo.(repo.Tagger).Tagged(ctx, expr))
+	if count != 1 {
+		t.Fatalf("Did not match namespace expression: %d", count)
+	}
+}
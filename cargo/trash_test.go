@@ -0,0 +1,106 @@
+package cargo
+
+import (
+	"testing"
+	"context"
+	"time"
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/aewens/nautical/cargo/model"
+	"github.com/aewens/nautical/cargo/repo"
+)
+
+func TestTrash(t *testing.T) {
+	ctx := context.Background()
+	hold, err := New(":memory:", WithSoftDelete(time.Hour))
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	repository, err := hold.NewRepo("tag")
+	catch(t, err)
+
+	trepo := repository.(*repo.Tag)
+	armada, err := trepo.Ensure(ctx, "project/armada")
+	catch(t, err)
+
+	crate, err := hold.NewCrate("external")
+	catch(t, err)
+	catch(t, crate.Set("type", []byte("test")))
+	catch(t, crate.Set("name", []byte("test")))
+	catch(t, crate.Set("body", []byte("test")))
+	catch(t, crate.Save(ctx))
+	catch(t, crate.Map(ctx, armada))
+
+	erepo, err := hold.NewRepo("external")
+	catch(t, err)
+
+	id, _ := crate.ExportMetadata()
+	catch(t, crate.Delete(ctx))
+
+	_, err = erepo.Get(ctx, id)
+	if err != sql.ErrNoRows {
+		t.Fatalf("Did not hide trashed crate: %v", err)
+	}
+
+	if StreamSize(erepo.All(ctx)) != 0 || StreamSize(erepo.Trash(ctx)) != 1 {
+		t.Fatal("Did not move crate to trash")
+	}
+
+	catch(t, crate.Restore(ctx))
+
+	external, err := erepo.Get(ctx, id)
+	catch(t, err)
+	catch(t, erepo.(*repo.External).Hydrate(ctx, external))
+
+	if len(external.(*model.External).Tags) != 1 {
+		t.Fatal("Did not keep mappings through the trash")
+	}
+
+	project, err := trepo.Path(ctx, "project")
+	catch(t, err)
+	catch(t, project.Delete(ctx))
+
+	count := StreamSize(erepo.(repo.Tagger).Tagged(ctx, "project/armada"))
+	if count != 0 || StreamSize(trepo.Trash(ctx)) != 2 {
+		t.Fatalf("Did not trash subtree: %d", count)
+	}
+
+	catch(t, project.Restore(ctx))
+
+	count = StreamSize(erepo.(repo.Tagger).Tagged(ctx, "project/armada"))
+	if count != 1 {
+		t.Fatalf("Did not restore subtree: %d", count)
+	}
+
+	catch(t, crate.Delete(ctx))
+	purged, err := hold.Purge(ctx)
+	catch(t, err)
+
+	if purged != 0 {
+		t.Fatalf("Purged before retention: %d", purged)
+	}
+
+	purged, err = model.Purge(ctx, hold.Store, Now().Add(2 * time.Hour))
+	catch(t, err)
+
+	if purged != 1 || StreamSize(erepo.Find(ctx, repo.NewQuery().WithTrash())) != 0 {
+		t.Fatalf("Did not purge trash: %d", purged)
+	}
+
+	catch(t, armada.Delete(ctx))
+	catch(t, armada.Delete(ctx))
+
+	if StreamSize(trepo.Find(ctx, repo.NewQuery().WithTrash())) != 1 {
+		t.Fatal("Did not delete trashed tag outright")
+	}
+
+	catch(t, project.Delete(ctx))
+	purged, err = hold.Empty(ctx)
+	catch(t, err)
+
+	if purged != 1 || StreamSize(trepo.Find(ctx, repo.NewQuery().WithTrash())) != 0 {
+		t.Fatalf("Did not empty trash: %d", purged)
+	}
+}
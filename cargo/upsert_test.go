@@ -0,0 +1,164 @@
+package cargo
+
+import (
+	"testing"
+	"bytes"
+	"context"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/aewens/nautical/cargo/model"
+	"github.com/aewens/nautical/cargo/repo"
+)
+
+func TestUpsert(t *testing.T) {
+	ctx := context.Background()
+	_, err := New(":memory:", WithNaturalKey("internal", "origin", "size"))
+	if err == nil {
+		t.Fatal("Accepted invalid natural key")
+	}
+
+	hold, err := New(":memory:",
+		WithNaturalKey("internal", "origin", "type", "hash"),
+		WithNaturalKey("tag", "label"),
+		WithSoftDelete(0),
+	)
+	catch(t, err)
+
+	defer hold.Store.Close()
+
+	external, err := hold.NewCrate("external")
+	catch(t, err)
+	catch(t, external.Set("type", []byte("note")))
+	catch(t, external.Set("name", []byte("draft")))
+	catch(t, external.Set("body", []byte("first")))
+	catch(t, external.Upsert(ctx))
+
+	catch(t, external.Set("body", []byte("second")))
+	catch(t, external.Upsert(ctx))
+
+	entity, err := hold.NewRepo("external")
+	catch(t, err)
+
+	if StreamSize(entity.All(ctx)) != 1 {
+		t.Fatal("Did not upsert by UUID")
+	}
+
+	// without a natural key for externals a new UUID is a new crate
+	copied, err := hold.NewCrate("external")
+	catch(t, err)
+	catch(t, copied.Set("type", []byte("note")))
+	catch(t, copied.Set("name", []byte("draft")))
+	catch(t, copied.Set("body", []byte("second")))
+	catch(t, copied.Upsert(ctx))
+
+	if StreamSize(entity.All(ctx)) != 2 {
+		t.Fatal("Matched external without natural key")
+	}
+
+	imports := func(data string) []model.Entity {
+		entities, err := internals(hold, 3)
+		catch(t, err)
+
+		entities[2].(*model.Internal).Data = []byte(data)
+		return entities
+	}
+
+	entity, err = hold.NewRepo("internal")
+	catch(t, err)
+
+	irepo := entity.(*repo.Internal)
+	first := imports("capture2")
+	catch(t, irepo.UpsertAll(ctx, first...))
+	catch(t, irepo.UpsertAll(ctx, imports("capture2")...))
+
+	if StreamSize(irepo.All(ctx)) != 3 {
+		t.Fatal("Did not upsert by natural key")
+	}
+
+	again := imports("changed")
+	catch(t, irepo.UpsertAll(ctx, again...))
+
+	if StreamSize(irepo.All(ctx)) != 4 {
+		t.Fatal("Matched internal with different hash")
+	}
+
+	original := first[0].(*model.Internal)
+	matched := again[0].(*model.Internal)
+	if matched.ID != original.ID || !bytes.Equal(matched.UUID, original.UUID) {
+		t.Fatal("Did not take over matched crate")
+	}
+
+	// data still stored inline, from before blobs, is matched by its hash too
+	result, err := hold.Store.Exec(`
+		INSERT INTO internal (uuid, type, origin, data)
+		VALUES (randomblob(32), 'legacy', 'ingest', CAST('inline' AS BLOB));
+	`)
+	catch(t, err)
+
+	inline, err := result.LastInsertId()
+	catch(t, err)
+
+	legacy, err := model.NewInternal(hold.Vault())
+	catch(t, err)
+
+	legacy.Type = "legacy"
+	legacy.Origin = "ingest"
+	legacy.Data = []byte("inline")
+	catch(t, legacy.Upsert(ctx))
+
+	if legacy.ID != inline || StreamSize(irepo.Equals(ctx, "type", "legacy")) != 1 {
+		t.Fatal("Did not match inline data by hash")
+	}
+
+	var indexed int
+	err = hold.Store.QueryRow(`
+		SELECT COUNT(*) FROM sqlite_master
+		WHERE type = 'index' AND name = 'natural_internal_origin_type';
+	`).Scan(&indexed)
+	catch(t, err)
+
+	if indexed != 1 {
+		t.Fatal("Did not index natural key")
+	}
+
+	// a match in the trash is restored rather than updated out of sight
+	catch(t, legacy.Delete(ctx))
+
+	restored, err := model.NewInternal(hold.Vault())
+	catch(t, err)
+
+	restored.Type = "legacy"
+	restored.Origin = "ingest"
+	restored.Data = []byte("inline")
+	catch(t, restored.Upsert(ctx))
+
+	if restored.ID != inline || StreamSize(irepo.Equals(ctx, "type", "legacy")) != 1 {
+		t.Fatal("Did not restore match from the trash")
+	}
+
+	tag, err := hold.NewTag()
+	catch(t, err)
+	catch(t, tag.Set("label", []byte("imported")))
+	catch(t, tag.Upsert(ctx))
+
+	relabel, err := hold.NewTag()
+	catch(t, err)
+	catch(t, relabel.Set("label", []byte("imported")))
+	catch(t, relabel.Set("flag", []byte{1}))
+	catch(t, relabel.Upsert(ctx))
+
+	if relabel.ID != tag.ID {
+		t.Fatal("Did not upsert tag by label")
+	}
+
+	catch(t, tag.Alias(ctx, "import"))
+
+	aliased, err := hold.NewTag()
+	catch(t, err)
+	catch(t, aliased.Set("label", []byte("import")))
+	catch(t, aliased.Upsert(ctx))
+
+	if aliased.ID != tag.ID || aliased.Label != "imported" {
+		t.Fatalf("Did not upsert tag by alias: %s", aliased.Label)
+	}
+}